@@ -0,0 +1,321 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const DATE_FORMAT = "2006-01-02"
+
+type ArchiveKind string
+
+const (
+	ARCHIVE_METADATA ArchiveKind = "metadata"
+	ARCHIVE_MAILDIR  ArchiveKind = "maildir"
+)
+
+var ARCHIVE_NAME_PATTERN = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2})\.(.+)\.(metadata|maildir)$`)
+var ARCHIVE_BASE_PATTERN = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2})\.(.+)$`)
+
+// ArchiveName is a parsed tarsnap archive name
+//
+//	YYYY-MM-DD.HOST.metadata
+//	YYYY-MM-DD.HOST.USER.maildir
+//
+// HOST and USER may both contain dots; a maildir archive name is split using
+// the hosts known from metadata archives, falling back to a dotless host.
+type ArchiveName struct {
+	Name string
+	Date time.Time
+	Host string
+	User string `json:",omitempty"`
+	Kind ArchiveKind
+}
+
+func (a *ArchiveName) DateString() string {
+	return a.Date.Format(DATE_FORMAT)
+}
+
+// Base returns the archive base name YYYY-MM-DD.HOST
+func (a *ArchiveName) Base() string {
+	return a.DateString() + "." + a.Host
+}
+
+func (a *ArchiveName) String() string {
+	return a.Name
+}
+
+func MetadataArchiveName(base string) string {
+	return base + "." + string(ARCHIVE_METADATA)
+}
+
+func MaildirArchiveName(base, user string) string {
+	return base + "." + user + "." + string(ARCHIVE_MAILDIR)
+}
+
+// ParseArchiveBase splits an archive base name into date and host
+func ParseArchiveBase(base string) (time.Time, string, error) {
+	match := ARCHIVE_BASE_PATTERN.FindStringSubmatch(base)
+	if len(match) != 3 {
+		return time.Time{}, "", fmt.Errorf("invalid archive base name: %s", base)
+	}
+	date, err := time.Parse(DATE_FORMAT, match[1])
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("invalid archive date in %s: %v", base, err)
+	}
+	return date, match[2], nil
+}
+
+// ParseArchiveName parses a tarsnap archive name; hosts, if given, are used to split maildir archive names
+func ParseArchiveName(name string, hosts ...string) (*ArchiveName, error) {
+	match := ARCHIVE_NAME_PATTERN.FindStringSubmatch(name)
+	if len(match) != 4 {
+		return nil, fmt.Errorf("unrecognized archive name: %s", name)
+	}
+	date, err := time.Parse(DATE_FORMAT, match[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid archive date in %s: %v", name, err)
+	}
+	a := ArchiveName{
+		Name: name,
+		Date: date,
+		Kind: ArchiveKind(match[3]),
+	}
+	if a.Kind == ARCHIVE_METADATA {
+		a.Host = match[2]
+		return &a, nil
+	}
+	hostUser := match[2]
+	for _, host := range hosts {
+		if len(host) > len(a.Host) && strings.HasPrefix(hostUser, host+".") {
+			a.Host = host
+		}
+	}
+	if a.Host == "" {
+		host, _, found := strings.Cut(hostUser, ".")
+		if !found {
+			return nil, fmt.Errorf("missing user in maildir archive name: %s", name)
+		}
+		a.Host = host
+	}
+	a.User = strings.TrimPrefix(hostUser, a.Host+".")
+	if a.User == "" {
+		return nil, fmt.Errorf("missing user in maildir archive name: %s", name)
+	}
+	return &a, nil
+}
+
+// ParseArchiveList parses archive names, resolving maildir hosts from the metadata archives of the same day
+// Names that cannot be parsed are returned separately
+func ParseArchiveList(names []string) ([]*ArchiveName, []string) {
+	archives := []*ArchiveName{}
+	unparsed := []string{}
+	dayHosts := make(map[string][]string)
+	allHosts := make(map[string]bool)
+	maildirs := []string{}
+	for _, name := range names {
+		if strings.HasSuffix(name, "."+string(ARCHIVE_METADATA)) {
+			a, err := ParseArchiveName(name)
+			if err != nil {
+				unparsed = append(unparsed, name)
+				continue
+			}
+			dayHosts[a.DateString()] = append(dayHosts[a.DateString()], a.Host)
+			allHosts[a.Host] = true
+			archives = append(archives, a)
+		} else {
+			maildirs = append(maildirs, name)
+		}
+	}
+	hosts := []string{}
+	for host := range allHosts {
+		hosts = append(hosts, host)
+	}
+	for _, name := range maildirs {
+		match := ARCHIVE_NAME_PATTERN.FindStringSubmatch(name)
+		if len(match) != 4 {
+			unparsed = append(unparsed, name)
+			continue
+		}
+		// prefer hosts with a metadata archive on the same day
+		sameDay := dayHosts[match[1]]
+		a, err := ParseArchiveName(name, sameDay...)
+		if err == nil && !slices.Contains(sameDay, a.Host) {
+			a, err = ParseArchiveName(name, hosts...)
+		}
+		if err != nil {
+			unparsed = append(unparsed, name)
+			continue
+		}
+		archives = append(archives, a)
+	}
+	SortArchives(archives)
+	return archives, unparsed
+}
+
+func SortArchives(archives []*ArchiveName) {
+	sort.Slice(archives, func(i, j int) bool {
+		a, b := archives[i], archives[j]
+		if a.Host != b.Host {
+			return a.Host < b.Host
+		}
+		if !a.Date.Equal(b.Date) {
+			return a.Date.Before(b.Date)
+		}
+		if a.Kind != b.Kind {
+			return a.Kind == ARCHIVE_METADATA
+		}
+		return a.User < b.User
+	})
+}
+
+// ArchiveDay is the set of archives written by one host's backup on one day
+type ArchiveDay struct {
+	Host     string
+	Date     string
+	Metadata string            `json:",omitempty"`
+	Maildirs map[string]string `json:",omitempty"`
+}
+
+func (d *ArchiveDay) Base() string {
+	return d.Date + "." + d.Host
+}
+
+func (d *ArchiveDay) Users() []string {
+	users := []string{}
+	for user := range d.Maildirs {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	return users
+}
+
+// GroupArchives returns the archives grouped by host and date
+func GroupArchives(archives []*ArchiveName) map[string]map[string]*ArchiveDay {
+	groups := make(map[string]map[string]*ArchiveDay)
+	for _, a := range archives {
+		days, ok := groups[a.Host]
+		if !ok {
+			days = make(map[string]*ArchiveDay)
+			groups[a.Host] = days
+		}
+		day, ok := days[a.DateString()]
+		if !ok {
+			day = &ArchiveDay{Host: a.Host, Date: a.DateString(), Maildirs: make(map[string]string)}
+			days[a.DateString()] = day
+		}
+		switch a.Kind {
+		case ARCHIVE_METADATA:
+			day.Metadata = a.Name
+		case ARCHIVE_MAILDIR:
+			day.Maildirs[a.User] = a.Name
+		}
+	}
+	return groups
+}
+
+func SortedKeys[V any](m map[string]V) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ParseDate accepts YYYY-MM-DD, today or yesterday
+func ParseDate(value string) (time.Time, error) {
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	switch strings.ToLower(value) {
+	case "today":
+		return today, nil
+	case "yesterday":
+		return today.AddDate(0, 0, -1), nil
+	}
+	date, err := time.Parse(DATE_FORMAT, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date '%s': expected YYYY-MM-DD, today or yesterday", value)
+	}
+	return date, nil
+}
+
+// ResolveArchive selects an archive base name from the metadata archives matching host and date
+// If date is zero, the latest matching archive is selected
+func ResolveArchive(archives []*ArchiveName, host string, date time.Time) (string, error) {
+	hosts := make(map[string]bool)
+	var selected *ArchiveName
+	for _, a := range archives {
+		if a.Kind != ARCHIVE_METADATA {
+			continue
+		}
+		if host != "" && a.Host != host {
+			continue
+		}
+		if !date.IsZero() && !a.Date.Equal(date) {
+			continue
+		}
+		hosts[a.Host] = true
+		if selected == nil || a.Date.After(selected.Date) {
+			selected = a
+		}
+	}
+	if selected == nil {
+		if date.IsZero() {
+			return "", fmt.Errorf("no archives found for host '%s'", host)
+		}
+		return "", fmt.Errorf("no archive found for host '%s' on %s", host, date.Format(DATE_FORMAT))
+	}
+	if len(hosts) > 1 {
+		return "", fmt.Errorf("multiple hosts match; select one with --host: %s", strings.Join(SortedKeys(hosts), " "))
+	}
+	return selected.Base(), nil
+}
+
+// ArchiveBaseName returns the archive base name from the command line arguments or options,
+// querying tarsnap when --latest or --date are given
+func ArchiveBaseName(args []string) (string, error) {
+	if len(args) > 0 {
+		return args[0], nil
+	}
+	latest := viper.GetBool("latest")
+	dateValue := viper.GetString("date")
+	if !latest && dateValue == "" {
+		name := viper.GetString("archive")
+		if name == "" {
+			return "", fmt.Errorf("archive name required: use ARCHIVE_NAME, --archive, --latest or --date")
+		}
+		return name, nil
+	}
+	var date time.Time
+	if dateValue != "" {
+		if latest {
+			return "", fmt.Errorf("--latest and --date are mutually exclusive")
+		}
+		var err error
+		date, err = ParseDate(dateValue)
+		if err != nil {
+			return "", err
+		}
+	}
+	names, err := ListArchives()
+	if err != nil {
+		return "", err
+	}
+	archives, _ := ParseArchiveList(names)
+	name, err := ResolveArchive(archives, viper.GetString("host"), date)
+	if err != nil {
+		return "", err
+	}
+	if viper.GetBool("verbose") {
+		slog.Info("resolved archive", "archive", name)
+	}
+	return name, nil
+}
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestArchiveParseName(t *testing.T) {
+	a, err := ParseArchiveName("2025-03-01.mail1.example.com.metadata")
+	require.Nil(t, err)
+	require.Equal(t, ARCHIVE_METADATA, a.Kind)
+	require.Equal(t, "mail1.example.com", a.Host)
+	require.Equal(t, "2025-03-01.mail1.example.com", a.Base())
+
+	a, err = ParseArchiveName("2025-03-01.mail1.example.com.john.doe.maildir", "mail1", "mail1.example.com")
+	require.Nil(t, err)
+	require.Equal(t, ARCHIVE_MAILDIR, a.Kind)
+	require.Equal(t, "mail1.example.com", a.Host)
+	require.Equal(t, "john.doe", a.User)
+
+	a, err = ParseArchiveName("2025-03-01.mail1.alice.maildir")
+	require.Nil(t, err)
+	require.Equal(t, "mail1", a.Host)
+	require.Equal(t, "alice", a.User)
+
+	_, err = ParseArchiveName("2025-03-01.mail1.maildir")
+	require.NotNil(t, err)
+	_, err = ParseArchiveName("2025-13-01.mail1.metadata")
+	require.NotNil(t, err)
+	_, err = ParseArchiveName("random-archive")
+	require.NotNil(t, err)
+}
+
+func TestArchiveParseList(t *testing.T) {
+	names := []string{
+		"2025-03-02.mx.example.org.bob.maildir",
+		"2025-03-01.mx.example.org.metadata",
+		"2025-03-01.mx.example.org.bob.maildir",
+		"2025-03-02.mx.example.org.metadata",
+		"2025-03-02.mail1.metadata",
+		"2025-03-02.mail1.alice.maildir",
+		"something-else",
+	}
+	archives, unparsed := ParseArchiveList(names)
+	require.Equal(t, []string{"something-else"}, unparsed)
+	require.Len(t, archives, 6)
+	for _, a := range archives {
+		if a.Kind == ARCHIVE_MAILDIR {
+			require.Contains(t, []string{"alice", "bob"}, a.User)
+		}
+	}
+	groups := GroupArchives(archives)
+	require.Len(t, groups, 2)
+	require.Equal(t, []string{"bob"}, groups["mx.example.org"]["2025-03-02"].Users())
+
+	name, err := ResolveArchive(archives, "mx.example.org", time.Time{})
+	require.Nil(t, err)
+	require.Equal(t, "2025-03-02.mx.example.org", name)
+
+	date, err := ParseDate("2025-03-01")
+	require.Nil(t, err)
+	name, err = ResolveArchive(archives, "mx.example.org", date)
+	require.Nil(t, err)
+	require.Equal(t, "2025-03-01.mx.example.org", name)
+
+	_, err = ResolveArchive(archives, "", time.Time{})
+	require.NotNil(t, err)
+}
@@ -0,0 +1,275 @@
+package cmd
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// output layouts of streamed files
+const (
+	// OUTPUT_LAYOUT_MAILDIR keeps the archived USER/Maildir/... paths
+	OUTPUT_LAYOUT_MAILDIR = "maildir"
+	// OUTPUT_LAYOUT_FOLDERS writes USER/FOLDER/cur/NAME using the folder display names
+	OUTPUT_LAYOUT_FOLDERS = "folders"
+)
+
+// output archive formats
+const (
+	ARCHIVE_FORMAT_TAR    = "tar"
+	ARCHIVE_FORMAT_TAR_GZ = "tar.gz"
+	ARCHIVE_FORMAT_ZIP    = "zip"
+)
+
+// OutputArchiveFormat returns the archive format of filename: tar.gz for .tar.gz and .tgz,
+// zip for .zip, and tar for .tar and - (stdout)
+func OutputArchiveFormat(filename string) (string, error) {
+	lower := strings.ToLower(filename)
+	switch {
+	case filename == "-" || strings.HasSuffix(lower, ".tar"):
+		return ARCHIVE_FORMAT_TAR, nil
+	case strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".tgz"):
+		return ARCHIVE_FORMAT_TAR_GZ, nil
+	case strings.HasSuffix(lower, ".zip"):
+		return ARCHIVE_FORMAT_ZIP, nil
+	}
+	return "", fmt.Errorf("unknown output archive format: %s (use .tar, .tar.gz, .tgz, .zip or -)", filename)
+}
+
+// FolderLayout replaces the archived path of each entry with USER/FOLDER/cur/NAME for
+// messages and USER/FOLDER/NAME for other files, FOLDER being the folder display name;
+// mailbox metadata is written to USER/NAME
+type FolderLayout struct {
+	next EntrySink
+}
+
+// FolderLayoutPath returns the folder layout target of entry
+func FolderLayoutPath(entry *StreamEntry) string {
+	components := []string{AttachmentFilename(entry.User, "user")}
+	if entry.Maildir != MAILBOX_FOLDER {
+		for _, component := range strings.Split(entry.Folder, "/") {
+			components = append(components, AttachmentFilename(component, "folder"))
+		}
+	}
+	name := path.Base(entry.Name)
+	if IsMessageFile(entry.Name) {
+		components = append(components, path.Base(path.Dir(entry.Name)))
+	}
+	return ArchivePath(path.Join(append(components, name)...))
+}
+
+func (l *FolderLayout) Write(entry *StreamEntry, content io.Reader) (string, error) {
+	layout := *entry
+	layout.Target = FolderLayoutPath(entry)
+	return l.next.Write(&layout, content)
+}
+
+func (l *FolderLayout) Close() error {
+	return l.next.Close()
+}
+
+// ArchiveSink writes entries to a tar, gzip compressed tar or zip archive
+// The cur, new and tmp directories of each message folder are added so that
+// extracted folders are complete Maildirs.
+type ArchiveSink struct {
+	gzip  *gzip.Writer
+	tar   *tar.Writer
+	zip   *zip.Writer
+	dirs  map[string]bool
+	names map[string]bool
+}
+
+func NewArchiveSink(output io.Writer, format string) (*ArchiveSink, error) {
+	s := ArchiveSink{dirs: make(map[string]bool), names: make(map[string]bool)}
+	switch format {
+	case ARCHIVE_FORMAT_TAR:
+		s.tar = tar.NewWriter(output)
+	case ARCHIVE_FORMAT_TAR_GZ:
+		s.gzip = gzip.NewWriter(output)
+		s.tar = tar.NewWriter(s.gzip)
+	case ARCHIVE_FORMAT_ZIP:
+		s.zip = zip.NewWriter(output)
+	default:
+		return nil, fmt.Errorf("unknown output archive format: %s", format)
+	}
+	return &s, nil
+}
+
+func (s *ArchiveSink) Write(entry *StreamEntry, content io.Reader) (string, error) {
+	name := strings.TrimPrefix(ArchivePath(entry.Target), "./")
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		return "", fmt.Errorf("invalid target path: %s", entry.Target)
+	}
+	if s.names[name] {
+		return "", fmt.Errorf("duplicate output archive path: %s", name)
+	}
+	s.names[name] = true
+	mode := entry.Mode
+	if mode == 0 {
+		mode = 0600
+	}
+	if IsMessageFile(name) {
+		folder := path.Dir(path.Dir(name))
+		for _, subdir := range MAILDIR_SUBDIRS {
+			err := s.addDir(path.Join(folder, subdir), entry)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	if s.zip != nil {
+		header := zip.FileHeader{Name: name, Method: zip.Deflate, Modified: entry.ModTime}
+		header.SetMode(mode)
+		writer, err := s.zip.CreateHeader(&header)
+		if err != nil {
+			return "", fmt.Errorf("failed writing output archive: %v", err)
+		}
+		_, err = io.Copy(writer, content)
+		if err != nil {
+			return "", fmt.Errorf("failed writing output archive: %s: %v", name, err)
+		}
+		return ArchivePath(name), nil
+	}
+	header := tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     entry.Size,
+		Mode:     int64(mode),
+		ModTime:  entry.ModTime,
+		Format:   tar.FormatPAX,
+	}
+	err := s.tar.WriteHeader(&header)
+	if err != nil {
+		return "", fmt.Errorf("failed writing output archive: %v", err)
+	}
+	_, err = io.Copy(s.tar, content)
+	if err != nil {
+		return "", fmt.Errorf("failed writing output archive: %s: %v", name, err)
+	}
+	return ArchivePath(name), nil
+}
+
+func (s *ArchiveSink) addDir(dir string, entry *StreamEntry) error {
+	if s.dirs[dir] {
+		return nil
+	}
+	s.dirs[dir] = true
+	if s.zip != nil {
+		header := zip.FileHeader{Name: dir + "/", Modified: entry.ModTime}
+		header.SetMode(os.ModeDir | 0700)
+		_, err := s.zip.CreateHeader(&header)
+		if err != nil {
+			return fmt.Errorf("failed writing output archive: %v", err)
+		}
+		return nil
+	}
+	header := tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     dir + "/",
+		Mode:     0700,
+		ModTime:  entry.ModTime,
+		Format:   tar.FormatPAX,
+	}
+	err := s.tar.WriteHeader(&header)
+	if err != nil {
+		return fmt.Errorf("failed writing output archive: %v", err)
+	}
+	return nil
+}
+
+func (s *ArchiveSink) Close() error {
+	var err error
+	if s.zip != nil {
+		err = s.zip.Close()
+	} else {
+		err = s.tar.Close()
+		if s.gzip != nil {
+			gerr := s.gzip.Close()
+			if err == nil {
+				err = gerr
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed writing output archive: %v", err)
+	}
+	return nil
+}
+
+// RestoreArchive streams the selected files into the output archive filename, or to stdout if filename is -
+// The archive is written under a temporary name and renamed when complete; an existing
+// file is replaced only under the overwrite policy.
+func (t *Tarsnap) RestoreArchive(ctx context.Context, filename string) error {
+	if viper.GetBool("mbox") {
+		return fmt.Errorf("--mbox cannot be combined with --output-archive")
+	}
+	format, err := OutputArchiveFormat(filename)
+	if err != nil {
+		return err
+	}
+	if filename == "-" {
+		archive, err := NewArchiveSink(os.Stdout, format)
+		if err != nil {
+			return err
+		}
+		sink, err := StreamFilters(archive)
+		if err != nil {
+			return err
+		}
+		restores, err := t.streamRestores("")
+		if err != nil {
+			return err
+		}
+		return t.guardedRestore(ctx, restores, sink)
+	}
+
+	filename = ExpandPath(filename)
+	policy, err := OverwritePolicyOption()
+	if err != nil {
+		return err
+	}
+	if IsFile(filename) && policy != OVERWRITE {
+		return fmt.Errorf("output archive exists: %s", filename)
+	}
+	restores, err := t.streamRestores(filepath.Dir(filename))
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*")
+	if err != nil {
+		return fmt.Errorf("failed creating output archive: %v", err)
+	}
+	temp := file.Name()
+	archive, err := NewArchiveSink(file, format)
+	var sink EntrySink
+	if err == nil {
+		sink, err = StreamFilters(archive)
+	}
+	if err == nil {
+		err = t.guardedRestore(ctx, restores, sink)
+	}
+	cerr := file.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(temp, filename)
+	}
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+	if t.verbose {
+		t.logger.Info("output archive written", "file", filename, "format", format)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutputArchiveFormat(t *testing.T) {
+	for filename, expected := range map[string]string{
+		"-":              ARCHIVE_FORMAT_TAR,
+		"mail.tar":       ARCHIVE_FORMAT_TAR,
+		"mail.tar.gz":    ARCHIVE_FORMAT_TAR_GZ,
+		"/tmp/MAIL.TGZ":  ARCHIVE_FORMAT_TAR_GZ,
+		"alice.mail.zip": ARCHIVE_FORMAT_ZIP,
+	} {
+		format, err := OutputArchiveFormat(filename)
+		require.Nil(t, err)
+		require.Equal(t, expected, format, filename)
+	}
+	_, err := OutputArchiveFormat("mail.7z")
+	require.NotNil(t, err)
+}
+
+func TestFolderLayoutPath(t *testing.T) {
+	entry := StreamEntry{Name: "./alice/Maildir/.Archive.2024/cur/1.M1P1.host:2,S", User: "alice", Maildir: ".Archive.2024", Folder: "Archive/2024"}
+	require.Equal(t, "./alice/Archive/2024/cur/1.M1P1.host:2,S", FolderLayoutPath(&entry))
+	entry = StreamEntry{Name: "./alice/Maildir/dovecot-uidlist", User: "alice", Maildir: "INBOX", Folder: "INBOX"}
+	require.Equal(t, "./alice/INBOX/dovecot-uidlist", FolderLayoutPath(&entry))
+	entry = StreamEntry{Name: "./alice/Maildir/subscriptions", User: "alice", Maildir: MAILBOX_FOLDER, Folder: "(mailbox)"}
+	require.Equal(t, "./alice/subscriptions", FolderLayoutPath(&entry))
+	entry = StreamEntry{Name: "./alice/Maildir/.x/cur/1:2,S", User: "alice", Maildir: ".x", Folder: "../x"}
+	require.Equal(t, "./alice/folder/x/cur/1:2,S", FolderLayoutPath(&entry))
+}
+
+func archiveSinkEntries(t *testing.T, sink EntrySink) {
+	name := "./alice/Maildir/.Sent/cur/1.M1P1.host:2,S"
+	entry := StreamEntry{Name: name, Target: name, User: "alice", Maildir: ".Sent", Folder: "Sent", Size: 6, ModTime: time.Date(2024, 4, 1, 10, 0, 0, 0, time.UTC), Mode: 0600}
+	_, err := sink.Write(&entry, strings.NewReader("hello\n"))
+	require.Nil(t, err)
+	_, err = sink.Write(&entry, strings.NewReader("hello\n"))
+	require.NotNil(t, err)
+}
+
+func TestArchiveSinkTar(t *testing.T) {
+	var buf bytes.Buffer
+	archive, err := NewArchiveSink(&buf, ARCHIVE_FORMAT_TAR_GZ)
+	require.Nil(t, err)
+	sink := &FolderLayout{next: archive}
+	archiveSinkEntries(t, sink)
+	require.Nil(t, sink.Close())
+
+	input, err := gzip.NewReader(&buf)
+	require.Nil(t, err)
+	reader := tar.NewReader(input)
+	names := []string{}
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.Nil(t, err)
+		names = append(names, header.Name)
+		if header.Typeflag == tar.TypeReg {
+			data, err := io.ReadAll(reader)
+			require.Nil(t, err)
+			require.Equal(t, "hello\n", string(data))
+			require.Equal(t, int64(0600), header.Mode)
+		}
+	}
+	require.Equal(t, []string{"alice/Sent/cur/", "alice/Sent/new/", "alice/Sent/tmp/", "alice/Sent/cur/1.M1P1.host:2,S"}, names)
+}
+
+func TestArchiveSinkZip(t *testing.T) {
+	var buf bytes.Buffer
+	archive, err := NewArchiveSink(&buf, ARCHIVE_FORMAT_ZIP)
+	require.Nil(t, err)
+	archiveSinkEntries(t, archive)
+	escape := StreamEntry{Name: "./alice/../../escape", Target: "./alice/../../escape", Size: 1}
+	_, err = archive.Write(&escape, strings.NewReader("x"))
+	require.NotNil(t, err)
+	require.Nil(t, archive.Close())
+
+	reader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.Nil(t, err)
+	require.Len(t, reader.File, 4)
+	file := reader.File[3]
+	require.Equal(t, "alice/Maildir/.Sent/cur/1.M1P1.host:2,S", file.Name)
+	content, err := file.Open()
+	require.Nil(t, err)
+	data, err := io.ReadAll(content)
+	require.Nil(t, err)
+	require.Equal(t, "hello\n", string(data))
+	require.True(t, reader.File[0].FileInfo().IsDir())
+}
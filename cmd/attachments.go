@@ -0,0 +1,337 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// ATTACHMENT_MANIFEST is the CSV manifest written to the output directory by the attachments command
+const ATTACHMENT_MANIFEST = "attachments.csv"
+
+var ATTACHMENT_MANIFEST_COLUMNS = []string{"file", "media_type", "size", "sha256", "archive", "message", "user", "maildir", "from", "date", "subject", "message_id"}
+
+var UNSAFE_FILENAME_PATTERN = regexp.MustCompile(`[/\\\x00-\x1f]`)
+
+var attachmentsCmd = &cobra.Command{
+	Use:   "attachments [ARCHIVE_NAME]",
+	Short: "extract message attachments",
+	Long: `
+Restore the messages selected from ARCHIVE_NAME to a temporary directory
+and write their decoded attachments to the output directory, one
+directory per message:
+
+  OUTPUT_DIR/USER/FOLDER/UNIQUE/FILENAME
+
+--from, --to, --subject, --since and --before select messages by their
+headers, and --attachment-pattern selects attachments by filename or
+media type, for example 'pdf$'. The restored messages are removed when
+done.
+
+The CSV manifest OUTPUT_DIR/attachments.csv lists each attachment file
+with its media type, size and SHA-256, and the archive path, sender, date,
+subject and Message-ID of its message. An existing manifest is not
+replaced; use an empty output directory for each extraction.
+`,
+	Args: cobra.RangeArgs(0, 1),
+	Run: func(cmd *cobra.Command, args []string) {
+		archiveName, err := ArchiveBaseName(args)
+		cobra.CheckErr(err)
+		query, err := SearchQuery([]string{})
+		cobra.CheckErr(err)
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		summary, err := ExtractAttachments(ctx, archiveName, query)
+		if summary != nil {
+			if viper.GetBool("json") {
+				fmt.Println(FormatJSON(summary))
+			} else {
+				fmt.Printf("%s: %d attachments from %d of %d messages written to %s\n", summary.Archive, summary.Attachments, summary.Matched, summary.Messages, summary.Manifest)
+			}
+		}
+		cobra.CheckErr(err)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(attachmentsCmd)
+}
+
+// AttachmentSummary reports the result of an attachments extraction
+type AttachmentSummary struct {
+	Archive     string
+	Manifest    string
+	Messages    int
+	Matched     int
+	Attachments int
+	Failed      int
+}
+
+// ExtractAttachments restores the selected messages to a scratch directory and writes the
+// attachments of those matching query to the output directory with a CSV manifest
+func ExtractAttachments(ctx context.Context, archiveName string, query *CatalogQuery) (*AttachmentSummary, error) {
+	outputDir := ExpandPath(viper.GetString("output_dir"))
+	var pattern *regexp.Regexp
+	if viper.GetString("attachment_pattern") != "" {
+		var err error
+		pattern, err = regexp.Compile(viper.GetString("attachment_pattern"))
+		if err != nil {
+			return nil, fmt.Errorf("failed attachment pattern regexp compile: %v", err)
+		}
+	}
+	err := os.MkdirAll(outputDir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating output directory: %v", err)
+	}
+	lock, err := LockOutputDir(outputDir, archiveName, viper.GetBool("force_unlock"))
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+	manifestFile := filepath.Join(outputDir, ATTACHMENT_MANIFEST)
+	if IsFile(manifestFile) {
+		return nil, fmt.Errorf("attachments manifest exists: %s", manifestFile)
+	}
+
+	scratch, err := os.MkdirTemp("", "tarsnap.attachments.*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(scratch)
+	tarsnap, err := RestoreScratch(ctx, archiveName, scratch, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(manifestFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating manifest: %v", err)
+	}
+	defer file.Close()
+	manifest := csv.NewWriter(file)
+	err = manifest.Write(ATTACHMENT_MANIFEST_COLUMNS)
+	if err != nil {
+		return nil, fmt.Errorf("failed writing manifest: %v", err)
+	}
+
+	summary := AttachmentSummary{Archive: archiveName, Manifest: manifestFile}
+	summary.Messages, err = tarsnap.ScratchMessages(scratch, query, func(file MaildirFile, data []byte, headers *CatalogMessage) error {
+		message, err := ParseMIMEMessage(data)
+		if err != nil {
+			tarsnap.logger.Warn("unreadable message", "file", file.Name, "error", err)
+			summary.Failed += 1
+			return nil
+		}
+		parts := []*MessagePart{}
+		for _, part := range message.Attachments() {
+			if pattern == nil || pattern.MatchString(part.Filename) || pattern.MatchString(part.MediaType) {
+				parts = append(parts, part)
+			}
+		}
+		if len(parts) == 0 {
+			return nil
+		}
+		summary.Matched += 1
+		dir := filepath.Join(outputDir, AttachmentDir(headers, file))
+		err = writeAttachments(manifest, outputDir, dir, headers, parts)
+		if err != nil {
+			return err
+		}
+		summary.Attachments += len(parts)
+		return nil
+	})
+	if err != nil {
+		return &summary, err
+	}
+	manifest.Flush()
+	err = manifest.Error()
+	if err != nil {
+		return &summary, fmt.Errorf("failed writing manifest: %v", err)
+	}
+	return &summary, nil
+}
+
+// RestoreScratch restores the selected messages of archiveName, or only those listed in paths if not nil, to the scratch directory
+func RestoreScratch(ctx context.Context, archiveName, scratch string, paths []string) (*Tarsnap, error) {
+	defer OverrideOptions(map[string]any{"output_dir": scratch, "classes": string(CLASS_MESSAGE)})()
+	tarsnap, err := NewTarsnap(archiveName)
+	if err != nil {
+		return nil, err
+	}
+	if paths != nil {
+		err = tarsnap.SelectFiles(paths)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = tarsnap.Restore(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tarsnap, nil
+}
+
+// ScratchMessages calls fn with the data and headers of each message restored to scratch
+// that matches query, in user, maildir and path order, returning the number of messages read.
+// Messages without a parseable header are passed with only the archive fields set.
+func (t *Tarsnap) ScratchMessages(scratch string, query *CatalogQuery, fn func(MaildirFile, []byte, *CatalogMessage) error) (int, error) {
+	count := 0
+	for _, userName := range SortedKeys(t.Users) {
+		user := t.Users[userName]
+		for _, maildirName := range SortedKeys(user.Maildirs) {
+			files := slices.Clone(user.Maildirs[maildirName].Files)
+			slices.SortFunc(files, func(a, b MaildirFile) int {
+				return strings.Compare(a.Name, b.Name)
+			})
+			for _, file := range files {
+				data, err := os.ReadFile(filepath.Join(scratch, file.Name))
+				if err != nil {
+					// not extracted
+					continue
+				}
+				count += 1
+				headers, err := ParseMessageHeaders(bytes.NewReader(data))
+				if err != nil {
+					headers = &CatalogMessage{}
+				}
+				headers.Archive = t.Archive
+				headers.Path = file.Name
+				headers.User = userName
+				headers.Maildir = maildirName
+				headers.Size = file.Size
+				if headers.Date.IsZero() && file.Message != nil {
+					headers.Date = file.Message.Time
+				}
+				if !query.Match(headers) {
+					continue
+				}
+				err = fn(file, data, headers)
+				if err != nil {
+					return count, err
+				}
+			}
+		}
+	}
+	return count, nil
+}
+
+// AttachmentDir returns the directory of the attachments of a message relative to the output directory,
+// each component of the user and folder display name made safe with AttachmentFilename
+func AttachmentDir(message *CatalogMessage, file MaildirFile) string {
+	components := []string{AttachmentFilename(message.User, "user")}
+	for _, component := range strings.Split(MaildirDisplayName(message.Maildir), "/") {
+		components = append(components, AttachmentFilename(component, "folder"))
+	}
+	return filepath.Join(append(components, messageDirName(file))...)
+}
+
+// messageDirName returns the Maildir unique name of a message, or its filename if it has none
+func messageDirName(file MaildirFile) string {
+	if file.Message != nil {
+		return AttachmentFilename(file.Message.Unique, "message")
+	}
+	base, _, _ := strings.Cut(filepath.Base(file.Name), ":")
+	return AttachmentFilename(base, "message")
+}
+
+// AttachmentFilename returns name made safe for use as a single path component, or fallback if nothing usable remains
+func AttachmentFilename(name, fallback string) string {
+	name = strings.TrimSpace(UNSAFE_FILENAME_PATTERN.ReplaceAllString(name, "_"))
+	name = strings.TrimLeft(name, ".")
+	if name == "" {
+		return fallback
+	}
+	return name
+}
+
+func writeAttachments(manifest *csv.Writer, outputDir, dir string, message *CatalogMessage, parts []*MessagePart) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return fmt.Errorf("failed creating attachment directory: %v", err)
+	}
+	used := make(map[string]bool)
+	for _, part := range parts {
+		filename := AttachmentFilename(part.Filename, "part-"+part.ID)
+		if used[filename] {
+			filename = "part-" + part.ID + "-" + filename
+		}
+		used[filename] = true
+		pathname := filepath.Join(dir, filename)
+		err := os.WriteFile(pathname, part.Body, 0600)
+		if err != nil {
+			return fmt.Errorf("failed writing attachment: %v", err)
+		}
+		relative, err := filepath.Rel(outputDir, pathname)
+		if err != nil {
+			relative = pathname
+		}
+		sum := sha256.Sum256(part.Body)
+		date := ""
+		if !message.Date.IsZero() {
+			date = message.Date.Format(time.RFC3339)
+		}
+		err = manifest.Write([]string{
+			relative,
+			part.MediaType,
+			strconv.Itoa(len(part.Body)),
+			hex.EncodeToString(sum[:]),
+			message.Archive,
+			message.Path,
+			message.User,
+			message.Maildir,
+			message.From,
+			date,
+			message.Subject,
+			message.MessageID,
+		})
+		if err != nil {
+			return fmt.Errorf("failed writing manifest: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"context"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAttachmentFilename(t *testing.T) {
+	require.Equal(t, "Angebot Q3.pdf", AttachmentFilename("Angebot Q3.pdf", "part-2"))
+	require.Equal(t, "_etc_passwd", AttachmentFilename("/etc/passwd", "part-2"))
+	require.Equal(t, "part-2", AttachmentFilename("..", "part-2"))
+	require.Equal(t, "part-2", AttachmentFilename(" ", "part-2"))
+	require.Equal(t, "bashrc", AttachmentFilename(".bashrc", "part-2"))
+}
+
+func TestAttachmentDir(t *testing.T) {
+	m := Maildir{}
+	m.AddFile("./alice/Maildir/.&AC4ALg-/cur/1.M1P1.host:2,S", 10)
+	require.Equal(t, "..", MaildirDisplayName(".&AC4ALg-"))
+	message := &CatalogMessage{User: "alice", Maildir: ".&AC4ALg-"}
+	require.Equal(t, filepath.Join("alice", "folder", "1.M1P1.host"), AttachmentDir(message, m.Files[0]))
+	message = &CatalogMessage{User: "../bob", Maildir: ".Archive.2024"}
+	require.Equal(t, filepath.Join("_bob", "Archive", "2024", "1.M1P1.host"), AttachmentDir(message, m.Files[0]))
+}
+
+func TestAttachmentManifestExists(t *testing.T) {
+	outputDir := t.TempDir()
+	restore := OverrideOptions(map[string]any{"output_dir": outputDir, "attachment_pattern": "", "force_unlock": false})
+	defer restore()
+	require.Nil(t, os.WriteFile(filepath.Join(outputDir, ATTACHMENT_MANIFEST), []byte("file\n"), 0600))
+	_, err := ExtractAttachments(context.Background(), "2025-06-25.mailbox", &CatalogQuery{})
+	require.NotNil(t, err)
+	data, err := os.ReadFile(filepath.Join(outputDir, ATTACHMENT_MANIFEST))
+	require.Nil(t, err)
+	require.Equal(t, "file\n", string(data))
+}
+
+func TestWriteAttachments(t *testing.T) {
+	outputDir := t.TempDir()
+	m, err := ParseMIMEMessage([]byte(mimeTestMessage))
+	require.Nil(t, err)
+	parts := append(m.Attachments(), m.Attachments()...)
+	message := &CatalogMessage{
+		Archive: "2025-06-25.mailbox",
+		Path:    "./alice/Maildir/cur/1.M1P1.host:2,S",
+		From:    "alice@example.org",
+		Date:    time.Date(2024, 4, 2, 8, 15, 0, 0, time.UTC),
+		Subject: "Angebot für Q3",
+	}
+	file, err := os.Create(filepath.Join(outputDir, ATTACHMENT_MANIFEST))
+	require.Nil(t, err)
+	manifest := csv.NewWriter(file)
+	dir := filepath.Join(outputDir, "alice", "INBOX", "1.M1P1.host")
+	require.Nil(t, writeAttachments(manifest, outputDir, dir, message, parts))
+	manifest.Flush()
+	require.Nil(t, file.Close())
+
+	data, err := os.ReadFile(filepath.Join(dir, "Angebot Q3.pdf"))
+	require.Nil(t, err)
+	require.Equal(t, "%PDF-1.4\n", string(data))
+	require.True(t, IsFile(filepath.Join(dir, "part-2-Angebot Q3.pdf")))
+
+	file, err = os.Open(filepath.Join(outputDir, ATTACHMENT_MANIFEST))
+	require.Nil(t, err)
+	defer file.Close()
+	records, err := csv.NewReader(file).ReadAll()
+	require.Nil(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, "alice/INBOX/1.M1P1.host/Angebot Q3.pdf", records[0][0])
+	require.Equal(t, "application/pdf", records[0][1])
+	require.Equal(t, "9", records[0][2])
+	require.Equal(t, message.Path, records[0][5])
+	require.Equal(t, "2024-04-02T08:15:00Z", records[0][9])
+	require.Equal(t, "Angebot für Q3", records[0][10])
+}
+
+func TestCatalogQueryMatch(t *testing.T) {
+	m := &CatalogMessage{
+		From:    "Customer <billing@customer.example>",
+		To:      "bob@example.org",
+		Subject: "Invoice 42",
+		Date:    time.Date(2024, 4, 2, 0, 0, 0, 0, time.UTC),
+	}
+	require.True(t, (&CatalogQuery{}).Match(m))
+	require.True(t, (&CatalogQuery{From: "CUSTOMER.example", To: "bob"}).Match(m))
+	require.False(t, (&CatalogQuery{To: "alice"}).Match(m))
+	require.True(t, (&CatalogQuery{Text: []string{"invoice", "billing"}}).Match(m))
+	require.False(t, (&CatalogQuery{Since: time.Date(2024, 4, 3, 0, 0, 0, 0, time.UTC)}).Match(m))
+	require.False(t, (&CatalogQuery{Before: time.Date(2024, 4, 2, 0, 0, 0, 0, time.UTC)}).Match(m))
+}
@@ -0,0 +1,234 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "check backup completeness across all archives",
+	Long: `
+Parse every archive name associated with the tarsnap key and reconstruct
+the expected set for each host and day: one metadata archive plus one
+maildir archive for each user listed in that day's metadata.
+
+Reports days with no archives, missing user archives, orphaned archives
+and users that disappeared from the metadata.  Exits nonzero if any
+problems are found. Missing days are counted from the first archive of
+each host through --until (default today), so backups that stopped are
+reported.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		until, err := ParseDate(viper.GetString("until"))
+		cobra.CheckErr(err)
+		names, err := ListArchives()
+		cobra.CheckErr(err)
+		report, err := AuditArchives(names, viper.GetString("host"), until, metadataUsers)
+		cobra.CheckErr(err)
+		if viper.GetBool("json") {
+			fmt.Println(FormatJSON(report))
+		} else {
+			report.Print()
+		}
+		if report.Problems > 0 {
+			cobra.CheckErr(fmt.Errorf("audit found %d problems", report.Problems))
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(auditCmd)
+}
+
+type AuditEntry struct {
+	Date    string
+	User    string `json:",omitempty"`
+	Archive string `json:",omitempty"`
+}
+
+type HostAudit struct {
+	First               string
+	Last                string
+	Days                int
+	MissingDays         []string
+	MissingMetadata     []string
+	MissingUserArchives []AuditEntry
+	OrphanedArchives    []AuditEntry
+	VanishedUsers       []AuditEntry
+}
+
+func (h *HostAudit) Problems() int {
+	return len(h.MissingDays) + len(h.MissingMetadata) + len(h.MissingUserArchives) + len(h.OrphanedArchives) + len(h.VanishedUsers)
+}
+
+type AuditReport struct {
+	Hosts    map[string]*HostAudit
+	Unparsed []string
+	Problems int
+}
+
+// metadataUsers returns the users listed in a metadata archive without extracting it
+func metadataUsers(day *ArchiveDay) ([]string, error) {
+	files, err := ListArchiveFiles(day.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	users := []string{}
+	for _, file := range files {
+		filename := path.Base(file)
+		if !strings.HasSuffix(filename, LIST_FILENAME_SUFFIX) {
+			continue
+		}
+		user, err := FileListUser(day.Base(), filename)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// AuditArchives compares the archives present for each host and day with the set expected from the metadata
+// Days are expected from the first archive of each host through until, or the last archive if later.
+func AuditArchives(names []string, host string, until time.Time, listUsers func(*ArchiveDay) ([]string, error)) (*AuditReport, error) {
+	archives, unparsed := ParseArchiveList(names)
+	report := AuditReport{
+		Hosts:    make(map[string]*HostAudit),
+		Unparsed: unparsed,
+	}
+	groups := GroupArchives(archives)
+	for _, hostName := range SortedKeys(groups) {
+		if host != "" && hostName != host {
+			continue
+		}
+		days := groups[hostName]
+		dates := SortedKeys(days)
+		audit := HostAudit{
+			First:               dates[0],
+			Last:                dates[len(dates)-1],
+			Days:                len(dates),
+			MissingDays:         []string{},
+			MissingMetadata:     []string{},
+			MissingUserArchives: []AuditEntry{},
+			OrphanedArchives:    []AuditEntry{},
+			VanishedUsers:       []AuditEntry{},
+		}
+
+		first, err := time.Parse(DATE_FORMAT, audit.First)
+		if err != nil {
+			return nil, err
+		}
+		last, err := time.Parse(DATE_FORMAT, audit.Last)
+		if err != nil {
+			return nil, err
+		}
+		if until.After(last) {
+			last = until
+		}
+		for date := first; !date.After(last); date = date.AddDate(0, 0, 1) {
+			_, ok := days[date.Format(DATE_FORMAT)]
+			if !ok {
+				audit.MissingDays = append(audit.MissingDays, date.Format(DATE_FORMAT))
+			}
+		}
+
+		var previous map[string]bool
+		for _, date := range dates {
+			day := days[date]
+			if day.Metadata == "" {
+				audit.MissingMetadata = append(audit.MissingMetadata, date)
+				for _, user := range day.Users() {
+					audit.OrphanedArchives = append(audit.OrphanedArchives, AuditEntry{Date: date, User: user, Archive: day.Maildirs[user]})
+				}
+				continue
+			}
+			users, err := listUsers(day)
+			if err != nil {
+				return nil, err
+			}
+			listed := make(map[string]bool)
+			for _, user := range users {
+				listed[user] = true
+				_, ok := day.Maildirs[user]
+				if !ok {
+					audit.MissingUserArchives = append(audit.MissingUserArchives, AuditEntry{Date: date, User: user, Archive: MaildirArchiveName(day.Base(), user)})
+				}
+			}
+			for _, user := range day.Users() {
+				if !listed[user] {
+					audit.OrphanedArchives = append(audit.OrphanedArchives, AuditEntry{Date: date, User: user, Archive: day.Maildirs[user]})
+				}
+			}
+			for _, user := range SortedKeys(previous) {
+				if !listed[user] {
+					audit.VanishedUsers = append(audit.VanishedUsers, AuditEntry{Date: date, User: user})
+				}
+			}
+			previous = listed
+		}
+		report.Hosts[hostName] = &audit
+		report.Problems += audit.Problems()
+	}
+	return &report, nil
+}
+
+func (r *AuditReport) Print() {
+	for _, host := range SortedKeys(r.Hosts) {
+		audit := r.Hosts[host]
+		fmt.Printf("%s: %d days %s to %s, %d problems\n", host, audit.Days, audit.First, audit.Last, audit.Problems())
+		for _, date := range audit.MissingDays {
+			fmt.Printf("  %s missing day\n", date)
+		}
+		for _, date := range audit.MissingMetadata {
+			fmt.Printf("  %s missing metadata archive\n", date)
+		}
+		for _, entry := range audit.MissingUserArchives {
+			fmt.Printf("  %s missing user archive: %s\n", entry.Date, entry.Archive)
+		}
+		for _, entry := range audit.OrphanedArchives {
+			fmt.Printf("  %s orphaned archive: %s\n", entry.Date, entry.Archive)
+		}
+		for _, entry := range audit.VanishedUsers {
+			fmt.Printf("  %s user vanished: %s\n", entry.Date, entry.User)
+		}
+	}
+	for _, name := range r.Unparsed {
+		fmt.Printf("unrecognized archive: %s\n", name)
+	}
+}
@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestAuditArchives(t *testing.T) {
+	names := []string{
+		"2025-03-01.mail1.metadata",
+		"2025-03-01.mail1.alice.maildir",
+		"2025-03-01.mail1.bob.maildir",
+		"2025-03-03.mail1.metadata",
+		"2025-03-03.mail1.alice.maildir",
+		"2025-03-03.mail1.carol.maildir",
+	}
+	listUsers := func(day *ArchiveDay) ([]string, error) {
+		if day.Date == "2025-03-01" {
+			return []string{"alice", "bob"}, nil
+		}
+		return []string{"alice", "dave"}, nil
+	}
+	until := time.Date(2025, 3, 3, 0, 0, 0, 0, time.UTC)
+	report, err := AuditArchives(names, "", until, listUsers)
+	require.Nil(t, err)
+	audit := report.Hosts["mail1"]
+	require.NotNil(t, audit)
+	require.Equal(t, []string{"2025-03-02"}, audit.MissingDays)
+	require.Equal(t, []AuditEntry{{Date: "2025-03-03", User: "dave", Archive: "2025-03-03.mail1.dave.maildir"}}, audit.MissingUserArchives)
+	require.Equal(t, []AuditEntry{{Date: "2025-03-03", User: "carol", Archive: "2025-03-03.mail1.carol.maildir"}}, audit.OrphanedArchives)
+	require.Equal(t, []AuditEntry{{Date: "2025-03-03", User: "bob"}}, audit.VanishedUsers)
+	require.Equal(t, 4, report.Problems)
+}
+
+func TestAuditArchivesTrailingDays(t *testing.T) {
+	names := []string{
+		"2025-03-01.mail1.metadata",
+		"2025-03-01.mail1.alice.maildir",
+	}
+	listUsers := func(day *ArchiveDay) ([]string, error) {
+		return []string{"alice"}, nil
+	}
+	until := time.Date(2025, 3, 4, 0, 0, 0, 0, time.UTC)
+	report, err := AuditArchives(names, "", until, listUsers)
+	require.Nil(t, err)
+	require.Equal(t, []string{"2025-03-02", "2025-03-03", "2025-03-04"}, report.Hosts["mail1"].MissingDays)
+	require.Equal(t, 3, report.Problems)
+
+	// an until date before the last archive does not shorten the range
+	report, err = AuditArchives(names, "", until.AddDate(0, 0, -10), listUsers)
+	require.Nil(t, err)
+	require.Equal(t, 0, report.Problems)
+}
@@ -0,0 +1,347 @@
+package cmd
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// DEFAULT_CATALOG is the default header catalog database filename
+const DEFAULT_CATALOG = "~/.tarsnap-maildir-restore/catalog.db"
+
+const CATALOG_SCHEMA = `
+CREATE TABLE IF NOT EXISTS messages (
+	archive TEXT NOT NULL,
+	path TEXT NOT NULL,
+	user TEXT NOT NULL,
+	maildir TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	date TEXT NOT NULL,
+	sender TEXT NOT NULL,
+	recipients TEXT NOT NULL,
+	cc TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	message_id TEXT NOT NULL,
+	in_reply_to TEXT NOT NULL,
+	refs TEXT NOT NULL,
+	PRIMARY KEY (archive, path)
+);
+CREATE INDEX IF NOT EXISTS messages_message_id ON messages (message_id);
+CREATE INDEX IF NOT EXISTS messages_date ON messages (date);
+`
+
+const CATALOG_COLUMNS = "archive, path, user, maildir, size, date, sender, recipients, cc, subject, message_id, in_reply_to, refs"
+
+// CatalogMessage is the catalog record of an archived message
+type CatalogMessage struct {
+	Archive   string
+	Path      string
+	User      string
+	Maildir   string
+	Size      int64
+	Date      time.Time
+	From      string
+	To        string
+	Cc        string
+	Subject   string
+	MessageID string
+	InReplyTo string `json:",omitempty"`
+	// References lists the message ids of the References header separated by spaces
+	References string `json:",omitempty"`
+}
+
+// CatalogQuery selects catalog messages; empty fields are not compared
+//
+// Text words must each match the subject, sender or recipients; From, To and
+// Subject are case insensitive substrings, To matching To or Cc.
+type CatalogQuery struct {
+	Archive   string
+	Text      []string
+	From      string
+	To        string
+	Subject   string
+	MessageID string
+	Since     time.Time
+	Before    time.Time
+	Limit     int
+}
+
+// Catalog is a SQLite database of message headers indexed from the archives
+type Catalog struct {
+	Filename string
+	db       *sql.DB
+}
+
+// OpenCatalog opens the catalog database, creating it if it does not exist
+// The catalog is available on darwin, freebsd, linux, openbsd and windows.
+func OpenCatalog(filename string) (*Catalog, error) {
+	if catalogDriver == "" {
+		return nil, fmt.Errorf("the catalog is not supported on %s", runtime.GOOS)
+	}
+	filename = ExpandPath(filename)
+	err := os.MkdirAll(filepath.Dir(filename), 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating catalog directory: %v", err)
+	}
+	db, err := sql.Open(catalogDriver, filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed opening catalog: %v", err)
+	}
+	_, err = db.Exec(CATALOG_SCHEMA)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed initializing catalog %s: %v", filename, err)
+	}
+	return &Catalog{Filename: filename, db: db}, nil
+}
+
+func (c *Catalog) Close() error {
+	return c.db.Close()
+}
+
+// IndexedPaths returns the paths of archive already present in the catalog
+func (c *Catalog) IndexedPaths(archive string) (map[string]bool, error) {
+	rows, err := c.db.Query("SELECT path FROM messages WHERE archive = ?", archive)
+	if err != nil {
+		return nil, fmt.Errorf("catalog query failed: %v", err)
+	}
+	defer rows.Close()
+	paths := make(map[string]bool)
+	for rows.Next() {
+		var pathname string
+		err := rows.Scan(&pathname)
+		if err != nil {
+			return nil, fmt.Errorf("catalog query failed: %v", err)
+		}
+		paths[pathname] = true
+	}
+	return paths, rows.Err()
+}
+
+// Add stores messages in the catalog in one transaction, replacing existing records of the same paths
+func (c *Catalog) Add(messages []CatalogMessage) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return fmt.Errorf("catalog update failed: %v", err)
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare("INSERT OR REPLACE INTO messages (" + CATALOG_COLUMNS + ") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return fmt.Errorf("catalog update failed: %v", err)
+	}
+	defer stmt.Close()
+	for _, m := range messages {
+		_, err := stmt.Exec(m.Archive, m.Path, m.User, m.Maildir, m.Size, formatCatalogDate(m.Date),
+			m.From, m.To, m.Cc, m.Subject, m.MessageID, m.InReplyTo, m.References)
+		if err != nil {
+			return fmt.Errorf("catalog update failed: %s: %v", m.Path, err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("catalog update failed: %v", err)
+	}
+	return nil
+}
+
+// Search returns the messages selected by query, oldest first
+func (c *Catalog) Search(query CatalogQuery) ([]CatalogMessage, error) {
+	where := []string{}
+	args := []any{}
+	like := func(value string, columns ...string) {
+		terms := []string{}
+		for _, column := range columns {
+			terms = append(terms, column+" LIKE ? ESCAPE '\\'")
+			args = append(args, "%"+escapeLike(value)+"%")
+		}
+		where = append(where, "("+strings.Join(terms, " OR ")+")")
+	}
+	if query.Archive != "" {
+		where = append(where, "archive = ?")
+		args = append(args, query.Archive)
+	}
+	for _, word := range query.Text {
+		like(word, "subject", "sender", "recipients", "cc")
+	}
+	if query.From != "" {
+		like(query.From, "sender")
+	}
+	if query.To != "" {
+		like(query.To, "recipients", "cc")
+	}
+	if query.Subject != "" {
+		like(query.Subject, "subject")
+	}
+	if query.MessageID != "" {
+		where = append(where, "message_id = ?")
+		args = append(args, NormalizeMessageID(query.MessageID))
+	}
+	if !query.Since.IsZero() {
+		where = append(where, "date >= ?")
+		args = append(args, formatCatalogDate(query.Since))
+	}
+	if !query.Before.IsZero() {
+		where = append(where, "date < ?")
+		args = append(args, formatCatalogDate(query.Before))
+	}
+	statement := "SELECT " + CATALOG_COLUMNS + " FROM messages"
+	if len(where) > 0 {
+		statement += " WHERE " + strings.Join(where, " AND ")
+	}
+	statement += " ORDER BY date, archive, path"
+	if query.Limit > 0 {
+		statement += fmt.Sprintf(" LIMIT %d", query.Limit)
+	}
+	return c.query(statement, args...)
+}
+
+// Match returns true if the message is selected by the query, comparing as Search does
+func (q *CatalogQuery) Match(m *CatalogMessage) bool {
+	contains := func(value string, fields ...string) bool {
+		for _, field := range fields {
+			if strings.Contains(strings.ToLower(field), strings.ToLower(value)) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, word := range q.Text {
+		if !contains(word, m.Subject, m.From, m.To, m.Cc) {
+			return false
+		}
+	}
+	switch {
+	case q.Archive != "" && m.Archive != q.Archive:
+		return false
+	case q.From != "" && !contains(q.From, m.From):
+		return false
+	case q.To != "" && !contains(q.To, m.To, m.Cc):
+		return false
+	case q.Subject != "" && !contains(q.Subject, m.Subject):
+		return false
+	case q.MessageID != "" && m.MessageID != NormalizeMessageID(q.MessageID):
+		return false
+	case !q.Since.IsZero() && m.Date.Before(q.Since):
+		return false
+	case !q.Before.IsZero() && !m.Date.Before(q.Before):
+		return false
+	}
+	return true
+}
+
+func (c *Catalog) query(statement string, args ...any) ([]CatalogMessage, error) {
+	rows, err := c.db.Query(statement, args...)
+	if err != nil {
+		return nil, fmt.Errorf("catalog query failed: %v", err)
+	}
+	defer rows.Close()
+	messages := []CatalogMessage{}
+	for rows.Next() {
+		var m CatalogMessage
+		var date string
+		err := rows.Scan(&m.Archive, &m.Path, &m.User, &m.Maildir, &m.Size, &date,
+			&m.From, &m.To, &m.Cc, &m.Subject, &m.MessageID, &m.InReplyTo, &m.References)
+		if err != nil {
+			return nil, fmt.Errorf("catalog query failed: %v", err)
+		}
+		if date != "" {
+			m.Date, _ = time.Parse(time.RFC3339, date)
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+func formatCatalogDate(date time.Time) string {
+	if date.IsZero() {
+		return ""
+	}
+	return date.UTC().Format(time.RFC3339)
+}
+
+func escapeLike(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, "%", `\%`)
+	return strings.ReplaceAll(value, "_", `\_`)
+}
+
+// NormalizeMessageID returns a message id without surrounding whitespace and angle brackets
+func NormalizeMessageID(id string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(id), "<"), ">")
+}
+
+// messageIDs returns the normalized message ids of a References or In-Reply-To header
+func messageIDs(value string) []string {
+	ids := []string{}
+	for _, field := range strings.Fields(strings.ReplaceAll(value, "><", "> <")) {
+		if strings.HasPrefix(field, "<") {
+			ids = append(ids, NormalizeMessageID(field))
+		}
+	}
+	return ids
+}
+
+var headerDecoder = &mime.WordDecoder{
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		encoding, err := htmlindex.Get(charset)
+		if err != nil {
+			return nil, err
+		}
+		return encoding.NewDecoder().Reader(input), nil
+	},
+}
+
+// DecodeHeader decodes the RFC 2047 encoded words of a header value, returning value unchanged if it cannot be decoded
+func DecodeHeader(value string) string {
+	decoded, err := headerDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// ParseMessageHeaders reads the RFC 5322 header of a message into a catalog record
+// The Date header is used when valid; otherwise Date is zero.
+func ParseMessageHeaders(input io.Reader) (*CatalogMessage, error) {
+	message, err := mail.ReadMessage(input)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading message header: %v", err)
+	}
+	header := message.Header
+	m := CatalogMessage{
+		From:      DecodeHeader(header.Get("From")),
+		To:        DecodeHeader(header.Get("To")),
+		Cc:        DecodeHeader(header.Get("Cc")),
+		Subject:   DecodeHeader(header.Get("Subject")),
+		MessageID: NormalizeMessageID(header.Get("Message-Id")),
+	}
+	inReplyTo := messageIDs(header.Get("In-Reply-To"))
+	if len(inReplyTo) > 0 {
+		m.InReplyTo = inReplyTo[0]
+	}
+	m.References = strings.Join(messageIDs(header.Get("References")), " ")
+	date, err := mail.ParseDate(header.Get("Date"))
+	if err == nil {
+		m.Date = date.UTC()
+	}
+	return &m, nil
+}
+
+// ReadMessageHeaders parses the header of the message file at pathname
+func ReadMessageHeaders(pathname string) (*CatalogMessage, error) {
+	file, err := os.Open(pathname)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseMessageHeaders(file)
+}
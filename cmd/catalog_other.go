@@ -0,0 +1,6 @@
+//go:build !(darwin || freebsd || linux || openbsd || windows)
+
+package cmd
+
+// catalogDriver is empty where the SQLite driver does not build; the catalog commands fail at runtime
+const catalogDriver = ""
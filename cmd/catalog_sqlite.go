@@ -0,0 +1,10 @@
+//go:build darwin || freebsd || linux || openbsd || windows
+
+package cmd
+
+import (
+	_ "modernc.org/sqlite"
+)
+
+// catalogDriver is the database/sql driver of the header catalog
+const catalogDriver = "sqlite"
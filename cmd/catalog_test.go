@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const catalogTestMessage = "Date: Tue, 02 Apr 2024 10:15:00 +0200\r\n" +
+	"From: =?ISO-8859-1?Q?J=F6rg_M=FCller?= <joerg@example.org>\r\n" +
+	"To: alice@example.org\r\n" +
+	"Cc: Bob <bob@example.org>\r\n" +
+	"Subject: =?UTF-8?Q?Rechnung_f=C3=BCr_M=C3=A4rz?=\r\n" +
+	"Message-ID: <invoice-1@example.org>\r\n" +
+	"In-Reply-To: <order-7@example.org>\r\n" +
+	"References: <order-1@example.org>\r\n <order-7@example.org>\r\n" +
+	"\r\n" +
+	"body\r\n"
+
+func TestParseMessageHeaders(t *testing.T) {
+	m, err := ParseMessageHeaders(strings.NewReader(catalogTestMessage))
+	require.Nil(t, err)
+	require.Equal(t, "Jörg Müller <joerg@example.org>", m.From)
+	require.Equal(t, "alice@example.org", m.To)
+	require.Equal(t, "Bob <bob@example.org>", m.Cc)
+	require.Equal(t, "Rechnung für März", m.Subject)
+	require.Equal(t, "invoice-1@example.org", m.MessageID)
+	require.Equal(t, "order-7@example.org", m.InReplyTo)
+	require.Equal(t, "order-1@example.org order-7@example.org", m.References)
+	require.Equal(t, time.Date(2024, 4, 2, 8, 15, 0, 0, time.UTC), m.Date)
+
+	m, err = ParseMessageHeaders(strings.NewReader("Subject: no date\n\n"))
+	require.Nil(t, err)
+	require.True(t, m.Date.IsZero())
+	require.Equal(t, "no date", m.Subject)
+}
+
+func TestCatalog(t *testing.T) {
+	catalog, err := OpenCatalog(filepath.Join(t.TempDir(), "catalog", "catalog.db"))
+	require.Nil(t, err)
+	defer catalog.Close()
+
+	invoice, err := ParseMessageHeaders(strings.NewReader(catalogTestMessage))
+	require.Nil(t, err)
+	invoice.Archive = "2025-06-25.mailbox"
+	invoice.Path = "./alice/Maildir/cur/1.M1P1.host:2,S"
+	invoice.User = "alice"
+	invoice.Maildir = "INBOX"
+	other := CatalogMessage{
+		Archive:   "2025-06-26.mailbox",
+		Path:      "./alice/Maildir/.Sent/cur/2.M1P1.host:2,S",
+		User:      "alice",
+		Maildir:   ".Sent",
+		Date:      time.Date(2024, 9, 1, 0, 0, 0, 0, time.UTC),
+		From:      "alice@example.org",
+		To:        "joerg@example.org",
+		Subject:   "100% done_now",
+		MessageID: "sent-1@example.org",
+	}
+	require.Nil(t, catalog.Add([]CatalogMessage{*invoice, other}))
+	// re-adding a path replaces its record
+	require.Nil(t, catalog.Add([]CatalogMessage{other}))
+
+	indexed, err := catalog.IndexedPaths("2025-06-25.mailbox")
+	require.Nil(t, err)
+	require.Equal(t, map[string]bool{invoice.Path: true}, indexed)
+
+	search := func(query CatalogQuery) []string {
+		messages, err := catalog.Search(query)
+		require.Nil(t, err)
+		paths := []string{}
+		for _, m := range messages {
+			paths = append(paths, m.Path)
+		}
+		return paths
+	}
+	require.Equal(t, []string{invoice.Path, other.Path}, search(CatalogQuery{}))
+	require.Equal(t, []string{invoice.Path, other.Path}, search(CatalogQuery{Text: []string{"JOERG"}}))
+	require.Equal(t, []string{invoice.Path}, search(CatalogQuery{Text: []string{"rechnung", "märz"}}))
+	require.Equal(t, []string{invoice.Path}, search(CatalogQuery{To: "bob@"}))
+	require.Equal(t, []string{other.Path}, search(CatalogQuery{From: "alice"}))
+	require.Equal(t, []string{other.Path}, search(CatalogQuery{Subject: "100%"}))
+	require.Equal(t, []string{}, search(CatalogQuery{Subject: "100_"}))
+	require.Equal(t, []string{invoice.Path}, search(CatalogQuery{MessageID: "<invoice-1@example.org>"}))
+	require.Equal(t, []string{other.Path}, search(CatalogQuery{Since: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)}))
+	require.Equal(t, []string{invoice.Path}, search(CatalogQuery{Before: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)}))
+	require.Equal(t, []string{other.Path}, search(CatalogQuery{Archive: "2025-06-26.mailbox"}))
+	require.Equal(t, []string{invoice.Path}, search(CatalogQuery{Limit: 1}))
+
+	messages, err := catalog.Search(CatalogQuery{MessageID: "invoice-1@example.org"})
+	require.Nil(t, err)
+	require.Equal(t, invoice.Date, messages[0].Date)
+	require.Equal(t, "Rechnung für März", messages[0].Subject)
+}
+
+func TestCatalogSink(t *testing.T) {
+	files := map[string]string{
+		"alice/Maildir/cur/1712052900.M1P1.host:2,S": catalogTestMessage,
+		"alice/Maildir/cur/1712052901.M1P1.host:2,S": "no header separator",
+		"alice/Maildir/dovecot-uidlist":              "3 V1 N3\n",
+	}
+	selected := streamTestSelection(files, SortedKeys(files)...)
+	summary := IndexSummary{Archive: "2025-03-01.mail1"}
+	sink := CatalogSink{summary: &summary, messages: []CatalogMessage{}}
+	var progress int
+	require.Nil(t, ReadTarStream(bytes.NewReader(streamTestArchive(t, files)), selected, nil, &sink, func(n int) { progress += n }))
+	require.Empty(t, selected)
+	require.Equal(t, len(catalogTestMessage)+len("no header separator")+len("3 V1 N3\n"), progress)
+	require.Len(t, sink.messages, 1)
+	require.Equal(t, 1, summary.Failed)
+	m := sink.messages[0]
+	require.Equal(t, "./alice/Maildir/cur/1712052900.M1P1.host:2,S", m.Path)
+	require.Equal(t, "2025-03-01.mail1", m.Archive)
+	require.Equal(t, "alice", m.User)
+	require.Equal(t, "invoice-1@example.org", m.MessageID)
+	require.Equal(t, int64(len(catalogTestMessage)), m.Size)
+}
@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"io"
 	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
@@ -40,33 +43,66 @@ func OptionString(name, flag, defaultValue, description string) {
 	viper.BindPFlag(ViperKey(name), rootCmd.PersistentFlags().Lookup(name))
 }
 
+func OptionInt(name, flag string, defaultValue int, description string) {
+
+	if flag == "" {
+		rootCmd.PersistentFlags().Int(name, defaultValue, description)
+	} else {
+		rootCmd.PersistentFlags().IntP(name, flag, defaultValue, description)
+	}
+
+	viper.BindPFlag(ViperKey(name), rootCmd.PersistentFlags().Lookup(name))
+}
+
+// OverrideOptions sets option values by viper key, returning a function restoring the previous values
+func OverrideOptions(values map[string]any) func() {
+	previous := make(map[string]any)
+	for key, value := range values {
+		previous[key] = viper.Get(key)
+		viper.Set(key, value)
+	}
+	return func() {
+		for key, value := range previous {
+			viper.Set(key, value)
+		}
+	}
+}
+
 func OpenLog() {
 	filename := viper.GetString("logfile")
 	LogFile = nil
+	var output io.Writer
 	if filename == "stdout" || filename == "-" {
-		log.SetOutput(os.Stdout)
+		output = os.Stdout
 	} else if filename == "stderr" || filename == "" {
-		log.SetOutput(os.Stderr)
+		output = os.Stderr
 	} else {
 		fp, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
 		if err != nil {
 			log.Fatalf("failed opening log file: %v", err)
 		}
 		LogFile = fp
-		log.SetOutput(LogFile)
+		output = LogFile
 		log.SetPrefix(fmt.Sprintf("[%d] ", os.Getpid()))
 		log.SetFlags(log.Ldate | log.Ltime | log.Lmsgprefix)
-		log.Printf("%s v%s startup\n", rootCmd.Name(), rootCmd.Version)
 		cobra.OnFinalize(CloseLog)
 	}
+	log.SetOutput(output)
 	if viper.GetBool("debug") {
 		log.SetFlags(log.Flags() | log.Lshortfile)
 	}
+	err := InitSlog(output)
+	if err != nil {
+		log.Fatalf("failed initializing logger: %v", err)
+	}
+	if LogFile != nil {
+		slog.Info("startup", "program", rootCmd.Name(), "version", rootCmd.Version)
+	}
 }
 
 func CloseLog() {
 	if LogFile != nil {
-		log.Println("shutdown")
+		slog.Info("shutdown")
 		err := LogFile.Close()
 		cobra.CheckErr(err)
 		LogFile = nil
@@ -105,6 +141,33 @@ func ExpandPath(pathname string) string {
 	return pathname
 }
 
+// ParseSize parses a byte count with an optional K, M, G or T suffix (powers of 1024)
+func ParseSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "B"), "I")
+	multiplier := int64(1)
+	if value != "" {
+		switch value[len(value)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			value = value[:len(value)-1]
+		}
+	}
+	count, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || count < 0 {
+		return 0, fmt.Errorf("invalid size: %s", value)
+	}
+	return count * multiplier, nil
+}
+
 func InitConfig() {
 	viper.SetEnvPrefix("tarsnap")
 	viper.AutomaticEnv()
@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// DiskSpace is the space available to unprivileged users on a filesystem
+type DiskSpace struct {
+	BlockSize  int64
+	FreeBytes  int64
+	FreeInodes int64
+}
+
+// SpacePlan is the space a restore needs on the output filesystem
+type SpacePlan struct {
+	Files  int64
+	Bytes  int64
+	Blocks int64
+	Inodes int64
+}
+
+// DiskSpaceOf returns the free space of the filesystem holding pathname,
+// using the nearest existing parent directory if pathname does not exist yet
+func DiskSpaceOf(pathname string) (*DiskSpace, error) {
+	dir, err := filepath.Abs(pathname)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		_, err := os.Stat(dir)
+		if err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil, fmt.Errorf("no existing parent directory for %s", pathname)
+		}
+		dir = parent
+	}
+	space, err := statfs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading filesystem space for %s: %v", dir, err)
+	}
+	return space, nil
+}
+
+// PlanSpace computes the bytes, rounded up to whole filesystem blocks, and inodes needed to restore files
+func PlanSpace(files []MaildirFile, blockSize int64) *SpacePlan {
+	plan := SpacePlan{}
+	if blockSize <= 0 {
+		blockSize = 512
+	}
+	dirs := make(map[string]bool)
+	for _, file := range files {
+		name := path.Clean(file.Name)
+		if strings.HasSuffix(file.Name, "/") {
+			dirs[name] = true
+		} else {
+			plan.Files += 1
+			plan.Bytes += file.Size
+			plan.Blocks += (file.Size + blockSize - 1) / blockSize
+		}
+		for dir := path.Dir(name); dir != "." && dir != "/" && !dirs[dir]; dir = path.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+	plan.Inodes = plan.Files + int64(len(dirs))
+	// each directory occupies at least one block
+	plan.Blocks += int64(len(dirs))
+	return &plan
+}
+
+// CheckSpace returns an error if the output filesystem cannot hold the plan while keeping reserve bytes free
+func CheckSpace(space *DiskSpace, plan *SpacePlan, reserve int64) error {
+	needed := plan.Blocks*space.BlockSize + reserve
+	if space.FreeBytes < needed {
+		return fmt.Errorf("insufficient disk space: restore needs %s (%d files, %s data) plus %s reserve, %s available",
+			FormatSize(plan.Blocks*space.BlockSize), plan.Files, FormatSize(plan.Bytes), FormatSize(reserve), FormatSize(space.FreeBytes))
+	}
+	if space.FreeInodes >= 0 && space.FreeInodes < plan.Inodes {
+		return fmt.Errorf("insufficient inodes: restore needs %d, %d available", plan.Inodes, space.FreeInodes)
+	}
+	return nil
+}
+
+func FormatSize(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit += 1
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d%s", size, units[0])
+	}
+	return fmt.Sprintf("%.1f%s", value, units[unit])
+}
+
+// Preflight refuses the restore if the output filesystem lacks space or inodes for the planned files
+func (s *ProcessSet) Preflight() error {
+	if s.skipSpaceCheck {
+		return nil
+	}
+	if !statfsSupported {
+		s.logger.Warn("free space check not supported; skipping", "os", runtime.GOOS)
+		return nil
+	}
+	space, err := DiskSpaceOf(s.outputDir)
+	if err != nil {
+		return err
+	}
+	plan := PlanSpace(s.files, space.BlockSize)
+	if s.verbose {
+		s.logger.Info("space preflight",
+			"files", plan.Files,
+			"bytes", plan.Bytes,
+			"allocated", plan.Blocks*space.BlockSize,
+			"inodes", plan.Inodes,
+			"free_bytes", space.FreeBytes,
+			"free_inodes", space.FreeInodes,
+			"reserve", s.spaceReserve,
+		)
+	}
+	return CheckSpace(space, plan, s.spaceReserve)
+}
+
+// waitForSpace blocks while free space on the output filesystem is below the reserve
+// It returns false if ctx is cancelled while waiting.
+func (s *ProcessSet) waitForSpace(ctx context.Context) bool {
+	if s.skipSpaceCheck || s.spaceReserve == 0 || !statfsSupported {
+		return true
+	}
+	paused := false
+	for {
+		space, err := DiskSpaceOf(s.outputDir)
+		if err != nil {
+			s.logger.Warn("free space check failed", "error", err)
+			return true
+		}
+		if space.FreeBytes >= s.spaceReserve {
+			if paused {
+				s.logger.Info("free space recovered; resuming", "free_bytes", space.FreeBytes, "reserve", s.spaceReserve)
+			}
+			return true
+		}
+		if !paused {
+			s.logger.Warn("free space below reserve; pausing new batches", "free_bytes", space.FreeBytes, "reserve", s.spaceReserve)
+			paused = true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(MONITOR_INTERVAL):
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"testing"
+)
+
+func TestDiskspacePlan(t *testing.T) {
+	files := []MaildirFile{
+		{Name: "./alice/Maildir/cur/", Size: 512},
+		{Name: "./alice/Maildir/cur/1.M1P1.host:2,S", Size: 100},
+		{Name: "./alice/Maildir/cur/2.M1P1.host:2,S", Size: 5000},
+		{Name: "./alice/Maildir/.Sent/cur/3.M1P1.host:2,S", Size: 0},
+	}
+	plan := PlanSpace(files, 4096)
+	require.Equal(t, int64(3), plan.Files)
+	require.Equal(t, int64(5100), plan.Bytes)
+	// alice, alice/Maildir, cur, .Sent, .Sent/cur
+	require.Equal(t, int64(8), plan.Inodes)
+	require.Equal(t, int64(3+5), plan.Blocks)
+
+	space := DiskSpace{BlockSize: 4096, FreeBytes: 1 << 20, FreeInodes: 100}
+	require.Nil(t, CheckSpace(&space, plan, 0))
+	require.NotNil(t, CheckSpace(&space, plan, 1<<20))
+	space.FreeInodes = 4
+	require.NotNil(t, CheckSpace(&space, plan, 0))
+
+	size, err := ParseSize("2G")
+	require.Nil(t, err)
+	require.Equal(t, int64(2<<30), size)
+	size, err = ParseSize("10MiB")
+	require.Nil(t, err)
+	require.Equal(t, int64(10<<20), size)
+	_, err = ParseSize("lots")
+	require.NotNil(t, err)
+}
+
+func TestDiskspacePreflightSupport(t *testing.T) {
+	s := ProcessSet{outputDir: t.TempDir(), spaceReserve: 1 << 62, logger: slog.Default()}
+	if statfsSupported {
+		require.NotNil(t, s.Preflight())
+		return
+	}
+	// without statfs support the checks are skipped
+	require.Nil(t, s.Preflight())
+	require.True(t, s.waitForSpace(context.Background()))
+}
@@ -0,0 +1,365 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const EDISCOVERY_MANIFEST = "manifest.json"
+const EDISCOVERY_SIGNATURE = "manifest.sig"
+const EDISCOVERY_LOADFILE = "loadfile.csv"
+const EDISCOVERY_MESSAGES_DIR = "messages"
+const EDISCOVERY_MANIFEST_VERSION = 1
+
+var EDISCOVERY_LOADFILE_COLUMNS = []string{"doc_id", "file", "sha256", "size", "archive", "source_path", "user", "maildir", "date", "from", "to", "cc", "subject", "message_id", "in_reply_to", "references"}
+
+// EDISCOVERY_SELECTION_OPTIONS are the options recorded in the manifest as the selection of the export
+var EDISCOVERY_SELECTION_OPTIONS = []string{"user", "maildir", "path_template", "filter", "files_from", "from", "to", "subject", "since", "before"}
+
+var ediscoveryExportCmd = &cobra.Command{
+	Use:   "ediscovery-export [ARCHIVE_NAME]",
+	Short: "export messages with a signed chain-of-custody manifest",
+	Long: `
+Restore the messages selected from ARCHIVE_NAME and package them in the
+output directory, which must be empty or not exist:
+
+  messages/DOC-NNNNNN.eml  each message, unchanged
+  loadfile.csv             document id, file, SHA-256 and parsed headers
+  manifest.json            chain-of-custody manifest
+  manifest.sig             ed25519 signature of manifest.json (base64)
+
+The manifest records the tarsnap archives read, the SHA-256 fingerprint
+of the tarsnap key file, the selection options, the operator, host, start
+and completion times, and the size and SHA-256 of every file in the
+package. It is signed with the --signing-key ed25519 key, which is
+generated on first use with its public key written to KEYFILE.pub.
+
+--user, --maildir, --filter, --files-from, --from, --to, --subject,
+--since and --before select the exported messages. The export fails if
+a selected message is not extracted with the size in the archive
+listing.
+
+Use ediscovery-verify to check a package.
+`,
+	Args: cobra.RangeArgs(0, 1),
+	Run: func(cmd *cobra.Command, args []string) {
+		archiveName, err := ArchiveBaseName(args)
+		cobra.CheckErr(err)
+		query, err := SearchQuery([]string{})
+		cobra.CheckErr(err)
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		manifest, err := EDiscoveryExport(ctx, archiveName, query)
+		cobra.CheckErr(err)
+		if viper.GetBool("json") {
+			fmt.Println(FormatJSON(manifest))
+		} else {
+			fmt.Printf("%s: %d messages exported to %s, signed by %s\n", archiveName, manifest.Messages, ExpandPath(viper.GetString("output_dir")), manifest.SigningKey)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(ediscoveryExportCmd)
+}
+
+// EDiscoveryManifest is the chain-of-custody record of an ediscovery package
+type EDiscoveryManifest struct {
+	Version        int
+	Archive        string
+	SourceArchives []string
+	MetadataDir    string `json:",omitempty"`
+	KeyFingerprint string
+	Selection      map[string]string
+	Operator       string
+	Host           string
+	Started        time.Time
+	Completed      time.Time
+	Messages       int
+	// PublicKey is the base64 ed25519 public key of the signature; SigningKey its fingerprint
+	PublicKey  string
+	SigningKey string
+	Files      []EDiscoveryFile
+}
+
+// EDiscoveryFile is a file of the package; Source is the archive path of an exported message
+type EDiscoveryFile struct {
+	Path   string
+	Size   int64
+	SHA256 string
+	Source string `json:",omitempty"`
+}
+
+// EDiscoveryExport restores the messages of archiveName matching query and writes a signed package to the output directory
+func EDiscoveryExport(ctx context.Context, archiveName string, query *CatalogQuery) (*EDiscoveryManifest, error) {
+	started := time.Now().UTC()
+	outputDir := ExpandPath(viper.GetString("output_dir"))
+	entries, err := os.ReadDir(outputDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed reading output directory: %v", err)
+	}
+	if len(entries) > 0 {
+		return nil, fmt.Errorf("output directory %s is not empty", outputDir)
+	}
+	signingKey, err := LoadSigningKey(viper.GetString("signing_key"))
+	if err != nil {
+		return nil, err
+	}
+	publicKey := signingKey.Public().(ed25519.PublicKey)
+	manifest, err := newEDiscoveryManifest(archiveName, started, publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := LockOutputDir(outputDir, archiveName, viper.GetBool("force_unlock"))
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+	messagesDir := filepath.Join(outputDir, EDISCOVERY_MESSAGES_DIR)
+	err = os.MkdirAll(messagesDir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating output directory: %v", err)
+	}
+
+	scratch, err := os.MkdirTemp("", "tarsnap.ediscovery.*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(scratch)
+	var paths []string
+	if viper.GetString("files_from") != "" {
+		paths, err = ReadPathList(viper.GetString("files_from"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	tarsnap, err := RestoreScratch(ctx, archiveName, scratch, paths)
+	if err != nil {
+		return nil, err
+	}
+	err = tarsnap.checkExtracted(scratch)
+	if err != nil {
+		return nil, err
+	}
+	if tarsnap.metadataDir != "" {
+		manifest.MetadataDir = tarsnap.metadataDir
+	} else {
+		manifest.SourceArchives = append(manifest.SourceArchives, MetadataArchiveName(archiveName))
+	}
+
+	loadFilename := filepath.Join(outputDir, EDISCOVERY_LOADFILE)
+	file, err := os.Create(loadFilename)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating load file: %v", err)
+	}
+	defer file.Close()
+	loadFile := csv.NewWriter(file)
+	err = loadFile.Write(EDISCOVERY_LOADFILE_COLUMNS)
+	if err != nil {
+		return nil, fmt.Errorf("failed writing load file: %v", err)
+	}
+	sources := make(map[string]bool)
+	_, err = tarsnap.ScratchMessages(scratch, query, func(file MaildirFile, data []byte, headers *CatalogMessage) error {
+		manifest.Messages += 1
+		docID := fmt.Sprintf("DOC-%06d", manifest.Messages)
+		name := filepath.Join(EDISCOVERY_MESSAGES_DIR, docID+".eml")
+		err := os.WriteFile(filepath.Join(outputDir, name), data, 0600)
+		if err != nil {
+			return fmt.Errorf("failed writing message: %v", err)
+		}
+		entry := newEDiscoveryFile(name, data)
+		entry.Source = file.Name
+		manifest.Files = append(manifest.Files, entry)
+		sources[MaildirArchiveName(archiveName, tarsnap.Users[headers.User].Archive)] = true
+		date := ""
+		if !headers.Date.IsZero() {
+			date = headers.Date.Format(time.RFC3339)
+		}
+		err = loadFile.Write([]string{
+			docID,
+			filepath.ToSlash(name),
+			entry.SHA256,
+			fmt.Sprintf("%d", entry.Size),
+			archiveName,
+			file.Name,
+			headers.User,
+			headers.Maildir,
+			date,
+			headers.From,
+			headers.To,
+			headers.Cc,
+			headers.Subject,
+			headers.MessageID,
+			headers.InReplyTo,
+			headers.References,
+		})
+		if err != nil {
+			return fmt.Errorf("failed writing load file: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	loadFile.Flush()
+	err = loadFile.Error()
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed writing load file: %v", err)
+	}
+	data, err := os.ReadFile(loadFilename)
+	if err != nil {
+		return nil, err
+	}
+	manifest.Files = append(manifest.Files, newEDiscoveryFile(EDISCOVERY_LOADFILE, data))
+	for name := range sources {
+		manifest.SourceArchives = append(manifest.SourceArchives, name)
+	}
+	sort.Strings(manifest.SourceArchives)
+	manifest.Completed = time.Now().UTC()
+
+	err = writeSignedManifest(outputDir, manifest, signingKey)
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// checkExtracted compares each selected file restored to scratch with its size in the archive listing
+func (t *Tarsnap) checkExtracted(scratch string) error {
+	files := 0
+	failed := 0
+	for _, user := range t.Users {
+		for _, maildir := range user.Maildirs {
+			for _, file := range maildir.Files {
+				files += 1
+				stat, err := os.Stat(filepath.Join(scratch, file.Name))
+				switch {
+				case err != nil:
+					t.logger.Error("message not extracted", "file", file.Name, "error", err)
+					failed += 1
+				case stat.Size() != file.Size:
+					t.logger.Error("extracted size mismatch", "file", file.Name, "bytes", stat.Size(), "expected", file.Size)
+					failed += 1
+				}
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d messages not extracted as listed in the archive", failed, files)
+	}
+	return nil
+}
+
+func newEDiscoveryManifest(archiveName string, started time.Time, publicKey ed25519.PublicKey) (*EDiscoveryManifest, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed reading hostname: %v", err)
+	}
+	operator := os.Getenv("USER")
+	current, err := user.Current()
+	if err == nil {
+		operator = current.Username
+	}
+	m := EDiscoveryManifest{
+		Version:        EDISCOVERY_MANIFEST_VERSION,
+		Archive:        archiveName,
+		SourceArchives: []string{},
+		Selection:      make(map[string]string),
+		Operator:       operator,
+		Host:           host,
+		Started:        started,
+		PublicKey:      base64.StdEncoding.EncodeToString(publicKey),
+		SigningKey:     KeyFingerprint(publicKey),
+		Files:          []EDiscoveryFile{},
+	}
+	keyfile := ExpandPath(viper.GetString("keyfile"))
+	if keyfile != "" {
+		data, err := os.ReadFile(keyfile)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading tarsnap key file: %v", err)
+		}
+		sum := sha256.Sum256(data)
+		m.KeyFingerprint = "SHA256:" + hex.EncodeToString(sum[:])
+	}
+	for _, key := range EDISCOVERY_SELECTION_OPTIONS {
+		value := viper.GetString(key)
+		if value != "" {
+			m.Selection[key] = value
+		}
+	}
+	return &m, nil
+}
+
+func newEDiscoveryFile(name string, data []byte) EDiscoveryFile {
+	sum := sha256.Sum256(data)
+	return EDiscoveryFile{Path: filepath.ToSlash(name), Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])}
+}
+
+// writeSignedManifest writes the manifest and the base64 ed25519 signature of its exact bytes
+func writeSignedManifest(outputDir string, manifest *EDiscoveryManifest, signingKey ed25519.PrivateKey) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	err = os.WriteFile(filepath.Join(outputDir, EDISCOVERY_MANIFEST), data, 0600)
+	if err != nil {
+		return fmt.Errorf("failed writing manifest: %v", err)
+	}
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(signingKey, data)) + "\n"
+	err = os.WriteFile(filepath.Join(outputDir, EDISCOVERY_SIGNATURE), []byte(signature), 0600)
+	if err != nil {
+		return fmt.Errorf("failed writing manifest signature: %v", err)
+	}
+	return nil
+}
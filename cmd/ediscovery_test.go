@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSigningKey(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "keys", "ediscovery.key")
+	generated, err := LoadSigningKey(filename)
+	require.Nil(t, err)
+	loaded, err := LoadSigningKey(filename)
+	require.Nil(t, err)
+	require.True(t, generated.Equal(loaded))
+	publicKey, err := LoadPublicKey(filename + ".pub")
+	require.Nil(t, err)
+	require.True(t, publicKey.Equal(loaded.Public()))
+	_, err = LoadPublicKey(filename)
+	require.NotNil(t, err)
+}
+
+func TestEDiscoveryVerify(t *testing.T) {
+	dir := t.TempDir()
+	signingKey, err := LoadSigningKey(filepath.Join(t.TempDir(), "ediscovery.key"))
+	require.Nil(t, err)
+	publicKey := signingKey.Public().(ed25519.PublicKey)
+	manifest, err := newEDiscoveryManifest("2025-06-25.mailbox", time.Now().UTC(), publicKey)
+	require.Nil(t, err)
+
+	message := []byte("Subject: hello\r\n\r\nbody\r\n")
+	name := filepath.Join(EDISCOVERY_MESSAGES_DIR, "DOC-000001.eml")
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, EDISCOVERY_MESSAGES_DIR), 0700))
+	require.Nil(t, os.WriteFile(filepath.Join(dir, name), message, 0600))
+	manifest.Files = append(manifest.Files, newEDiscoveryFile(name, message))
+	require.Nil(t, writeSignedManifest(dir, manifest, signingKey))
+
+	report, err := EDiscoveryVerify(dir, "")
+	require.Nil(t, err)
+	require.True(t, report.Signature)
+	require.True(t, report.EmbeddedKey)
+	require.Equal(t, KeyFingerprint(publicKey), report.SigningKey)
+	require.Empty(t, report.Problems)
+
+	// a message changed and a file added
+	require.Nil(t, os.WriteFile(filepath.Join(dir, name), []byte("Subject: hellO\r\n\r\nbody\r\n"), 0600))
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "extra.eml"), message, 0600))
+	report, err = EDiscoveryVerify(dir, "")
+	require.Nil(t, err)
+	require.True(t, report.Signature)
+	require.Equal(t, []string{"checksum mismatch: messages/DOC-000001.eml", "unlisted file: extra.eml"}, report.Problems)
+
+	// a different verify key
+	otherKeyFile := filepath.Join(t.TempDir(), "other.key")
+	_, err = LoadSigningKey(otherKeyFile)
+	require.Nil(t, err)
+	report, err = EDiscoveryVerify(dir, otherKeyFile+".pub")
+	require.Nil(t, err)
+	require.False(t, report.Signature)
+	require.False(t, report.EmbeddedKey)
+
+	// an edited manifest
+	data, err := os.ReadFile(filepath.Join(dir, EDISCOVERY_MANIFEST))
+	require.Nil(t, err)
+	data = bytes.Replace(data, []byte("2025-06-25"), []byte("2025-06-26"), 1)
+	require.Nil(t, os.WriteFile(filepath.Join(dir, EDISCOVERY_MANIFEST), data, 0600))
+	report, err = EDiscoveryVerify(dir, "")
+	require.Nil(t, err)
+	require.False(t, report.Signature)
+
+	// listed paths outside the package are not read
+	outside := filepath.Join(filepath.Dir(dir), "outside.eml")
+	require.Nil(t, os.WriteFile(outside, message, 0600))
+	manifest.Files = []EDiscoveryFile{newEDiscoveryFile("../outside.eml", message), newEDiscoveryFile(outside, message)}
+	require.Nil(t, os.Remove(filepath.Join(dir, "extra.eml")))
+	require.Nil(t, os.Remove(filepath.Join(dir, name)))
+	require.Nil(t, writeSignedManifest(dir, manifest, signingKey))
+	report, err = EDiscoveryVerify(dir, "")
+	require.Nil(t, err)
+	require.True(t, report.Signature)
+	require.Equal(t, []string{"invalid path: ../outside.eml", "invalid path: " + outside}, report.Problems)
+}
+
+func TestEDiscoveryCheckExtracted(t *testing.T) {
+	scratch := t.TempDir()
+	tarsnap := Tarsnap{Archive: "2025-06-25.mailbox", Users: make(map[string]*User), logger: slog.Default()}
+	inbox := tarsnap.getUser("alice").getMaildir("INBOX")
+	inbox.AddFile("./alice/Maildir/cur/1.M1P1.host:2,S", 6)
+	require.Nil(t, os.MkdirAll(filepath.Join(scratch, "alice", "Maildir", "cur"), 0700))
+	require.Nil(t, os.WriteFile(filepath.Join(scratch, "alice", "Maildir", "cur", "1.M1P1.host:2,S"), []byte("hello\n"), 0600))
+	require.Nil(t, tarsnap.checkExtracted(scratch))
+
+	// a short extraction
+	require.Nil(t, os.WriteFile(filepath.Join(scratch, "alice", "Maildir", "cur", "1.M1P1.host:2,S"), []byte("he"), 0600))
+	require.NotNil(t, tarsnap.checkExtracted(scratch))
+
+	// a message not extracted
+	require.Nil(t, os.WriteFile(filepath.Join(scratch, "alice", "Maildir", "cur", "1.M1P1.host:2,S"), []byte("hello\n"), 0600))
+	inbox.AddFile("./alice/Maildir/cur/2.M1P1.host:2,S", 6)
+	require.NotNil(t, tarsnap.checkExtracted(scratch))
+}
@@ -0,0 +1,200 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// EDISCOVERY_UNAUTHENTICATED is the ediscovery-verify exit status of an intact package checked only with the manifest key
+const EDISCOVERY_UNAUTHENTICATED = 2
+
+var ediscoveryVerifyCmd = &cobra.Command{
+	Use:   "ediscovery-verify DIR",
+	Short: "verify an ediscovery export package",
+	Long: `
+Check the manifest signature of the ediscovery package in DIR and the
+size and SHA-256 of every file it lists, and report files missing from
+or added to the package.
+
+The signature is verified with the PEM public key given with
+--verify-key; without it the public key recorded in the manifest is
+used, which proves the package is unchanged since signing but not who
+signed it: compare the reported fingerprint with the signer's key.
+
+Exits 0 if the package is intact and its signature was verified with
+--verify-key, 2 if it is intact but was checked only with the manifest
+key, and 1 otherwise.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		report, err := EDiscoveryVerify(args[0], viper.GetString("verify_key"))
+		cobra.CheckErr(err)
+		if viper.GetBool("json") {
+			fmt.Println(FormatJSON(report))
+		} else {
+			report.Print()
+		}
+		if len(report.Problems) > 0 {
+			cobra.CheckErr(fmt.Errorf("%s: %d problems", report.Dir, len(report.Problems)))
+		}
+		if report.EmbeddedKey {
+			fmt.Fprintf(os.Stderr, "%s: signer not authenticated: verified with the manifest key only, use --verify-key\n", report.Dir)
+			os.Exit(EDISCOVERY_UNAUTHENTICATED)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(ediscoveryVerifyCmd)
+}
+
+// EDiscoveryReport is the result of verifying an ediscovery package
+type EDiscoveryReport struct {
+	Dir        string
+	Archive    string
+	SigningKey string
+	// EmbeddedKey is set if the signature was checked with the public key recorded in the manifest
+	EmbeddedKey bool
+	Signature   bool
+	Files       int
+	Problems    []string
+}
+
+func (r *EDiscoveryReport) Print() {
+	key := "verify key"
+	if r.EmbeddedKey {
+		key = "manifest key"
+	}
+	signature := "INVALID"
+	if r.Signature {
+		signature = "valid"
+	}
+	fmt.Printf("%s: archive %s, %d files, signature %s (%s %s)\n", r.Dir, r.Archive, r.Files, signature, key, r.SigningKey)
+	for _, problem := range r.Problems {
+		fmt.Printf("  %s\n", problem)
+	}
+}
+
+// EDiscoveryVerify checks the signed manifest and files of the package in dir
+// The signature is checked with the public key in verifyKey, or the manifest key if verifyKey is empty.
+// Listed paths outside dir are reported as problems and not read.
+func EDiscoveryVerify(dir, verifyKey string) (*EDiscoveryReport, error) {
+	dir = ExpandPath(dir)
+	data, err := os.ReadFile(filepath.Join(dir, EDISCOVERY_MANIFEST))
+	if err != nil {
+		return nil, fmt.Errorf("failed reading manifest: %v", err)
+	}
+	var manifest EDiscoveryManifest
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing manifest: %v", err)
+	}
+	report := EDiscoveryReport{Dir: dir, Archive: manifest.Archive, Files: len(manifest.Files), Problems: []string{}}
+
+	var publicKey ed25519.PublicKey
+	if verifyKey != "" {
+		publicKey, err = LoadPublicKey(verifyKey)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		publicKey, err = base64.StdEncoding.DecodeString(manifest.PublicKey)
+		if err != nil || len(publicKey) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid manifest public key")
+		}
+		report.EmbeddedKey = true
+	}
+	report.SigningKey = KeyFingerprint(publicKey)
+	signatureData, err := os.ReadFile(filepath.Join(dir, EDISCOVERY_SIGNATURE))
+	if err != nil {
+		report.Problems = append(report.Problems, fmt.Sprintf("missing signature: %v", err))
+	} else {
+		signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signatureData)))
+		report.Signature = err == nil && ed25519.Verify(publicKey, data, signature)
+		if !report.Signature {
+			report.Problems = append(report.Problems, "manifest signature does not verify")
+		}
+	}
+
+	listed := map[string]bool{EDISCOVERY_MANIFEST: true, EDISCOVERY_SIGNATURE: true}
+	for _, file := range manifest.Files {
+		if !filepath.IsLocal(filepath.FromSlash(file.Path)) {
+			report.Problems = append(report.Problems, fmt.Sprintf("invalid path: %s", file.Path))
+			continue
+		}
+		listed[file.Path] = true
+		content, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(file.Path)))
+		if err != nil {
+			report.Problems = append(report.Problems, fmt.Sprintf("missing file: %s", file.Path))
+			continue
+		}
+		sum := sha256.Sum256(content)
+		switch {
+		case int64(len(content)) != file.Size:
+			report.Problems = append(report.Problems, fmt.Sprintf("size mismatch: %s: %d, expected %d", file.Path, len(content), file.Size))
+		case hex.EncodeToString(sum[:]) != file.SHA256:
+			report.Problems = append(report.Problems, fmt.Sprintf("checksum mismatch: %s", file.Path))
+		}
+	}
+	err = filepath.WalkDir(dir, func(pathname string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		name, err := filepath.Rel(dir, pathname)
+		if err != nil {
+			return err
+		}
+		if !listed[filepath.ToSlash(name)] {
+			report.Problems = append(report.Problems, fmt.Sprintf("unlisted file: %s", filepath.ToSlash(name)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed reading package: %v", err)
+	}
+	return &report, nil
+}
@@ -42,17 +42,19 @@ var filesCmd = &cobra.Command{
 	Short: "List all files in archive",
 	Long: `
 Output each directory and filename to stdout.
+
+The JSON output includes the size and class of each file and, for
+messages, the delivery time, host, unique name, size attributes and flags
+parsed from the Maildir filename.
 `,
 	Args: cobra.RangeArgs(0, 1),
 	Run: func(cmd *cobra.Command, args []string) {
-		archiveName := viper.GetString("archive")
-		if len(args) > 0 {
-			archiveName = args[0]
-		}
+		archiveName, err := ArchiveBaseName(args)
+		cobra.CheckErr(err)
 		tarsnap, err := NewTarsnap(archiveName)
 		cobra.CheckErr(err)
 		if viper.GetBool("json") {
-			fmt.Println(FormatJSON(tarsnap.Files()))
+			fmt.Println(FormatJSON(tarsnap.MaildirFiles()))
 		} else {
 			for _, filename := range tarsnap.Files() {
 				fmt.Println(filename)
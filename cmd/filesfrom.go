@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ReadPathList reads archive pathnames, one per line, from filename or stdin if filename is -
+// Blank lines and lines starting with # are ignored.
+func ReadPathList(filename string) ([]string, error) {
+	var input io.Reader
+	if filename == "-" {
+		input = os.Stdin
+	} else {
+		file, err := os.Open(ExpandPath(filename))
+		if err != nil {
+			return nil, fmt.Errorf("failed opening path list: %v", err)
+		}
+		defer file.Close()
+		input = file
+	}
+	paths := []string{}
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		paths = append(paths, ArchivePath(line))
+	}
+	err := scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed reading path list: %v", err)
+	}
+	return paths, nil
+}
+
+// ArchivePath returns pathname in the ./USER/Maildir/... form used in the archive metadata
+func ArchivePath(pathname string) string {
+	pathname = strings.TrimPrefix(pathname, "/")
+	if !strings.HasPrefix(pathname, "./") {
+		pathname = "./" + pathname
+	}
+	return pathname
+}
+
+// SelectFiles reduces the loaded metadata to the listed paths
+// A listed directory selects every file below it.
+// Paths not present in the metadata, or rejected by the user, maildir and filter options, are reported and returned as an error.
+func (t *Tarsnap) SelectFiles(paths []string) error {
+	type location struct {
+		user    string
+		maildir *Maildir
+		file    MaildirFile
+	}
+	index := make(map[string]location)
+	for userName, user := range t.Users {
+		for _, maildir := range user.Maildirs {
+			for _, file := range maildir.Files {
+				index[file.Name] = location{userName, maildir, file}
+			}
+		}
+	}
+	names := SortedKeys(index)
+	selected := make(map[string]*User)
+	seen := make(map[string]bool)
+	unknown := []string{}
+	for _, pathname := range paths {
+		matches := []string{}
+		loc, ok := index[pathname]
+		if ok && !strings.HasSuffix(pathname, "/") {
+			matches = append(matches, pathname)
+		} else {
+			prefix := strings.TrimSuffix(pathname, "/") + "/"
+			for i := sort.SearchStrings(names, prefix); i < len(names) && strings.HasPrefix(names[i], prefix); i++ {
+				matches = append(matches, names[i])
+			}
+		}
+		if len(matches) == 0 {
+			t.logger.Warn("unknown path", "file", pathname)
+			unknown = append(unknown, pathname)
+			continue
+		}
+		for _, name := range matches {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			loc = index[name]
+			user, ok := selected[loc.user]
+			if !ok {
+				user = &User{Archive: t.Users[loc.user].Archive, Maildirs: make(map[string]*Maildir)}
+				selected[loc.user] = user
+			}
+			maildir, ok := user.Maildirs[loc.maildir.Name]
+			if !ok {
+				// keep the folder directory and layout of the loaded maildir
+				maildir = &Maildir{Name: loc.maildir.Name, DisplayName: loc.maildir.DisplayName, Dir: loc.maildir.Dir, Layout: loc.maildir.Layout, Files: []MaildirFile{}}
+				user.Maildirs[maildir.Name] = maildir
+			}
+			maildir.Files = append(maildir.Files, loc.file)
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("%d of %d listed paths not found in %s metadata or not selected by filters", len(unknown), len(paths), t.Archive)
+	}
+	t.Users = selected
+	if t.verbose {
+		t.logger.Info("selected listed paths", "files", len(seen))
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFilesFromSelect(t *testing.T) {
+	listFile := filepath.Join(t.TempDir(), "paths")
+	list := "# ticket 1234\nalice/Maildir/.Sent/cur/2.M1P1.host:2,S\n\n./alice/Maildir/cur/1.M1P1.host:2,S\n./alice/Maildir/cur/1.M1P1.host:2,S\n"
+	require.Nil(t, os.WriteFile(listFile, []byte(list), 0600))
+	paths, err := ReadPathList(listFile)
+	require.Nil(t, err)
+	require.Len(t, paths, 3)
+	require.Equal(t, "./alice/Maildir/.Sent/cur/2.M1P1.host:2,S", paths[0])
+
+	tarsnap := Tarsnap{Archive: "2025-03-01.mail1", Users: make(map[string]*User), logger: slog.Default()}
+	tarsnap.getUser("alice").getMaildir("INBOX").AddFile("./alice/Maildir/cur/1.M1P1.host:2,S", 100)
+	tarsnap.getUser("alice").getMaildir("INBOX").AddFile("./alice/Maildir/cur/3.M1P1.host:2,S", 100)
+	tarsnap.getUser("alice").getMaildir(".Sent").AddFile("./alice/Maildir/.Sent/cur/2.M1P1.host:2,S", 100)
+	tarsnap.getUser("bob").getMaildir("INBOX").AddFile("./bob/Maildir/cur/1.M1P1.host:2,S", 100)
+
+	err = tarsnap.SelectFiles(append(paths, "./alice/Maildir/cur/missing"))
+	require.NotNil(t, err)
+	require.Len(t, tarsnap.Users, 2)
+
+	err = tarsnap.SelectFiles(paths)
+	require.Nil(t, err)
+	require.Len(t, tarsnap.Users, 1)
+	require.Len(t, tarsnap.Users["alice"].Maildirs["INBOX"].Files, 1)
+	require.Len(t, tarsnap.Users["alice"].Maildirs[".Sent"].Files, 1)
+
+	// a listed directory selects the files below it
+	tarsnap.getUser("alice").getMaildir(".Sent").AddFile("./alice/Maildir/.Sent/cur/4.M1P1.host:2,S", 100)
+	tarsnap.getUser("alice").getMaildir(".Sent.Archive").AddFile("./alice/Maildir/.Sent.Archive/cur/5.M1P1.host:2,S", 100)
+	err = tarsnap.SelectFiles([]string{"./alice/Maildir/.Sent/", "./alice/Maildir/.Sent/cur/2.M1P1.host:2,S"})
+	require.Nil(t, err)
+	require.Len(t, tarsnap.Users["alice"].Maildirs, 1)
+	require.Len(t, tarsnap.Users["alice"].Maildirs[".Sent"].Files, 2)
+	require.NotNil(t, tarsnap.SelectFiles([]string{"./alice/Maildir/.Drafts/"}))
+}
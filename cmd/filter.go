@@ -0,0 +1,532 @@
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Filter is an ordered list of include and exclude rules selecting files from the archive metadata
+//
+//	include|exclude EXPR [; include|exclude EXPR ...]
+//
+// EXPR combines comparisons with and, or, not and parentheses:
+//
+//	FIELD = VALUE       FIELD != VALUE      FIELD in (VALUE, ...)
+//	FIELD ~ REGEX       FIELD !~ REGEX
+//	size < SIZE         (also <=, >, >=; SIZE accepts K, M, G suffixes)
+//	date < YYYY-MM-DD   (also =, !=, <=, >, >=; message delivery date)
+//	flags has LETTERS   (all of the Maildir flag letters are set)
+//
+// FIELD is one of user, maildir, path, size, flags, subdir (cur, new or tmp), class, domain, host or date;
+// maildir matches either the archived or the decoded folder name.
+// Values containing spaces or operator characters must be quoted.
+//
+// The first rule matching a file decides; a file matching no rule is selected
+// only if the filter has no include rules.
+type Filter struct {
+	Rules      []*FilterRule
+	hasInclude bool
+}
+
+type FilterRule struct {
+	Index   int
+	Include bool
+	Text    string
+	expr    filterExpr
+}
+
+func (r *FilterRule) String() string {
+	return fmt.Sprintf("rule %d: %s", r.Index, r.Text)
+}
+
+// FilterFile is the metadata of a file evaluated by the filter rules
+type FilterFile struct {
+	User    string
+	Maildir string
+	Folder  string
+	Path    string
+	Size    int64
+	Flags   string
+	Subdir  string
+	Class   MaildirClass
+	Domain  string
+	Host    string
+	Time    time.Time
+}
+
+var FILTER_FIELDS = []string{"user", "maildir", "path", "size", "flags", "subdir", "class", "domain", "host", "date"}
+
+// NewFilterFile returns the filter fields of a file in the archive metadata
+func NewFilterFile(user, maildir, pathname string, size int64) *FilterFile {
+	classified, err := ClassifyPath(pathname)
+	if err != nil {
+		classified = nil
+	}
+	return newFilterFile(user, maildir, pathname, size, classified)
+}
+
+// newFilterFile returns the filter fields of a file classified by a path template, or nil if unclassified
+func newFilterFile(user, maildir, pathname string, size int64, classified *MaildirPath) *FilterFile {
+	f := FilterFile{
+		User:    user,
+		Maildir: maildir,
+		Folder:  MaildirDisplayName(maildir),
+		Path:    pathname,
+		Size:    size,
+	}
+	f.Class = CLASS_UNKNOWN
+	if classified != nil {
+		f.Subdir = classified.Subdir
+		f.Class = classified.Class
+		f.Domain = classified.Domain
+	}
+	if f.Class == CLASS_MESSAGE {
+		message, err := ParseMaildirName(pathname)
+		if err == nil {
+			f.Flags = message.Flags
+			f.Host = message.Host
+			f.Time = message.Time
+		}
+	}
+	return &f
+}
+
+// fields returns the values of a field; maildir matches both the archived and the decoded folder name
+func (f *FilterFile) fields(name string) []string {
+	switch name {
+	case "user":
+		return []string{f.User}
+	case "maildir":
+		return []string{f.Maildir, f.Folder}
+	case "path":
+		return []string{f.Path}
+	case "flags":
+		return []string{f.Flags}
+	case "subdir":
+		return []string{f.Subdir}
+	case "class":
+		return []string{string(f.Class)}
+	case "domain":
+		return []string{f.Domain}
+	case "host":
+		return []string{f.Host}
+	}
+	return []string{}
+}
+
+// Match returns whether the filter selects file and the rule deciding it, nil if no rule matched
+func (f *Filter) Match(file *FilterFile) (bool, *FilterRule) {
+	for _, rule := range f.Rules {
+		if rule.expr.eval(file) {
+			return rule.Include, rule
+		}
+	}
+	return !f.hasInclude, nil
+}
+
+// Explain describes the filter decision for file
+func (f *Filter) Explain(file *FilterFile) string {
+	selected, rule := f.Match(file)
+	decision := "rejected"
+	if selected {
+		decision = "selected"
+	}
+	if rule == nil {
+		if f.hasInclude {
+			return decision + " by default: no include rule matched"
+		}
+		return decision + " by default: no rule matched"
+	}
+	return decision + " by " + rule.String()
+}
+
+// ParseFilter parses filter rules separated by newlines or semicolons outside quoted strings
+func ParseFilter(text string) (*Filter, error) {
+	filter := Filter{Rules: []*FilterRule{}}
+	for _, line := range splitFilterRules(text) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseFilterRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("filter rule '%s': %v", line, err)
+		}
+		rule.Index = len(filter.Rules) + 1
+		filter.hasInclude = filter.hasInclude || rule.Include
+		filter.Rules = append(filter.Rules, rule)
+	}
+	return &filter, nil
+}
+
+// splitFilterRules splits text into rules at newlines and at semicolons outside quoted strings
+func splitFilterRules(text string) []string {
+	rules := []string{}
+	for _, line := range strings.Split(text, "\n") {
+		var quote rune
+		start := 0
+		for i, r := range line {
+			switch {
+			case quote != 0:
+				if r == quote {
+					quote = 0
+				}
+			case r == '"' || r == '\'':
+				quote = r
+			case r == ';':
+				rules = append(rules, line[start:i])
+				start = i + 1
+			}
+		}
+		rules = append(rules, line[start:])
+	}
+	return rules
+}
+
+func parseFilterRule(text string) (*FilterRule, error) {
+	tokens, err := filterTokens(text)
+	if err != nil {
+		return nil, err
+	}
+	rule := FilterRule{Text: text}
+	switch tokens[0].text {
+	case "include":
+		rule.Include = true
+	case "exclude":
+	default:
+		return nil, fmt.Errorf("expected include or exclude")
+	}
+	p := filterParser{tokens: tokens[1:]}
+	if p.done() {
+		return nil, fmt.Errorf("missing expression")
+	}
+	rule.expr, err = p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if !p.done() {
+		return nil, fmt.Errorf("unexpected '%s'", p.peek().text)
+	}
+	return &rule, nil
+}
+
+type filterToken struct {
+	text   string
+	quoted bool
+}
+
+const filterOperatorChars = "=!~<>"
+
+// filterTokens splits a rule into words, quoted strings, operators and punctuation
+func filterTokens(text string) ([]filterToken, error) {
+	tokens := []filterToken{}
+	runes := []rune(text)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')' || r == ',':
+			tokens = append(tokens, filterToken{text: string(r)})
+			i++
+		case r == '"' || r == '\'':
+			end := i + 1
+			for end < len(runes) && runes[end] != r {
+				end++
+			}
+			if end == len(runes) {
+				return nil, fmt.Errorf("unterminated quoted string")
+			}
+			tokens = append(tokens, filterToken{text: string(runes[i+1 : end]), quoted: true})
+			i = end + 1
+		case strings.ContainsRune(filterOperatorChars, r):
+			end := i + 1
+			for end < len(runes) && strings.ContainsRune(filterOperatorChars, runes[end]) {
+				end++
+			}
+			tokens = append(tokens, filterToken{text: string(runes[i:end])})
+			i = end
+		default:
+			end := i + 1
+			for end < len(runes) && !unicode.IsSpace(runes[end]) && !strings.ContainsRune(`(),"'`+filterOperatorChars, runes[end]) {
+				end++
+			}
+			tokens = append(tokens, filterToken{text: string(runes[i:end])})
+			i = end
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty rule")
+	}
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterParser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *filterParser) peek() filterToken {
+	if p.done() {
+		return filterToken{}
+	}
+	return p.tokens[p.pos]
+}
+
+// keyword returns true and advances if the next token is the unquoted word
+func (p *filterParser) keyword(word string) bool {
+	token := p.peek()
+	if !p.done() && !token.quoted && token.text == word {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) next() (filterToken, error) {
+	if p.done() {
+		return filterToken{}, fmt.Errorf("unexpected end of rule")
+	}
+	token := p.tokens[p.pos]
+	p.pos++
+	return token, nil
+}
+
+func (p *filterParser) parseOr() (filterExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &filterOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &filterAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (filterExpr, error) {
+	if p.keyword("not") {
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &filterNot{expr}, nil
+	}
+	if p.keyword("(") {
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.keyword(")") {
+			return nil, fmt.Errorf("missing ')'")
+		}
+		return expr, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (filterExpr, error) {
+	field, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if field.quoted || !slices.Contains(FILTER_FIELDS, field.text) {
+		return nil, fmt.Errorf("unknown field '%s': expected one of %s", field.text, strings.Join(FILTER_FIELDS, ", "))
+	}
+	op, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	c := filterCompare{field: field.text, op: op.text}
+	if op.text == "in" && !op.quoted {
+		if !p.keyword("(") {
+			return nil, fmt.Errorf("expected '(' after in")
+		}
+		for {
+			value, err := p.next()
+			if err != nil {
+				return nil, err
+			}
+			c.values = append(c.values, value.text)
+			if p.keyword(")") {
+				break
+			}
+			if !p.keyword(",") {
+				return nil, fmt.Errorf("expected ',' or ')' in value list")
+			}
+		}
+	} else {
+		value, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		c.values = []string{value.text}
+	}
+	err = c.compile()
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+type filterExpr interface {
+	eval(file *FilterFile) bool
+}
+
+type filterAnd struct{ left, right filterExpr }
+type filterOr struct{ left, right filterExpr }
+type filterNot struct{ expr filterExpr }
+
+func (e *filterAnd) eval(file *FilterFile) bool { return e.left.eval(file) && e.right.eval(file) }
+func (e *filterOr) eval(file *FilterFile) bool  { return e.left.eval(file) || e.right.eval(file) }
+func (e *filterNot) eval(file *FilterFile) bool { return !e.expr.eval(file) }
+
+type filterCompare struct {
+	field  string
+	op     string
+	values []string
+	size   int64
+	date   time.Time
+	regex  *regexp.Regexp
+}
+
+func (c *filterCompare) compile() error {
+	value := c.values[0]
+	switch c.field {
+	case "size", "date":
+		switch c.op {
+		case "=", "!=", "<", "<=", ">", ">=":
+		default:
+			return fmt.Errorf("operator '%s' not supported for %s", c.op, c.field)
+		}
+		if c.field == "date" {
+			date, err := time.Parse(DATE_FORMAT, value)
+			if err != nil {
+				return fmt.Errorf("invalid date '%s': expected YYYY-MM-DD", value)
+			}
+			c.date = date
+			return nil
+		}
+		size, err := ParseSize(value)
+		if err != nil {
+			return err
+		}
+		c.size = size
+		return nil
+	}
+	switch c.op {
+	case "=", "!=", "in":
+	case "~", "!~":
+		regex, err := regexp.Compile(value)
+		if err != nil {
+			return fmt.Errorf("invalid regex '%s': %v", value, err)
+		}
+		c.regex = regex
+	case "has":
+		if c.field != "flags" {
+			return fmt.Errorf("operator 'has' is only supported for flags")
+		}
+	default:
+		return fmt.Errorf("operator '%s' not supported for %s", c.op, c.field)
+	}
+	return nil
+}
+
+func (c *filterCompare) eval(file *FilterFile) bool {
+	switch c.field {
+	case "size":
+		return compareOrdered(c.op, file.Size, c.size)
+	case "date":
+		// files that are not messages have no delivery date
+		if file.Time.IsZero() {
+			return false
+		}
+		day := time.Date(file.Time.Year(), file.Time.Month(), file.Time.Day(), 0, 0, 0, 0, time.UTC)
+		return compareOrdered(c.op, day.Unix(), c.date.Unix())
+	}
+	switch c.op {
+	case "!=":
+		return !c.match("=", file)
+	case "!~":
+		return !c.match("~", file)
+	}
+	return c.match(c.op, file)
+}
+
+// match returns true if any value of the field satisfies op
+func (c *filterCompare) match(op string, file *FilterFile) bool {
+	for _, value := range file.fields(c.field) {
+		switch op {
+		case "=":
+			if value == c.values[0] {
+				return true
+			}
+		case "in":
+			if slices.Contains(c.values, value) {
+				return true
+			}
+		case "~":
+			if c.regex.MatchString(value) {
+				return true
+			}
+		case "has":
+			if containsAll(value, c.values[0]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func compareOrdered(op string, value, operand int64) bool {
+	switch op {
+	case "=":
+		return value == operand
+	case "!=":
+		return value != operand
+	case "<":
+		return value < operand
+	case "<=":
+		return value <= operand
+	case ">":
+		return value > operand
+	case ">=":
+		return value >= operand
+	}
+	return false
+}
+
+func containsAll(value, letters string) bool {
+	for _, letter := range letters {
+		if !strings.ContainsRune(value, letter) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestFilterMatch(t *testing.T) {
+	filter, err := ParseFilter(`exclude maildir in (.Trash, .Junk)
+		exclude size >= 20M
+		include flags has F or not flags has S`)
+	require.Nil(t, err)
+	require.Len(t, filter.Rules, 3)
+
+	cases := []struct {
+		maildir  string
+		path     string
+		size     int64
+		selected bool
+		rule     int
+	}{
+		{"INBOX", "./alice/Maildir/cur/1.M1P1.host:2,FS", 1000, true, 3},
+		{"INBOX", "./alice/Maildir/cur/2.M1P1.host:2,S", 1000, false, 0},
+		{"INBOX", "./alice/Maildir/new/3.M1P1.host", 1000, true, 3},
+		{"INBOX", "./alice/Maildir/cur/4.M1P1.host:2,F", 30 << 20, false, 2},
+		{".Trash", "./alice/Maildir/.Trash/cur/5.M1P1.host:2,F", 1000, false, 1},
+	}
+	for _, c := range cases {
+		file := NewFilterFile("alice", c.maildir, c.path, c.size)
+		selected, rule := filter.Match(file)
+		require.Equal(t, c.selected, selected, c.path)
+		if c.rule == 0 {
+			require.Nil(t, rule, c.path)
+		} else {
+			require.Equal(t, c.rule, rule.Index, c.path)
+		}
+	}
+
+	filter, err = ParseFilter(`exclude subdir = tmp; exclude user ~ "^test" and not (path ~ keep)`)
+	require.Nil(t, err)
+	selected, _ := filter.Match(NewFilterFile("testuser", "INBOX", "./testuser/Maildir/cur/keep.1", 1))
+	require.True(t, selected)
+	selected, _ = filter.Match(NewFilterFile("testuser", "INBOX", "./testuser/Maildir/cur/1", 1))
+	require.False(t, selected)
+	selected, _ = filter.Match(NewFilterFile("alice", "INBOX", "./alice/Maildir/tmp/1", 1))
+	require.False(t, selected)
+	require.Equal(t, "selected by default: no rule matched", filter.Explain(NewFilterFile("alice", "INBOX", "./alice/Maildir/cur/1", 1)))
+}
+
+func TestFilterDecodedFolder(t *testing.T) {
+	filter, err := ParseFilter(`exclude maildir = Entwürfe; exclude maildir ~ "^Archive/"`)
+	require.Nil(t, err)
+	selected, _ := filter.Match(NewFilterFile("alice", ".Entw&APw-rfe", "./alice/Maildir/.Entw&APw-rfe/cur/1", 1))
+	require.False(t, selected)
+	selected, _ = filter.Match(NewFilterFile("alice", ".Archive.2024", "./alice/Maildir/.Archive.2024/cur/1", 1))
+	require.False(t, selected)
+	filter, err = ParseFilter(`exclude maildir != .Sent`)
+	require.Nil(t, err)
+	selected, _ = filter.Match(NewFilterFile("alice", ".Sent", "./alice/Maildir/.Sent/cur/1", 1))
+	require.True(t, selected)
+}
+
+func TestFilterMessageName(t *testing.T) {
+	filter, err := ParseFilter(`include date >= 2023-11-14 and host = mx1`)
+	require.Nil(t, err)
+	selected, _ := filter.Match(NewFilterFile("alice", "INBOX", "./alice/Maildir/cur/1700000000.M1P1.mx1:2,S", 1))
+	require.True(t, selected)
+	selected, _ = filter.Match(NewFilterFile("alice", "INBOX", "./alice/Maildir/cur/1699000000.M1P1.mx1:2,S", 1))
+	require.False(t, selected)
+	selected, _ = filter.Match(NewFilterFile("alice", "INBOX", "./alice/Maildir/dovecot-uidlist", 1))
+	require.False(t, selected)
+}
+
+func TestFilterQuotedSemicolon(t *testing.T) {
+	filter, err := ParseFilter(`exclude path ~ "a;b" ; include path ~ 'c;d'` + "\ninclude user = bob")
+	require.Nil(t, err)
+	require.Len(t, filter.Rules, 3)
+	require.Equal(t, `exclude path ~ "a;b"`, filter.Rules[0].Text)
+	require.Equal(t, `include path ~ 'c;d'`, filter.Rules[1].Text)
+	selected, rule := filter.Match(NewFilterFile("alice", "INBOX", "./alice/Maildir/cur/a;b", 1))
+	require.False(t, selected)
+	require.Equal(t, 1, rule.Index)
+	selected, rule = filter.Match(NewFilterFile("alice", "INBOX", "./alice/Maildir/cur/c;d", 1))
+	require.True(t, selected)
+	require.Equal(t, 2, rule.Index)
+	selected, _ = filter.Match(NewFilterFile("alice", "INBOX", "./alice/Maildir/cur/c", 1))
+	require.False(t, selected)
+}
+
+func TestFilterParseErrors(t *testing.T) {
+	for _, text := range []string{
+		"select user = alice",
+		"include",
+		"include color = red",
+		"include size ~ 10",
+		"include user has F",
+		"include (user = alice",
+		"include user = alice bob",
+		`include path ~ "unterminated`,
+		`include path ~ "a;b`,
+		"include path ~ [",
+		"include date > yesterday",
+	} {
+		_, err := ParseFilter(text)
+		require.NotNil(t, err, text)
+	}
+}
@@ -0,0 +1,89 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+var filterHelpCmd = &cobra.Command{
+	Use:   "filter",
+	Short: "file selection rules for --filter",
+	Long: `
+The --filter option selects files with include and exclude rules separated
+by semicolons or newlines; semicolons within quoted values do not separate
+rules. The rules are evaluated in order after --user and --maildir; the
+first rule matching a file decides. A file matching no rule is selected
+only if there are no include rules.
+
+  include|exclude EXPR
+
+EXPR combines comparisons with and, or, not and parentheses:
+
+  FIELD = VALUE         FIELD != VALUE        FIELD in (VALUE, ...)
+  FIELD ~ REGEX         FIELD !~ REGEX
+  size < SIZE           also <=, >, >=; SIZE accepts K, M and G suffixes
+  date < YYYY-MM-DD     also =, !=, <=, >, >=
+  flags has LETTERS     all of the Maildir flag letters are set
+
+Fields:
+
+  user      username, or user@domain if --path-template has a {domain}
+  domain    domain from --path-template
+  maildir   folder name as archived (INBOX, .Sent, .Entw&APw-rfe) or
+            decoded (Sent, Entwürfe, Archive/2024)
+  path      archive pathname, for example ./USER/Maildir/...
+  size      file size in bytes
+  flags     Maildir info flags: D draft, F flagged, P passed, R replied,
+            S seen, T trashed
+  subdir    cur, new or tmp
+  class     message, folder-metadata, mailbox-metadata, unknown or directory
+  host      delivery host from the Maildir filename
+  date      delivery date (UTC) from the Maildir filename; only messages
+            have a date
+
+Values containing spaces, parentheses, commas or =!~<> must be quoted.
+
+Example: all folders except Trash and Junk, only messages under 20 MB,
+only flagged or unseen:
+
+  --filter 'exclude maildir in (.Trash, .Junk);
+            exclude size >= 20M;
+            include flags has F or not flags has S'
+
+Use --explain REGEX to report which rule selected or rejected each path
+matching REGEX.
+`,
+}
+
+func init() {
+	rootCmd.AddCommand(filterHelpCmd)
+}
@@ -0,0 +1,572 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// IMAP_DELIMITER is the hierarchy separator of the IMAP mailbox names
+const IMAP_DELIMITER = "/"
+
+// DEFAULT_IMAP_CACHE is the default directory caching messages extracted for IMAP clients
+const DEFAULT_IMAP_CACHE = "~/.tarsnap-maildir-restore/imap-cache"
+
+var ErrIMAPReadOnly = errors.New("archive mailboxes are read-only")
+
+// MAILDIR_IMAP_FLAGS maps Maildir info flag letters to IMAP flags
+var MAILDIR_IMAP_FLAGS = map[rune]string{
+	'D': imap.DraftFlag,
+	'F': imap.FlaggedFlag,
+	'P': "$Forwarded",
+	'R': imap.AnsweredFlag,
+	'S': imap.SeenFlag,
+	'T': imap.DeletedFlag,
+}
+
+// IMAPFlags returns the IMAP flags of Maildir info flags
+func IMAPFlags(flags string) []string {
+	result := []string{}
+	for _, letter := range flags {
+		flag, ok := MAILDIR_IMAP_FLAGS[letter]
+		if ok {
+			result = append(result, flag)
+		}
+	}
+	return result
+}
+
+// MessageCache holds message contents extracted from an archive in a local directory
+// A message not yet cached is extracted with the other uncached messages of its mailbox by
+// reading the tar stream of the user's maildir archive once. Concurrent requests for a
+// message being extracted wait for that extraction; other mailboxes are extracted concurrently.
+type MessageCache struct {
+	dir     string
+	tarsnap *Tarsnap
+	mutex   sync.Mutex
+	pending map[string]*cacheLoad
+	logger  *slog.Logger
+}
+
+// cacheLoad is an extraction of the messages of one mailbox in progress
+type cacheLoad struct {
+	done chan struct{}
+	err  error
+}
+
+func NewMessageCache(dir string, tarsnap *Tarsnap) (*MessageCache, error) {
+	dir = ExpandPath(dir)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating cache directory: %v", err)
+	}
+	return &MessageCache{dir: dir, tarsnap: tarsnap, pending: make(map[string]*cacheLoad), logger: tarsnap.logger}, nil
+}
+
+// filename returns the cache file of an archive path
+func (c *MessageCache) filename(pathname string) string {
+	sum := sha256.Sum256([]byte(c.tarsnap.Archive + "\x00" + pathname))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+// Get returns the content of the archive path of userName, extracting it with the
+// uncached files of mailbox from the archive if it is not cached
+func (c *MessageCache) Get(userName, pathname string, mailbox []MaildirFile) ([]byte, error) {
+	data, err := os.ReadFile(c.filename(pathname))
+	if err == nil {
+		return data, nil
+	}
+	c.mutex.Lock()
+	load, loading := c.pending[pathname]
+	var selection *streamSelection
+	if !loading {
+		load = &cacheLoad{done: make(chan struct{})}
+		selection, err = c.selectUncached(userName, pathname, mailbox, load)
+		if err != nil {
+			c.mutex.Unlock()
+			return nil, err
+		}
+	}
+	c.mutex.Unlock()
+
+	if loading {
+		<-load.done
+	} else {
+		names := SortedKeys(selection.files)
+		load.err = c.tarsnap.streamArchive(context.Background(), selection, &cacheSink{cache: c}, nil)
+		c.mutex.Lock()
+		for _, name := range names {
+			delete(c.pending, name)
+		}
+		c.mutex.Unlock()
+		close(load.done)
+		if load.err != nil {
+			c.logger.Warn("imap cache extraction failed", "user", userName, "files", len(names), "error", load.err)
+		}
+	}
+	data, err = os.ReadFile(c.filename(pathname))
+	if err != nil {
+		if load.err != nil {
+			return nil, load.err
+		}
+		return nil, fmt.Errorf("failed reading cached message: %v", err)
+	}
+	return data, nil
+}
+
+// selectUncached registers the extraction of pathname and the uncached, not pending files of mailbox
+// The caller must hold the mutex.
+func (c *MessageCache) selectUncached(userName, pathname string, mailbox []MaildirFile, load *cacheLoad) (*streamSelection, error) {
+	user, ok := c.tarsnap.Users[userName]
+	if !ok {
+		return nil, fmt.Errorf("unknown user: %s", userName)
+	}
+	selection := streamSelection{archive: MaildirArchiveName(c.tarsnap.Archive, user.Archive), user: userName, files: make(map[string]*StreamEntry)}
+	for _, file := range mailbox {
+		_, pending := c.pending[file.Name]
+		if pending || file.Class == CLASS_DIRECTORY {
+			continue
+		}
+		if file.Name != pathname && IsFile(c.filename(file.Name)) {
+			continue
+		}
+		selection.files[file.Name] = &StreamEntry{Name: file.Name, Target: file.Name, User: userName, File: file}
+	}
+	if selection.files[pathname] == nil {
+		return nil, fmt.Errorf("path not found in %s mailbox of %s: %s", c.tarsnap.Archive, userName, pathname)
+	}
+	for name := range selection.files {
+		c.pending[name] = load
+	}
+	if c.tarsnap.verbose {
+		c.logger.Info("imap cache extracting", "user", userName, "files", len(selection.files))
+	}
+	return &selection, nil
+}
+
+// cacheSink writes streamed messages to the cache
+type cacheSink struct {
+	cache *MessageCache
+}
+
+func (s *cacheSink) Write(entry *StreamEntry, content io.Reader) (string, error) {
+	file, err := os.CreateTemp(s.cache.dir, ".cache-*")
+	if err != nil {
+		return "", fmt.Errorf("failed caching message: %v", err)
+	}
+	_, err = io.Copy(file, content)
+	cerr := file.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), s.cache.filename(entry.Name))
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("failed caching message: %v", err)
+	}
+	return entry.Target, nil
+}
+
+func (s *cacheSink) Close() error {
+	return nil
+}
+
+// IMAPBackend serves the users of an archive as read-only IMAP accounts
+// Users log in with their bcrypt password hash from the password file, or with the
+// server password if the archive is served for a single user.
+type IMAPBackend struct {
+	tarsnap     *Tarsnap
+	cache       *MessageCache
+	password    string
+	hashes      map[string][]byte
+	uidValidity uint32
+	logger      *slog.Logger
+}
+
+// NewIMAPBackend returns the backend authenticating users with hashes, or with password if hashes is nil
+// A password shared by several users is rejected, as it would give every user access to all mailboxes.
+func NewIMAPBackend(tarsnap *Tarsnap, cache *MessageCache, password string, hashes map[string][]byte) (*IMAPBackend, error) {
+	if hashes == nil && len(tarsnap.Users) != 1 {
+		return nil, fmt.Errorf("a shared imap password would give each of the %d users access to all mailboxes: use --imap-passwords or select one user with --user", len(tarsnap.Users))
+	}
+	// the archive date identifies the UIDs assigned from its metadata
+	uidValidity := uint32(1)
+	date, _, err := ParseArchiveBase(tarsnap.Archive)
+	if err == nil {
+		uidValidity = uint32(date.Unix() / 86400)
+	}
+	return &IMAPBackend{
+		tarsnap:     tarsnap,
+		cache:       cache,
+		password:    password,
+		hashes:      hashes,
+		uidValidity: uidValidity,
+		logger:      tarsnap.logger,
+	}, nil
+}
+
+// ReadIMAPPasswords reads a password file of USER:HASH lines with bcrypt password hashes,
+// as written by htpasswd -B; blank lines and lines starting with # are ignored
+func ReadIMAPPasswords(filename string) (map[string][]byte, error) {
+	data, err := os.ReadFile(ExpandPath(filename))
+	if err != nil {
+		return nil, fmt.Errorf("failed reading imap password file: %v", err)
+	}
+	hashes := make(map[string][]byte)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if ok {
+			_, err = bcrypt.Cost([]byte(hash))
+		}
+		if !ok || user == "" || err != nil {
+			return nil, fmt.Errorf("%s line %d: expected USER:BCRYPT_HASH", filename, i+1)
+		}
+		hashes[user] = []byte(hash)
+	}
+	return hashes, nil
+}
+
+// authenticate returns true if password is the password of username
+func (b *IMAPBackend) authenticate(username, password string) bool {
+	if b.hashes == nil {
+		return subtle.ConstantTimeCompare([]byte(password), []byte(b.password)) == 1
+	}
+	hash, ok := b.hashes[username]
+	return ok && bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+// Login accepts the users of the archive with their password
+func (b *IMAPBackend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	user, ok := b.tarsnap.Users[username]
+	if !ok || !b.authenticate(username, password) {
+		b.logger.Warn("imap login failed", "user", username, "remote", connInfo.RemoteAddr)
+		return nil, backend.ErrInvalidCredentials
+	}
+	b.logger.Info("imap login", "user", username, "remote", connInfo.RemoteAddr)
+	return newIMAPUser(b, username, user), nil
+}
+
+type imapUser struct {
+	name      string
+	mailboxes map[string]*imapMailbox
+}
+
+func newIMAPUser(b *IMAPBackend, name string, user *User) *imapUser {
+	u := imapUser{name: name, mailboxes: make(map[string]*imapMailbox)}
+	for maildirName, maildir := range user.Maildirs {
+		if maildirName == MAILBOX_FOLDER {
+			continue
+		}
+		messages := []MaildirFile{}
+		for _, file := range maildir.Files {
+			if file.Class == CLASS_MESSAGE {
+				messages = append(messages, file)
+			}
+		}
+		sort.SliceStable(messages, func(i, j int) bool {
+			if messages[i].Message != nil && messages[j].Message != nil && !messages[i].Message.Time.Equal(messages[j].Message.Time) {
+				return messages[i].Message.Time.Before(messages[j].Message.Time)
+			}
+			return messages[i].Name < messages[j].Name
+		})
+		name := maildir.DisplayName
+		u.mailboxes[strings.ToUpper(name)] = &imapMailbox{name: name, user: u.name, backend: b, messages: messages}
+	}
+	return &u
+}
+
+func (u *imapUser) Username() string {
+	return u.name
+}
+
+func (u *imapUser) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	mailboxes := []backend.Mailbox{}
+	for _, key := range SortedKeys(u.mailboxes) {
+		mailboxes = append(mailboxes, u.mailboxes[key])
+	}
+	return mailboxes, nil
+}
+
+// GetMailbox returns the named mailbox; mailbox names are case insensitive
+func (u *imapUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mailbox, ok := u.mailboxes[strings.ToUpper(name)]
+	if !ok {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	return mailbox, nil
+}
+
+func (u *imapUser) CreateMailbox(name string) error {
+	return ErrIMAPReadOnly
+}
+
+func (u *imapUser) DeleteMailbox(name string) error {
+	return ErrIMAPReadOnly
+}
+
+func (u *imapUser) RenameMailbox(existingName, newName string) error {
+	return ErrIMAPReadOnly
+}
+
+func (u *imapUser) Logout() error {
+	return nil
+}
+
+// imapMailbox lists the messages of a Maildir folder; the UID of a message is its position in delivery order
+type imapMailbox struct {
+	name     string
+	user     string
+	backend  *IMAPBackend
+	messages []MaildirFile
+}
+
+func (m *imapMailbox) Name() string {
+	return m.name
+}
+
+func (m *imapMailbox) Info() (*imap.MailboxInfo, error) {
+	return &imap.MailboxInfo{Delimiter: IMAP_DELIMITER, Name: m.name}, nil
+}
+
+func (m *imapMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	status := imap.NewMailboxStatus(m.name, items)
+	status.ReadOnly = true
+	status.Flags = []string{imap.SeenFlag, imap.AnsweredFlag, imap.FlaggedFlag, imap.DeletedFlag, imap.DraftFlag, "$Forwarded"}
+	status.PermanentFlags = []string{}
+	for i, file := range m.messages {
+		if !m.seen(file) && status.UnseenSeqNum == 0 {
+			status.UnseenSeqNum = uint32(i + 1)
+		}
+	}
+	for _, item := range items {
+		switch item {
+		case imap.StatusMessages:
+			status.Messages = uint32(len(m.messages))
+		case imap.StatusUidNext:
+			status.UidNext = uint32(len(m.messages) + 1)
+		case imap.StatusUidValidity:
+			status.UidValidity = m.backend.uidValidity
+		case imap.StatusRecent:
+			status.Recent = 0
+		case imap.StatusUnseen:
+			for _, file := range m.messages {
+				if !m.seen(file) {
+					status.Unseen += 1
+				}
+			}
+		}
+	}
+	return status, nil
+}
+
+func (m *imapMailbox) seen(file MaildirFile) bool {
+	return file.Message != nil && strings.ContainsRune(file.Message.Flags, 'S')
+}
+
+func (m *imapMailbox) SetSubscribed(subscribed bool) error {
+	return nil
+}
+
+func (m *imapMailbox) Check() error {
+	return nil
+}
+
+// ListMessages sends the requested items of each message; flags, size, date and UID come
+// from the metadata, and only items reading the message content extract it
+func (m *imapMailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+	for i, file := range m.messages {
+		seqNum := uint32(i + 1)
+		id := seqNum
+		if uid {
+			id = m.uid(i)
+		}
+		if !seqSet.Contains(id) {
+			continue
+		}
+		message, err := m.fetch(i, items)
+		if err != nil {
+			m.backend.logger.Warn("imap fetch failed", "file", file.Name, "error", err)
+			continue
+		}
+		ch <- message
+	}
+	return nil
+}
+
+func (m *imapMailbox) uid(index int) uint32 {
+	return uint32(index + 1)
+}
+
+func (m *imapMailbox) internalDate(file MaildirFile) time.Time {
+	if file.Message != nil {
+		return file.Message.Time
+	}
+	return time.Time{}
+}
+
+func (m *imapMailbox) flags(file MaildirFile) []string {
+	if file.Message != nil {
+		return IMAPFlags(file.Message.Flags)
+	}
+	return []string{}
+}
+
+func (m *imapMailbox) fetch(index int, items []imap.FetchItem) (*imap.Message, error) {
+	file := m.messages[index]
+	fetched := imap.NewMessage(uint32(index+1), items)
+	var content []byte
+	read := func() error {
+		if content == nil {
+			data, err := m.backend.cache.Get(m.user, file.Name, m.messages)
+			if err != nil {
+				return err
+			}
+			content = data
+		}
+		return nil
+	}
+	load := func() (textproto.Header, *bufio.Reader, error) {
+		err := read()
+		if err != nil {
+			return textproto.Header{}, nil, err
+		}
+		body := bufio.NewReader(bytes.NewReader(content))
+		header, err := textproto.ReadHeader(body)
+		return header, body, err
+	}
+	for _, item := range items {
+		switch item {
+		case imap.FetchFlags:
+			fetched.Flags = m.flags(file)
+		case imap.FetchInternalDate:
+			fetched.InternalDate = m.internalDate(file)
+		case imap.FetchRFC822Size:
+			size := file.Size
+			if size == 0 {
+				// the listed size of a hard link whose target was not listed before it
+				err := read()
+				if err != nil {
+					return nil, err
+				}
+				size = int64(len(content))
+			}
+			fetched.Size = uint32(size)
+		case imap.FetchUid:
+			fetched.Uid = m.uid(index)
+		case imap.FetchEnvelope:
+			header, _, err := load()
+			if err != nil {
+				return nil, err
+			}
+			fetched.Envelope, _ = backendutil.FetchEnvelope(header)
+		case imap.FetchBody, imap.FetchBodyStructure:
+			header, body, err := load()
+			if err != nil {
+				return nil, err
+			}
+			fetched.BodyStructure, _ = backendutil.FetchBodyStructure(header, body, item == imap.FetchBodyStructure)
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil {
+				break
+			}
+			header, body, err := load()
+			if err != nil {
+				return nil, err
+			}
+			literal, _ := backendutil.FetchBodySection(header, body, section)
+			fetched.Body[section] = literal
+		}
+	}
+	return fetched, nil
+}
+
+// SearchMessages matches the criteria, extracting message contents only for criteria on headers, text or size
+func (m *imapMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	ids := []uint32{}
+	content := searchNeedsContent(criteria)
+	for i, file := range m.messages {
+		entity, _ := message.New(message.Header{}, bytes.NewReader(nil))
+		if content {
+			data, err := m.backend.cache.Get(m.user, file.Name, m.messages)
+			if err != nil {
+				m.backend.logger.Warn("imap search failed", "file", file.Name, "error", err)
+				continue
+			}
+			entity, err = message.Read(bytes.NewReader(data))
+			if err != nil && entity == nil {
+				continue
+			}
+		}
+		ok, err := backendutil.Match(entity, uint32(i+1), m.uid(i), m.internalDate(file), m.flags(file), criteria)
+		if err != nil || !ok {
+			continue
+		}
+		if uid {
+			ids = append(ids, m.uid(i))
+		} else {
+			ids = append(ids, uint32(i+1))
+		}
+	}
+	return ids, nil
+}
+
+func searchNeedsContent(c *imap.SearchCriteria) bool {
+	if !c.SentBefore.IsZero() || !c.SentSince.IsZero() || len(c.Header) > 0 || len(c.Body) > 0 || len(c.Text) > 0 || c.Larger > 0 || c.Smaller > 0 {
+		return true
+	}
+	for _, not := range c.Not {
+		if searchNeedsContent(not) {
+			return true
+		}
+	}
+	for _, or := range c.Or {
+		if searchNeedsContent(or[0]) || searchNeedsContent(or[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *imapMailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	return ErrIMAPReadOnly
+}
+
+func (m *imapMailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation imap.FlagsOp, flags []string) error {
+	return ErrIMAPReadOnly
+}
+
+func (m *imapMailbox) CopyMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	return ErrIMAPReadOnly
+}
+
+func (m *imapMailbox) Expunge() error {
+	return ErrIMAPReadOnly
+}
@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/server"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestIMAPFlags(t *testing.T) {
+	require.Equal(t, []string{imap.FlaggedFlag, imap.AnsweredFlag, imap.SeenFlag}, IMAPFlags("FRSx"))
+	require.Equal(t, []string{}, IMAPFlags(""))
+}
+
+func TestIMAPBackend(t *testing.T) {
+	tarsnap := &Tarsnap{Archive: "2025-06-25.mailbox", Users: make(map[string]*User), logger: slog.Default()}
+	user := tarsnap.getUser("alice")
+	inbox := user.getMaildir("INBOX")
+	inbox.AddFile("./alice/Maildir/cur/1700000002.M1P1.host,S=40:2,S", 40)
+	inbox.AddFile("./alice/Maildir/new/1700000001.M1P1.host", 41)
+	inbox.AddFile("./alice/Maildir/dovecot-uidlist", 10)
+	user.getMaildir(".Entw&APw-rfe")
+	user.getMaildir(MAILBOX_FOLDER).AddFile("./alice/Maildir/subscriptions", 10)
+
+	cache, err := NewMessageCache(t.TempDir(), tarsnap)
+	require.Nil(t, err)
+	// cached contents are served without running tarsnap
+	cacheMessage := func(pathname, content string) {
+		sum := sha256.Sum256([]byte(tarsnap.Archive + "\x00" + pathname))
+		require.Nil(t, os.WriteFile(filepath.Join(cache.dir, hex.EncodeToString(sum[:])), []byte(content), 0600))
+	}
+	cacheMessage("./alice/Maildir/new/1700000001.M1P1.host", "Subject: first\r\n\r\nfirst body\r\n")
+	cacheMessage("./alice/Maildir/cur/1700000002.M1P1.host,S=40:2,S", "Subject: second\r\n\r\nsecond body\r\n")
+
+	backend, err := NewIMAPBackend(tarsnap, cache, "secret", nil)
+	require.Nil(t, err)
+	s := server.New(backend)
+	s.AllowInsecureAuth = true
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	go s.Serve(listener)
+	defer s.Close()
+
+	c, err := client.Dial(listener.Addr().String())
+	require.Nil(t, err)
+	defer c.Logout()
+	require.NotNil(t, c.Login("alice", "wrong"))
+	require.NotNil(t, c.Login("bob", "secret"))
+	require.Nil(t, c.Login("alice", "secret"))
+
+	mailboxes := make(chan *imap.MailboxInfo, 10)
+	require.Nil(t, c.List("", "*", mailboxes))
+	names := []string{}
+	for mailbox := range mailboxes {
+		names = append(names, mailbox.Name)
+	}
+	require.Equal(t, []string{"Entwürfe", "INBOX"}, names)
+
+	status, err := c.Select("inbox", false)
+	require.Nil(t, err)
+	require.True(t, status.ReadOnly)
+	require.Equal(t, uint32(2), status.Messages)
+	require.Equal(t, uint32(20264), status.UidValidity)
+
+	seqSet, _ := imap.ParseSeqSet("1:*")
+	section := &imap.BodySectionName{}
+	messages := make(chan *imap.Message, 10)
+	require.Nil(t, c.Fetch(seqSet, []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchRFC822Size, section.FetchItem()}, messages))
+	bodies := []string{}
+	for message := range messages {
+		data, err := io.ReadAll(message.GetBody(section))
+		require.Nil(t, err)
+		bodies = append(bodies, string(data))
+		if message.Uid == 2 {
+			require.Equal(t, []string{imap.SeenFlag}, message.Flags)
+			require.Equal(t, uint32(40), message.Size)
+		}
+	}
+	require.Equal(t, []string{"Subject: first\r\n\r\nfirst body\r\n", "Subject: second\r\n\r\nsecond body\r\n"}, bodies)
+
+	criteria := imap.NewSearchCriteria()
+	criteria.WithoutFlags = []string{imap.SeenFlag}
+	ids, err := c.UidSearch(criteria)
+	require.Nil(t, err)
+	require.Equal(t, []uint32{1}, ids)
+	criteria = imap.NewSearchCriteria()
+	criteria.Header.Add("Subject", "second")
+	ids, err = c.Search(criteria)
+	require.Nil(t, err)
+	require.Equal(t, []uint32{2}, ids)
+
+	require.NotNil(t, c.Store(seqSet, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil))
+	require.NotNil(t, c.Create("New"))
+}
+
+func TestIMAPPasswords(t *testing.T) {
+	tarsnap := &Tarsnap{Archive: "2025-06-25.mailbox", Users: make(map[string]*User), logger: slog.Default()}
+	tarsnap.getUser("alice").getMaildir("INBOX")
+	tarsnap.getUser("bob").getMaildir("INBOX")
+	cache, err := NewMessageCache(t.TempDir(), tarsnap)
+	require.Nil(t, err)
+
+	// a shared password is refused for several users
+	_, err = NewIMAPBackend(tarsnap, cache, "secret", nil)
+	require.NotNil(t, err)
+
+	aliceHash, err := bcrypt.GenerateFromPassword([]byte("alice-secret"), bcrypt.MinCost)
+	require.Nil(t, err)
+	bobHash, err := bcrypt.GenerateFromPassword([]byte("bob-secret"), bcrypt.MinCost)
+	require.Nil(t, err)
+	filename := filepath.Join(t.TempDir(), "passwords")
+	require.Nil(t, os.WriteFile(filename, []byte("# imap users\nalice:"+string(aliceHash)+"\n\nbob:"+string(bobHash)+"\n"), 0600))
+	hashes, err := ReadIMAPPasswords(filename)
+	require.Nil(t, err)
+	require.Len(t, hashes, 2)
+	b, err := NewIMAPBackend(tarsnap, cache, "", hashes)
+	require.Nil(t, err)
+
+	connInfo := &imap.ConnInfo{RemoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}}
+	_, err = b.Login(connInfo, "alice", "alice-secret")
+	require.Nil(t, err)
+	_, err = b.Login(connInfo, "alice", "bob-secret")
+	require.NotNil(t, err)
+	_, err = b.Login(connInfo, "bob", "bob-secret")
+	require.Nil(t, err)
+	_, err = b.Login(connInfo, "carol", "bob-secret")
+	require.NotNil(t, err)
+
+	for _, invalid := range []string{"alice\n", "alice:secret\n", ":" + string(aliceHash) + "\n"} {
+		require.Nil(t, os.WriteFile(filename, []byte(invalid), 0600))
+		_, err = ReadIMAPPasswords(filename)
+		require.NotNil(t, err, invalid)
+	}
+}
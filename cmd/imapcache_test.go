@@ -0,0 +1,91 @@
+//go:build unix
+
+package cmd
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageCache(t *testing.T) {
+	src := t.TempDir()
+	runs := filepath.Join(t.TempDir(), "runs")
+	messages := map[string]string{
+		"./alice/Maildir/cur/1.M1P1.host:2,S":       "Subject: one\r\n\r\none\r\n",
+		"./alice/Maildir/cur/2.M1P1.host:2,S":       "Subject: two\r\n\r\ntwo\r\n",
+		"./alice/Maildir/.Sent/cur/3.M1P1.host:2,S": "Subject: three\r\n\r\nthree\r\n",
+	}
+	for name, content := range messages {
+		require.Nil(t, os.MkdirAll(filepath.Join(src, filepath.Dir(name)), 0700))
+		require.Nil(t, os.WriteFile(filepath.Join(src, name), []byte(content), 0600))
+	}
+	// the fake tarsnap -r writes the tar stream of the source directory, recording each run
+	script := fakeTarsnap(t, "echo run >> "+runs+"\ncd "+src+" && tar -cf - ./alice")
+	restore := OverrideOptions(map[string]any{"tarsnap_command": script, "keyfile": "", "maxbw_rate": "", "nice": 0, "ionice_idle": false})
+	defer restore()
+
+	tarsnap := &Tarsnap{Archive: "2025-06-25.mailbox", Users: make(map[string]*User), logger: slog.Default()}
+	user := tarsnap.getUser("alice")
+	for _, name := range SortedKeys(messages) {
+		maildir := ".Sent"
+		if !strings.Contains(name, ".Sent") {
+			maildir = "INBOX"
+		}
+		user.getMaildir(maildir).AddFile(name, int64(len(messages[name])))
+	}
+	inbox := user.Maildirs["INBOX"].Files
+	cache, err := NewMessageCache(t.TempDir(), tarsnap)
+	require.Nil(t, err)
+	runCount := func() int {
+		data, _ := os.ReadFile(runs)
+		return strings.Count(string(data), "run")
+	}
+
+	// concurrent reads of the mailbox extract it once
+	var group sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			data, err := cache.Get("alice", inbox[i%2].Name, inbox)
+			require.Nil(t, err)
+			require.Equal(t, messages[inbox[i%2].Name], string(data))
+		}()
+	}
+	group.Wait()
+	require.Equal(t, 1, runCount())
+	require.Empty(t, cache.pending)
+
+	// the other mailbox is extracted separately
+	sent := user.Maildirs[".Sent"].Files
+	data, err := cache.Get("alice", sent[0].Name, sent)
+	require.Nil(t, err)
+	require.Equal(t, messages[sent[0].Name], string(data))
+	require.Equal(t, 2, runCount())
+	_, err = cache.Get("alice", inbox[1].Name, inbox)
+	require.Nil(t, err)
+	require.Equal(t, 2, runCount())
+
+	// the size of a message listed with size 0 is read from its content
+	linked := inbox[0]
+	linked.Size = 0
+	mailbox := imapMailbox{name: "INBOX", user: "alice", backend: &IMAPBackend{cache: cache}, messages: []MaildirFile{linked}}
+	fetched, err := mailbox.fetch(0, []imap.FetchItem{imap.FetchRFC822Size})
+	require.Nil(t, err)
+	require.Equal(t, uint32(len(messages[linked.Name])), fetched.Size)
+
+	// a message missing from the archive
+	missing := Maildir{}
+	missing.AddFile("./alice/Maildir/cur/4.M1P1.host:2,S", 10)
+	_, err = cache.Get("alice", missing.Files[0].Name, missing.Files)
+	require.NotNil(t, err)
+	_, err = cache.Get("bob", missing.Files[0].Name, missing.Files)
+	require.NotNil(t, err)
+}
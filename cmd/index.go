@@ -0,0 +1,233 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var indexCmd = &cobra.Command{
+	Use:   "index [ARCHIVE_NAME]",
+	Short: "catalog message headers for search",
+	Long: `
+Extract the messages selected from ARCHIVE_NAME into a temporary directory
+and store their Date, From, To, Cc, Subject, Message-ID, In-Reply-To and
+References headers with the archive path in the --catalog SQLite database.
+
+Messages already cataloged for the archive are not extracted again, so
+index may be repeated with wider --user and --maildir selections. The
+temporary directory is created in $TMPDIR and removed when done; the
+restore options (--space-reserve, --stall-timeout, ...) apply to the
+extraction.
+
+The catalog is available on darwin, freebsd, linux, openbsd and windows;
+on other platforms the catalog commands fail.
+
+Use the search command to query the catalog.
+`,
+	Args: cobra.RangeArgs(0, 1),
+	Run: func(cmd *cobra.Command, args []string) {
+		archiveName, err := ArchiveBaseName(args)
+		cobra.CheckErr(err)
+		catalog, err := OpenCatalog(viper.GetString("catalog"))
+		cobra.CheckErr(err)
+		defer catalog.Close()
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		summary, err := IndexArchive(ctx, catalog, archiveName)
+		if summary != nil {
+			if viper.GetBool("json") {
+				fmt.Println(FormatJSON(summary))
+			} else {
+				fmt.Printf("%s: %d messages indexed, %d already cataloged, %d unreadable\n", summary.Archive, summary.Indexed, summary.Skipped, summary.Failed)
+			}
+		}
+		cobra.CheckErr(err)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(indexCmd)
+}
+
+// IndexSummary reports the result of indexing an archive
+type IndexSummary struct {
+	Archive string
+	Catalog string
+	Indexed int
+	Skipped int
+	Failed  int
+}
+
+// IndexArchive extracts the selected messages of archiveName not yet in the catalog and catalogs their headers
+// Messages extracted before an interrupted or failed restore are cataloged before the error is returned.
+func IndexArchive(ctx context.Context, catalog *Catalog, archiveName string) (*IndexSummary, error) {
+	dir, err := os.MkdirTemp("", "tarsnap.index.*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	defer OverrideOptions(map[string]any{"output_dir": dir})()
+	tarsnap, summary, err := selectUnindexed(catalog, archiveName)
+	if err != nil || tarsnap == nil {
+		return summary, err
+	}
+
+	restoreErr := tarsnap.Restore(ctx)
+
+	messages := []CatalogMessage{}
+	for userName, user := range tarsnap.Users {
+		for maildirName, maildir := range user.Maildirs {
+			for _, file := range maildir.Files {
+				pathname := filepath.Join(dir, file.Name)
+				_, err := os.Stat(pathname)
+				if err != nil {
+					// not extracted
+					continue
+				}
+				message, err := ReadMessageHeaders(pathname)
+				if err != nil {
+					slog.Warn("unreadable message", "archive", archiveName, "file", file.Name, "error", err)
+					summary.Failed += 1
+					continue
+				}
+				message.Archive = archiveName
+				message.Path = file.Name
+				message.User = userName
+				message.Maildir = maildirName
+				message.Size = file.Size
+				if message.Date.IsZero() && file.Message != nil {
+					message.Date = file.Message.Time
+				}
+				messages = append(messages, *message)
+			}
+		}
+	}
+	err = catalog.Add(messages)
+	if err != nil {
+		return nil, err
+	}
+	summary.Indexed = len(messages)
+	return summary, restoreErr
+}
+
+// StreamIndexArchive catalogs the headers of the selected messages of archiveName not yet in the catalog,
+// reading them from the tar stream of each maildir archive without writing the messages to disk
+// Messages read before an interrupted or failed stream are cataloged before the error is returned.
+func StreamIndexArchive(ctx context.Context, catalog *Catalog, archiveName string) (*IndexSummary, error) {
+	tarsnap, summary, err := selectUnindexed(catalog, archiveName)
+	if err != nil || tarsnap == nil {
+		return summary, err
+	}
+	sink := CatalogSink{summary: summary, messages: []CatalogMessage{}}
+	streamErr := tarsnap.StreamRestore(ctx, &sink)
+	err = catalog.Add(sink.messages)
+	if err != nil {
+		return nil, err
+	}
+	summary.Indexed = len(sink.messages)
+	return summary, streamErr
+}
+
+// selectUnindexed loads the messages of archiveName selected by the options, reduced to those not
+// yet in the catalog; the returned Tarsnap is nil if every selected message is cataloged
+func selectUnindexed(catalog *Catalog, archiveName string) (*Tarsnap, *IndexSummary, error) {
+	defer OverrideOptions(map[string]any{"classes": string(CLASS_MESSAGE)})()
+	tarsnap, err := NewTarsnap(archiveName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	summary := IndexSummary{Archive: archiveName, Catalog: catalog.Filename}
+	indexed, err := catalog.IndexedPaths(archiveName)
+	if err != nil {
+		return nil, nil, err
+	}
+	paths := []string{}
+	for _, file := range tarsnap.MaildirFiles() {
+		if indexed[file.Name] {
+			summary.Skipped += 1
+			continue
+		}
+		paths = append(paths, file.Name)
+	}
+	if len(paths) == 0 {
+		return nil, &summary, nil
+	}
+	err = tarsnap.SelectFiles(paths)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tarsnap, &summary, nil
+}
+
+// CatalogSink parses the headers of streamed messages into catalog records
+type CatalogSink struct {
+	summary  *IndexSummary
+	messages []CatalogMessage
+}
+
+func (s *CatalogSink) Write(entry *StreamEntry, content io.Reader) (string, error) {
+	if entry.File.Class != CLASS_MESSAGE {
+		return "", nil
+	}
+	message, err := ParseMessageHeaders(content)
+	if err != nil {
+		slog.Warn("unreadable message", "archive", s.summary.Archive, "file", entry.Name, "error", err)
+		s.summary.Failed += 1
+		return "", nil
+	}
+	message.Archive = s.summary.Archive
+	message.Path = entry.Name
+	message.User = entry.User
+	message.Maildir = entry.Maildir
+	message.Size = entry.File.Size
+	if message.Date.IsZero() && entry.File.Message != nil {
+		message.Date = entry.File.Message.Time
+	}
+	s.messages = append(s.messages, *message)
+	return entry.Target, nil
+}
+
+func (s *CatalogSink) Close() error {
+	return nil
+}
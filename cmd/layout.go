@@ -0,0 +1,258 @@
+package cmd
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// MaildirClass classifies a path in a user's Maildir
+type MaildirClass string
+
+const (
+	// CLASS_MESSAGE is a message file in a folder's cur, new or tmp directory
+	CLASS_MESSAGE MaildirClass = "message"
+	// CLASS_FOLDER_METADATA is a per-folder index, uid list or keyword file
+	CLASS_FOLDER_METADATA MaildirClass = "folder-metadata"
+	// CLASS_MAILBOX_METADATA is a file describing the whole mailbox, such as subscriptions or quota
+	CLASS_MAILBOX_METADATA MaildirClass = "mailbox-metadata"
+	// CLASS_UNKNOWN is any other file
+	CLASS_UNKNOWN MaildirClass = "unknown"
+	// CLASS_DIRECTORY is a directory entry; directories are created by the restore, not extracted
+	CLASS_DIRECTORY MaildirClass = "directory"
+)
+
+var MAILDIR_CLASSES = []MaildirClass{CLASS_MESSAGE, CLASS_FOLDER_METADATA, CLASS_MAILBOX_METADATA, CLASS_UNKNOWN}
+
+// MaildirLayout is the folder naming scheme of a Maildir
+type MaildirLayout string
+
+const (
+	// LAYOUT_MAILDIRPP folders are dot-separated directories in the Maildir root: .A.B/cur
+	LAYOUT_MAILDIRPP MaildirLayout = "maildir++"
+	// LAYOUT_FS folders are nested directories: A/B/cur
+	LAYOUT_FS MaildirLayout = "fs"
+)
+
+// MAILBOX_FOLDER is the folder name holding mailbox-level metadata
+const MAILBOX_FOLDER = ""
+
+var MAILDIR_SUBDIRS = []string{"cur", "new", "tmp"}
+
+// folder metadata files present in each folder, including the INBOX in the Maildir root
+var FOLDER_METADATA_NAMES = []string{
+	"dovecot-uidlist",
+	"dovecot-uidlist.lock",
+	"dovecot-keywords",
+	"dovecot-acl",
+	"maildirfolder",
+	"courierimapuiddb",
+	"courierimapacl",
+}
+var FOLDER_METADATA_PREFIXES = []string{"dovecot.index"}
+var FOLDER_METADATA_DIRS = []string{"courierimapkeywords"}
+
+// mailbox metadata files present only in the Maildir root
+var MAILBOX_METADATA_NAMES = []string{
+	"subscriptions",
+	"maildirsize",
+	"courierimapsubscribed",
+	"courierimaphieracl",
+	"dovecot.mailbox.log",
+	"dovecot-acl-list",
+}
+var MAILBOX_METADATA_PREFIXES = []string{"dovecot-uidvalidity", "dovecot.list.index"}
+
+// DEFAULT_PATH_TEMPLATE locates Maildirs in the archive paths of a server storing mail in home directories
+const DEFAULT_PATH_TEMPLATE = "./{user}/Maildir/{folder}"
+
+// PathTemplate describes where the Maildir of each user is stored in the archive paths
+//
+//	./{user}/Maildir/{folder}
+//	./{domain}/{user}/Maildir/{folder}
+//	./{user}/mail/{folder}
+//
+// Each {user} and {domain} placeholder matches one path component; {folder}
+// marks the Maildir root and must be last. With a {domain} placeholder users
+// are identified as user@domain.
+type PathTemplate struct {
+	Text  string
+	parts []string
+}
+
+// ParsePathTemplate parses a path template
+func ParsePathTemplate(text string) (*PathTemplate, error) {
+	parts := strings.Split(strings.TrimPrefix(strings.TrimSpace(text), "./"), "/")
+	if len(parts) < 2 || parts[len(parts)-1] != "{folder}" {
+		return nil, fmt.Errorf("invalid path template '%s': must end with /{folder}", text)
+	}
+	parts = parts[:len(parts)-1]
+	if !slices.Contains(parts, "{user}") {
+		return nil, fmt.Errorf("invalid path template '%s': missing {user}", text)
+	}
+	seen := make(map[string]bool)
+	for _, part := range parts {
+		if strings.ContainsAny(part, "{}") {
+			if part != "{user}" && part != "{domain}" {
+				return nil, fmt.Errorf("invalid path template '%s': unknown placeholder %s", text, part)
+			}
+			if seen[part] {
+				return nil, fmt.Errorf("invalid path template '%s': duplicate %s", text, part)
+			}
+			seen[part] = true
+		} else if part == "" || part == "." || part == ".." {
+			return nil, fmt.Errorf("invalid path template '%s': empty path component", text)
+		}
+	}
+	return &PathTemplate{Text: text, parts: parts}, nil
+}
+
+// DefaultPathTemplate is the parsed DEFAULT_PATH_TEMPLATE
+var DefaultPathTemplate, _ = ParsePathTemplate(DEFAULT_PATH_TEMPLATE)
+
+// MaildirPath is the classification of an archive path
+type MaildirPath struct {
+	// User is the user identity: the user, or user@domain if the path template has a domain
+	User      string
+	LocalPart string
+	Domain    string
+	Folder    string
+	Layout    MaildirLayout
+	Class     MaildirClass
+	// FolderDir is the archive path of the folder directory
+	FolderDir string
+	// Subdir is cur, new or tmp for messages and their directories
+	Subdir string
+}
+
+// ClassifyPath returns the user, folder and class of an archive path using DefaultPathTemplate
+func ClassifyPath(pathname string) (*MaildirPath, error) {
+	return DefaultPathTemplate.Classify(pathname)
+}
+
+// HasDomain returns true if the template identifies users as user@domain
+func (t *PathTemplate) HasDomain() bool {
+	return slices.Contains(t.parts, "{domain}")
+}
+
+// Classify returns the user, folder and class of an archive path
+// The INBOX is the Maildir root; Maildir++ folders are named as archived (.A.B),
+// LAYOUT=fs folders by their path below the Maildir root (A/B).
+func (t *PathTemplate) Classify(pathname string) (*MaildirPath, error) {
+	isDir := strings.HasSuffix(pathname, "/")
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(pathname, "./"), "/"), "/")
+	if len(parts) < len(t.parts) {
+		return nil, fmt.Errorf("path does not match template %s: %s", t.Text, pathname)
+	}
+	p := MaildirPath{
+		Folder:    "INBOX",
+		Layout:    LAYOUT_MAILDIRPP,
+		Class:     CLASS_UNKNOWN,
+		FolderDir: "./" + strings.Join(parts[:len(t.parts)], "/"),
+	}
+	for i, part := range t.parts {
+		switch {
+		case parts[i] == "":
+			return nil, fmt.Errorf("path does not match template %s: %s", t.Text, pathname)
+		case part == "{user}":
+			p.LocalPart = parts[i]
+		case part == "{domain}":
+			p.Domain = parts[i]
+		case part != parts[i]:
+			return nil, fmt.Errorf("path does not match template %s: %s", t.Text, pathname)
+		}
+	}
+	p.User = p.LocalPart
+	if p.Domain != "" {
+		p.User = p.LocalPart + "@" + p.Domain
+	}
+	rest := parts[len(t.parts):]
+	if len(rest) == 0 {
+		p.Class = CLASS_DIRECTORY
+		return &p, nil
+	}
+
+	// the last component of a file path is never a folder
+	last := len(rest)
+	if !isDir {
+		last -= 1
+	}
+	folder := []string{}
+	if strings.HasPrefix(rest[0], ".") && len(rest[0]) > 1 && last > 0 {
+		folder = rest[:1]
+	} else {
+		for _, part := range rest[:last] {
+			if slices.Contains(MAILDIR_SUBDIRS, part) || slices.Contains(FOLDER_METADATA_DIRS, part) {
+				break
+			}
+			folder = append(folder, part)
+		}
+		if len(folder) > 0 {
+			p.Layout = LAYOUT_FS
+		}
+	}
+	if len(folder) > 0 {
+		p.Folder = strings.Join(folder, "/")
+		p.FolderDir += "/" + p.Folder
+		rest = rest[len(folder):]
+	}
+
+	switch {
+	case len(rest) == 0:
+		p.Class = CLASS_DIRECTORY
+	case slices.Contains(MAILDIR_SUBDIRS, rest[0]):
+		p.Subdir = rest[0]
+		if len(rest) == 1 && isDir {
+			p.Class = CLASS_DIRECTORY
+		} else if len(rest) == 2 && !isDir {
+			p.Class = CLASS_MESSAGE
+		}
+	case slices.Contains(FOLDER_METADATA_DIRS, rest[0]):
+		p.Class = CLASS_FOLDER_METADATA
+		if isDir && len(rest) == 1 {
+			p.Class = CLASS_DIRECTORY
+		}
+	case len(rest) == 1 && !isDir:
+		name := rest[0]
+		if p.Folder == "INBOX" && matchesName(name, MAILBOX_METADATA_NAMES, MAILBOX_METADATA_PREFIXES) {
+			p.Class = CLASS_MAILBOX_METADATA
+			p.Folder = MAILBOX_FOLDER
+		} else if matchesName(name, FOLDER_METADATA_NAMES, FOLDER_METADATA_PREFIXES) {
+			p.Class = CLASS_FOLDER_METADATA
+		}
+	}
+	return &p, nil
+}
+
+func matchesName(name string, names, prefixes []string) bool {
+	if slices.Contains(names, name) {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseClasses parses a comma separated list of Maildir classes
+func ParseClasses(value string) ([]MaildirClass, error) {
+	classes := []MaildirClass{}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if name == "all" {
+			classes = append(classes, MAILDIR_CLASSES...)
+			continue
+		}
+		class := MaildirClass(name)
+		if !slices.Contains(MAILDIR_CLASSES, class) {
+			return nil, fmt.Errorf("unknown class '%s': expected all or %v", name, MAILDIR_CLASSES)
+		}
+		classes = append(classes, class)
+	}
+	return classes, nil
+}
@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLayoutClassify(t *testing.T) {
+	cases := []struct {
+		path   string
+		folder string
+		class  MaildirClass
+		layout MaildirLayout
+	}{
+		{"./alice/Maildir/cur/1.M1P1.host:2,S", "INBOX", CLASS_MESSAGE, LAYOUT_MAILDIRPP},
+		{"./alice/Maildir/tmp/1.M1P1.host", "INBOX", CLASS_MESSAGE, LAYOUT_MAILDIRPP},
+		{"./alice/Maildir/cur/", "INBOX", CLASS_DIRECTORY, LAYOUT_MAILDIRPP},
+		{"./alice/Maildir/dovecot-uidlist", "INBOX", CLASS_FOLDER_METADATA, LAYOUT_MAILDIRPP},
+		{"./alice/Maildir/dovecot.index.cache", "INBOX", CLASS_FOLDER_METADATA, LAYOUT_MAILDIRPP},
+		{"./alice/Maildir/subscriptions", MAILBOX_FOLDER, CLASS_MAILBOX_METADATA, LAYOUT_MAILDIRPP},
+		{"./alice/Maildir/dovecot.list.index.log", MAILBOX_FOLDER, CLASS_MAILBOX_METADATA, LAYOUT_MAILDIRPP},
+		{"./alice/Maildir/dovecot-uidvalidity.65f1a2b3", MAILBOX_FOLDER, CLASS_MAILBOX_METADATA, LAYOUT_MAILDIRPP},
+		{"./alice/Maildir/core", "INBOX", CLASS_UNKNOWN, LAYOUT_MAILDIRPP},
+		{"./alice/Maildir/.Sent/cur/1.M1P1.host:2,S", ".Sent", CLASS_MESSAGE, LAYOUT_MAILDIRPP},
+		{"./alice/Maildir/.Sent/maildirfolder", ".Sent", CLASS_FOLDER_METADATA, LAYOUT_MAILDIRPP},
+		{"./alice/Maildir/.Sent/subscriptions", ".Sent", CLASS_UNKNOWN, LAYOUT_MAILDIRPP},
+		{"./alice/Maildir/.Archive.2024/courierimapkeywords/:list", ".Archive.2024", CLASS_FOLDER_METADATA, LAYOUT_MAILDIRPP},
+		{"./alice/Maildir/.Sent/", ".Sent", CLASS_DIRECTORY, LAYOUT_MAILDIRPP},
+		{"./alice/Maildir/Archive/2024/new/1.M1P1.host", "Archive/2024", CLASS_MESSAGE, LAYOUT_FS},
+		{"./alice/Maildir/Archive/2024/dovecot-uidlist", "Archive/2024", CLASS_FOLDER_METADATA, LAYOUT_FS},
+		{"./alice/Maildir/Archive/", "Archive", CLASS_DIRECTORY, LAYOUT_FS},
+		{"./alice/Maildir/cur/extra/1", "INBOX", CLASS_UNKNOWN, LAYOUT_MAILDIRPP},
+	}
+	for _, c := range cases {
+		p, err := ClassifyPath(c.path)
+		require.Nil(t, err, c.path)
+		require.Equal(t, "alice", p.User, c.path)
+		require.Equal(t, c.folder, p.Folder, c.path)
+		require.Equal(t, c.class, p.Class, c.path)
+		require.Equal(t, c.layout, p.Layout, c.path)
+	}
+	p, err := ClassifyPath("./alice/Maildir/Archive/2024/cur/1")
+	require.Nil(t, err)
+	require.Equal(t, "./alice/Maildir/Archive/2024", p.FolderDir)
+	require.Equal(t, "cur", p.Subdir)
+	_, err = ClassifyPath("./alice/mbox")
+	require.NotNil(t, err)
+
+	require.Equal(t, "Archive/Ärger", MaildirDisplayName("Archive/&AMQ-rger"))
+	require.Equal(t, "(mailbox)", MaildirDisplayName(MAILBOX_FOLDER))
+
+	classes, err := ParseClasses("message, folder-metadata")
+	require.Nil(t, err)
+	require.Equal(t, []MaildirClass{CLASS_MESSAGE, CLASS_FOLDER_METADATA}, classes)
+	classes, err = ParseClasses("all")
+	require.Nil(t, err)
+	require.Equal(t, MAILDIR_CLASSES, classes)
+	_, err = ParseClasses("directory")
+	require.NotNil(t, err)
+}
+
+func TestPathTemplate(t *testing.T) {
+	template, err := ParsePathTemplate("./{domain}/{user}/Maildir/{folder}")
+	require.Nil(t, err)
+	p, err := template.Classify("./example.org/alice/Maildir/.Sent/cur/1.M1P1.host:2,S")
+	require.Nil(t, err)
+	require.Equal(t, "alice@example.org", p.User)
+	require.Equal(t, "alice", p.LocalPart)
+	require.Equal(t, "example.org", p.Domain)
+	require.Equal(t, ".Sent", p.Folder)
+	require.Equal(t, CLASS_MESSAGE, p.Class)
+	require.Equal(t, "./example.org/alice/Maildir/.Sent", p.FolderDir)
+	p, err = template.Classify("./example.org/alice/Maildir/")
+	require.Nil(t, err)
+	require.Equal(t, CLASS_DIRECTORY, p.Class)
+	_, err = template.Classify("./example.org/alice/mail/cur/1")
+	require.NotNil(t, err)
+	_, err = template.Classify("./example.org/")
+	require.NotNil(t, err)
+
+	template, err = ParsePathTemplate("{user}/{folder}")
+	require.Nil(t, err)
+	p, err = template.Classify("./bob/new/1.M1P1.host")
+	require.Nil(t, err)
+	require.Equal(t, "bob", p.User)
+	require.Equal(t, "INBOX", p.Folder)
+	require.Equal(t, CLASS_MESSAGE, p.Class)
+
+	for _, text := range []string{
+		"./{user}/Maildir",
+		"./{domain}/Maildir/{folder}",
+		"./{user}/{user}/{folder}",
+		"./{host}/{user}/{folder}",
+		"./{user}//{folder}",
+	} {
+		_, err = ParsePathTemplate(text)
+		require.NotNil(t, err, text)
+	}
+}
+
+func TestPathTemplateMetadata(t *testing.T) {
+	metadataDir := t.TempDir()
+	lists := map[string]string{
+		"2025-06-25.mailbox.example.org.file_list": "-rw------- 1 vmail vmail 300 Jun 25 10:00 ./example.org/alice/Maildir/cur/1.M1P1.host,S=300:2,S\n" +
+			"-rw------- 1 vmail vmail 300 Jun 25 10:00 ./example.org/bob/Maildir/.Sent/cur/2.M1P1.host,S=300:2,S\n" +
+			"hrw------- 1 vmail vmail 0 Jun 25 10:00 ./example.org/bob/Maildir/.Archive/cur/2.M1P1.host,S=300:2,S link to ./example.org/bob/Maildir/.Sent/cur/2.M1P1.host,S=300:2,S\n",
+	}
+	for name, content := range lists {
+		require.Nil(t, os.WriteFile(filepath.Join(metadataDir, name), []byte(content), 0600))
+	}
+	restore := OverrideOptions(map[string]any{"path_template": "./{domain}/{user}/Maildir/{folder}", "user": "^bob@"})
+	defer restore()
+	tarsnap, err := newTarsnap("2025-06-25.mailbox", metadataDir)
+	require.Nil(t, err)
+	require.Equal(t, []string{"bob@example.org"}, SortedKeys(tarsnap.Users))
+	require.Equal(t, "example.org", tarsnap.Users["bob@example.org"].Archive)
+	require.Equal(t, CLASS_MESSAGE, tarsnap.Users["bob@example.org"].Maildirs[".Sent"].Files[0].Class)
+	// hard links are listed with their link target and take its size
+	require.Equal(t, "./example.org/bob/Maildir/.Archive/cur/2.M1P1.host,S=300:2,S", tarsnap.Users["bob@example.org"].Maildirs[".Archive"].Files[0].Name)
+	require.Equal(t, int64(300), tarsnap.Users["bob@example.org"].Maildirs[".Archive"].Files[0].Size)
+	// the default template is not changed by --path-template
+	require.Equal(t, DEFAULT_PATH_TEMPLATE, DefaultPathTemplate.Text)
+
+	// file lists of filtered users are not parsed
+	require.Nil(t, os.WriteFile(filepath.Join(metadataDir, "2025-06-25.mailbox.carol.file_list"), []byte("invalid\n"), 0600))
+	OverrideOptions(map[string]any{"path_template": DEFAULT_PATH_TEMPLATE, "user": "^example.org$"})
+	_, err = newTarsnap("2025-06-25.mailbox", metadataDir)
+	require.NotNil(t, err)
+	OverrideOptions(map[string]any{"user": "^carol$"})
+	_, err = newTarsnap("2025-06-25.mailbox", metadataDir)
+	require.NotNil(t, err)
+	OverrideOptions(map[string]any{"user": "^dave$"})
+	tarsnap, err = newTarsnap("2025-06-25.mailbox", metadataDir)
+	require.Nil(t, err)
+	require.Empty(t, tarsnap.Users)
+}
@@ -32,7 +32,7 @@ package cmd
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"strings"
 
 	"github.com/spf13/cobra"
@@ -44,11 +44,19 @@ var listCmd = &cobra.Command{
 	Short: "list tarsnap archives",
 	Long: `
 Output a list of archives associated with a tarsnap key
+
+With --group, archives are grouped by host and date, showing the
+metadata archive and the users with maildir archives for each day.
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 		archives, err := ListArchives()
 		cobra.CheckErr(err)
 
+		if viper.GetBool("group") {
+			listGrouped(archives)
+			return
+		}
+
 		if viper.GetBool("json") {
 			fmt.Println(FormatJSON(&archives))
 		} else {
@@ -63,12 +71,42 @@ func init() {
 	rootCmd.AddCommand(listCmd)
 }
 
+func listGrouped(names []string) {
+	archives, unparsed := ParseArchiveList(names)
+	groups := GroupArchives(archives)
+	if viper.GetBool("json") {
+		fmt.Println(FormatJSON(map[string]any{
+			"Hosts":    groups,
+			"Unparsed": unparsed,
+		}))
+		return
+	}
+	for _, host := range SortedKeys(groups) {
+		fmt.Println(host)
+		days := groups[host]
+		for _, date := range SortedKeys(days) {
+			day := days[date]
+			metadata := "metadata"
+			if day.Metadata == "" {
+				metadata = "no-metadata"
+			}
+			fmt.Printf("  %s %s %d users: %s\n", date, metadata, len(day.Maildirs), strings.Join(day.Users(), " "))
+		}
+	}
+	if len(unparsed) > 0 {
+		fmt.Println("unrecognized")
+		for _, name := range unparsed {
+			fmt.Printf("  %s\n", name)
+		}
+	}
+}
+
 func ListArchives() ([]string, error) {
 	archives := []string{}
 	p := NewTarsnapProcess([]string{"--list-archives", "--keyfile", ExpandPath(viper.GetString("keyfile"))})
 	stdout, stderr, err := p.Run()
 	if stderr != "" {
-		log.Printf("%s\n", stderr)
+		slog.Warn("tarsnap stderr", "stderr", strings.TrimSpace(stderr))
 	}
 	if err != nil {
 		return archives, err
@@ -82,3 +120,23 @@ func ListArchives() ([]string, error) {
 
 	return archives, nil
 }
+
+// ListArchiveFiles returns the pathnames stored in a tarsnap archive
+func ListArchiveFiles(archiveName string) ([]string, error) {
+	files := []string{}
+	p := NewTarsnapProcess([]string{"-t", "--keyfile", ExpandPath(viper.GetString("keyfile")), "-f", archiveName})
+	stdout, stderr, err := p.Run()
+	if stderr != "" {
+		slog.Warn("tarsnap stderr", "tarsnap_archive", archiveName, "stderr", strings.TrimSpace(stderr))
+	}
+	if err != nil {
+		return files, fmt.Errorf("failed listing %s: %v", archiveName, err)
+	}
+	for _, line := range strings.Split(stdout, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			files = append(files, line)
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const LOCK_FILENAME = ".tarsnap-restore.lock"
+
+// OutputLock is the advisory lock file held in an output directory for the whole restore run
+type OutputLock struct {
+	PID       int
+	Host      string
+	StartTime time.Time
+	Archive   string
+	pathname  string
+}
+
+func (l *OutputLock) String() string {
+	return fmt.Sprintf("pid %d on %s since %s restoring %s", l.PID, l.Host, l.StartTime.Format(time.RFC3339), l.Archive)
+}
+
+// Stale returns true if the lock was written on this host by a process that no longer exists
+func (l *OutputLock) Stale(host string) bool {
+	if l.Host != host {
+		return false
+	}
+	return processExited(l.PID)
+}
+
+// ReadLock returns the lock held on outputDir, or nil if the directory is not locked
+func ReadLock(outputDir string) (*OutputLock, error) {
+	pathname := filepath.Join(outputDir, LOCK_FILENAME)
+	data, err := os.ReadFile(pathname)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed reading lock file: %v", err)
+	}
+	var lock OutputLock
+	err = json.Unmarshal(data, &lock)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing lock file %s: %v", pathname, err)
+	}
+	lock.pathname = pathname
+	return &lock, nil
+}
+
+// LockOutputDir creates the lock file in outputDir, removing a stale lock left by a dead process on this host
+// If force is set, any existing lock is removed.
+func LockOutputDir(outputDir, archive string, force bool) (*OutputLock, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed reading hostname: %v", err)
+	}
+	err = os.MkdirAll(outputDir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating output directory: %v", err)
+	}
+	lock := OutputLock{
+		PID:       os.Getpid(),
+		Host:      host,
+		StartTime: time.Now(),
+		Archive:   archive,
+		pathname:  filepath.Join(outputDir, LOCK_FILENAME),
+	}
+	data, err := json.MarshalIndent(&lock, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	for retry := true; ; retry = false {
+		file, err := os.OpenFile(lock.pathname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			_, err = file.Write(append(data, '\n'))
+			cerr := file.Close()
+			if err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(lock.pathname)
+				return nil, fmt.Errorf("failed writing lock file: %v", err)
+			}
+			return &lock, nil
+		}
+		if !os.IsExist(err) || !retry {
+			return nil, fmt.Errorf("failed creating lock file: %v", err)
+		}
+		held, err := ReadLock(outputDir)
+		switch {
+		case force:
+			slog.Warn("forcing removal of lock", "file", lock.pathname)
+		case err != nil:
+			return nil, fmt.Errorf("%v; use --force-unlock to remove it", err)
+		case held == nil:
+			// released while we were looking
+		case held.Stale(host):
+			slog.Warn("removing stale lock", "file", lock.pathname, "lock", held.String())
+		default:
+			return nil, fmt.Errorf("output directory %s is locked by %s; use --force-unlock if that restore is no longer running", outputDir, held)
+		}
+		err = os.Remove(lock.pathname)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed removing lock file: %v", err)
+		}
+	}
+}
+
+// Unlock removes the lock file if it is still the one written by this lock
+func (l *OutputLock) Unlock() error {
+	held, err := ReadLock(filepath.Dir(l.pathname))
+	if err != nil {
+		return err
+	}
+	if held == nil || held.PID != l.PID || held.Host != l.Host || !held.StartTime.Equal(l.StartTime) {
+		slog.Warn("lock file replaced; not removing", "file", l.pathname)
+		return nil
+	}
+	err = os.Remove(l.pathname)
+	if err != nil {
+		return fmt.Errorf("failed removing lock file: %v", err)
+	}
+	return nil
+}
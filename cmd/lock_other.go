@@ -0,0 +1,16 @@
+//go:build !unix
+
+package cmd
+
+import "os"
+
+// processExited returns true if no process with pid exists
+// Where FindProcess cannot tell, the process is assumed to be running.
+func processExited(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return true
+	}
+	process.Release()
+	return false
+}
@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestLockOutputDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "restore")
+	lock, err := LockOutputDir(dir, "2025-03-01.mail1", false)
+	require.Nil(t, err)
+	held, err := ReadLock(dir)
+	require.Nil(t, err)
+	require.Equal(t, os.Getpid(), held.PID)
+	require.Equal(t, "2025-03-01.mail1", held.Archive)
+
+	_, err = LockOutputDir(dir, "2025-03-02.mail1", false)
+	require.NotNil(t, err)
+
+	forced, err := LockOutputDir(dir, "2025-03-02.mail1", true)
+	require.Nil(t, err)
+	// the replaced lock is left in place
+	require.Nil(t, lock.Unlock())
+	held, err = ReadLock(dir)
+	require.Nil(t, err)
+	require.Equal(t, "2025-03-02.mail1", held.Archive)
+	require.Nil(t, forced.Unlock())
+	held, err = ReadLock(dir)
+	require.Nil(t, err)
+	require.Nil(t, held)
+}
+
+func TestLockStale(t *testing.T) {
+	dir := t.TempDir()
+	proc := exec.Command("true")
+	require.Nil(t, proc.Run())
+	lock, err := LockOutputDir(dir, "2025-03-01.mail1", false)
+	require.Nil(t, err)
+
+	// rewrite the lock as held by the exited process
+	stale := *lock
+	stale.PID = proc.Process.Pid
+	require.True(t, stale.Stale(lock.Host))
+	require.False(t, stale.Stale("otherhost"))
+	data, err := json.Marshal(&stale)
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(filepath.Join(dir, LOCK_FILENAME), data, 0600))
+
+	lock, err = LockOutputDir(dir, "2025-03-02.mail1", false)
+	require.Nil(t, err)
+	require.Equal(t, os.Getpid(), lock.PID)
+	require.Nil(t, lock.Unlock())
+
+	stale.Host = "otherhost"
+	data, err = json.Marshal(&stale)
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(filepath.Join(dir, LOCK_FILENAME), data, 0600))
+	_, err = LockOutputDir(dir, "2025-03-02.mail1", false)
+	require.NotNil(t, err)
+}
@@ -0,0 +1,14 @@
+//go:build unix
+
+package cmd
+
+import (
+	"errors"
+	"syscall"
+)
+
+// processExited returns true if no process with pid exists
+func processExited(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return errors.Is(err, syscall.ESRCH)
+}
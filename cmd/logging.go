@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// RunID identifies all log records written by one invocation
+var RunID = NewRunID()
+
+func NewRunID() string {
+	buf := make([]byte, 6)
+	_, err := rand.Read(buf)
+	if err != nil {
+		log.Fatalf("failed generating run id: %v", err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+func ParseLogLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "":
+		if viper.GetBool("debug") {
+			return slog.LevelDebug, nil
+		}
+		return slog.LevelInfo, nil
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("unknown log level: %s", name)
+}
+
+// InitSlog installs the default structured logger writing to w
+// The default text format passes records through the standard log package
+func InitSlog(w io.Writer) error {
+	level, err := ParseLogLevel(viper.GetString("log_level"))
+	if err != nil {
+		return err
+	}
+	options := slog.HandlerOptions{
+		Level:     level,
+		AddSource: viper.GetBool("debug"),
+	}
+	var handler slog.Handler
+	switch viper.GetString("log_format") {
+	case "", "text":
+		slog.SetLogLoggerLevel(level)
+		handler = slog.Default().Handler()
+	case "json":
+		handler = slog.NewJSONHandler(w, &options)
+	case "logfmt":
+		handler = slog.NewTextHandler(w, &options)
+	default:
+		return fmt.Errorf("unknown log format: %s", viper.GetString("log_format"))
+	}
+	slog.SetDefault(slog.New(handler).With("run_id", RunID))
+	return nil
+}
+
+// lineWriter calls emit for each complete line written to it
+type lineWriter struct {
+	mutex sync.Mutex
+	buf   []byte
+	emit  func(string)
+}
+
+func newLineWriter(emit func(string)) *lineWriter {
+	return &lineWriter{emit: emit}
+}
+
+func (w *lineWriter) Write(data []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.buf = append(w.buf, data...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimRight(string(w.buf[:i]), "\r")
+		w.buf = w.buf[i+1:]
+		if line != "" {
+			w.emit(line)
+		}
+	}
+	return len(data), nil
+}
+
+// Flush emits any buffered partial line
+func (w *lineWriter) Flush() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if len(w.buf) > 0 {
+		w.emit(string(w.buf))
+		w.buf = nil
+	}
+}
@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	for name, expected := range map[string]slog.Level{
+		"debug":   slog.LevelDebug,
+		"INFO":    slog.LevelInfo,
+		"warn":    slog.LevelWarn,
+		"Warning": slog.LevelWarn,
+		"error":   slog.LevelError,
+	} {
+		level, err := ParseLogLevel(name)
+		require.Nil(t, err, name)
+		require.Equal(t, expected, level, name)
+	}
+	_, err := ParseLogLevel("verbose")
+	require.NotNil(t, err)
+
+	restore := OverrideOptions(map[string]any{"debug": true})
+	level, err := ParseLogLevel("")
+	restore()
+	require.Nil(t, err)
+	require.Equal(t, slog.LevelDebug, level)
+	restore = OverrideOptions(map[string]any{"debug": false})
+	level, err = ParseLogLevel("")
+	restore()
+	require.Nil(t, err)
+	require.Equal(t, slog.LevelInfo, level)
+}
+
+func initTestSlog(t *testing.T, options map[string]any) *bytes.Buffer {
+	previous := slog.Default()
+	restore := OverrideOptions(options)
+	t.Cleanup(func() {
+		restore()
+		slog.SetDefault(previous)
+	})
+	var buf bytes.Buffer
+	require.Nil(t, InitSlog(&buf))
+	return &buf
+}
+
+func TestInitSlogJSON(t *testing.T) {
+	buf := initTestSlog(t, map[string]any{"log_format": "json", "log_level": "info", "debug": false})
+	slog.Debug("hidden")
+	slog.Default().With("archive", "2025-03-01.mail1").Info("restore started", "batch", 3)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 1)
+	record := map[string]any{}
+	require.Nil(t, json.Unmarshal([]byte(lines[0]), &record))
+	require.Equal(t, "INFO", record["level"])
+	require.Equal(t, "restore started", record["msg"])
+	require.Equal(t, RunID, record["run_id"])
+	require.Equal(t, "2025-03-01.mail1", record["archive"])
+	require.Equal(t, float64(3), record["batch"])
+}
+
+func TestInitSlogLogfmt(t *testing.T) {
+	buf := initTestSlog(t, map[string]any{"log_format": "logfmt", "log_level": "warn", "debug": false})
+	slog.Info("hidden")
+	slog.Warn("disk low", "free", "1G")
+	line := strings.TrimSpace(buf.String())
+	require.Contains(t, line, "level=WARN")
+	require.Contains(t, line, `msg="disk low"`)
+	require.Contains(t, line, "run_id="+RunID)
+	require.Contains(t, line, "free=1G")
+	require.NotContains(t, line, "hidden")
+
+	restore := OverrideOptions(map[string]any{"log_format": "xml"})
+	defer restore()
+	require.NotNil(t, InitSlog(&bytes.Buffer{}))
+}
+
+func TestLineWriter(t *testing.T) {
+	lines := []string{}
+	w := newLineWriter(func(line string) {
+		lines = append(lines, line)
+	})
+	for _, chunk := range []string{"x ./alice/Mail", "dir/cur/1\r\nx ./bob", "\n\n", "tarsnap: error"} {
+		n, err := w.Write([]byte(chunk))
+		require.Nil(t, err)
+		require.Equal(t, len(chunk), n)
+	}
+	require.Equal(t, []string{"x ./alice/Maildir/cur/1", "x ./bob"}, lines)
+	w.Flush()
+	require.Equal(t, []string{"x ./alice/Maildir/cur/1", "x ./bob", "tarsnap: error"}, lines)
+	w.Flush()
+	require.Len(t, lines, 3)
+}
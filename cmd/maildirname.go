@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var MAILDIR_DELIVERY_USEC_PATTERN = regexp.MustCompile(`M(\d{1,6})`)
+
+// MaildirName is a parsed Maildir message filename
+//
+//	TIME.DELIVERY.HOST[,S=SIZE][,W=SIZE]:2,FLAGS
+//
+// DELIVERY identifies the delivery on HOST, for example M123456P4321Q7
+// (microseconds, pid and sequence). Size is the file size recorded by the
+// delivery agent (S=) and VirtualSize the RFC822 size with CRLF line endings (W=).
+type MaildirName struct {
+	Unique      string
+	Time        time.Time
+	Delivery    string
+	Host        string
+	Size        int64  `json:",omitempty"`
+	VirtualSize int64  `json:",omitempty"`
+	Flags       string `json:",omitempty"`
+}
+
+// ParseMaildirName parses the unique name, size attributes and flags of a Maildir message filename
+func ParseMaildirName(filename string) (*MaildirName, error) {
+	filename = path.Base(filename)
+	base, info, _ := strings.Cut(filename, ":")
+	attributes := strings.Split(base, ",")
+	m := MaildirName{Unique: attributes[0]}
+	fields := strings.SplitN(m.Unique, ".", 3)
+	if len(fields) != 3 || fields[1] == "" || fields[2] == "" {
+		return nil, fmt.Errorf("invalid Maildir unique name: %s", filename)
+	}
+	seconds, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Maildir delivery time: %s", filename)
+	}
+	m.Delivery = fields[1]
+	m.Host = fields[2]
+	var usec int64
+	match := MAILDIR_DELIVERY_USEC_PATTERN.FindStringSubmatch(m.Delivery)
+	if len(match) == 2 {
+		usec, _ = strconv.ParseInt(match[1], 10, 64)
+	}
+	m.Time = time.Unix(seconds, usec*1000).UTC()
+	for _, attribute := range attributes[1:] {
+		key, value, found := strings.Cut(attribute, "=")
+		if !found {
+			continue
+		}
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Maildir size attribute %s: %s", attribute, filename)
+		}
+		switch key {
+		case "S":
+			m.Size = size
+		case "W":
+			m.VirtualSize = size
+		}
+	}
+	if strings.HasPrefix(info, "2,") {
+		m.Flags = info[2:]
+	}
+	return &m, nil
+}
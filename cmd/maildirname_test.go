@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMaildirNameParse(t *testing.T) {
+	m, err := ParseMaildirName("./alice/Maildir/cur/1700000000.M123456P4321Q7.mail.example.com,S=2048,W=2100:2,FRS")
+	require.Nil(t, err)
+	require.Equal(t, "1700000000.M123456P4321Q7.mail.example.com", m.Unique)
+	require.Equal(t, time.Unix(1700000000, 123456000).UTC(), m.Time)
+	require.Equal(t, "M123456P4321Q7", m.Delivery)
+	require.Equal(t, "mail.example.com", m.Host)
+	require.Equal(t, int64(2048), m.Size)
+	require.Equal(t, int64(2100), m.VirtualSize)
+	require.Equal(t, "FRS", m.Flags)
+
+	m, err = ParseMaildirName("1700000000.P4321.host")
+	require.Nil(t, err)
+	require.Equal(t, int64(0), m.Size)
+	require.Equal(t, "", m.Flags)
+
+	for _, invalid := range []string{"dovecot-uidlist", "abc.P1.host", "1700000000.P1", "1700000000.P1.host,S=big"} {
+		_, err := ParseMaildirName(invalid)
+		require.NotNil(t, err, invalid)
+	}
+
+	maildir := Maildir{}
+	maildir.AddFile("./alice/Maildir/cur/1700000000.P1.host,S=5:2,S", 5)
+	maildir.AddFile("./alice/Maildir/dovecot-uidlist", 10)
+	require.Equal(t, "S", maildir.Files[0].Message.Flags)
+	require.Nil(t, maildir.Files[1].Message)
+}
+
+func TestMaildirNameVerify(t *testing.T) {
+	dir := t.TempDir()
+	s := ProcessSet{outputDir: dir, policy: OVERWRITE, existing: make(map[string]*existingFile), logger: slog.Default()}
+	maildir := Maildir{}
+	maildir.AddFile("./alice/Maildir/cur/1700000000.P1.host,S=5:2,S", 5)
+	maildir.AddFile("./alice/Maildir/cur/1700000001.P1.host,S=9:2,S", 5)
+	s.files = maildir.Files
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "alice/Maildir/cur"), 0700))
+	require.Nil(t, os.WriteFile(filepath.Join(dir, maildir.Files[0].Name), []byte("hello"), 0600))
+	require.NotNil(t, s.Verify())
+	require.Nil(t, os.WriteFile(filepath.Join(dir, maildir.Files[1].Name), []byte("hello"), 0600))
+	// the file matches the metadata size but not its ,S= size
+	require.NotNil(t, s.Verify())
+	s.files = s.files[:1]
+	require.Nil(t, s.Verify())
+}
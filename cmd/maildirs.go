@@ -42,22 +42,24 @@ var maildirsCmd = &cobra.Command{
 	Short: "List all maildirs in archive",
 	Long: `
 Write list of maildirs to stdout
+
+Folder names are decoded from IMAP modified UTF-7 with the Maildir++
+hierarchy separator shown as /. The JSON output includes both the
+archived Name and the decoded DisplayName.
 `,
 	Args: cobra.RangeArgs(0, 1),
 	Run: func(cmd *cobra.Command, args []string) {
-		archiveName := viper.GetString("archive")
-		if len(args) > 0 {
-			archiveName = args[0]
-		}
+		archiveName, err := ArchiveBaseName(args)
+		cobra.CheckErr(err)
 		tarsnap, err := NewTarsnap(archiveName)
 		cobra.CheckErr(err)
 		if viper.GetBool("json") {
 			fmt.Println(FormatJSON(&tarsnap.Users))
 		} else {
 			for username, user := range tarsnap.Users {
-				for maildirname, maildir := range user.Maildirs {
+				for _, maildir := range user.Maildirs {
 					for _, file := range maildir.Files {
-						fmt.Printf("%s %s %s\n", username, maildirname, file.Name)
+						fmt.Printf("%s %s %s\n", username, maildir.DisplayName, file.Name)
 					}
 				}
 			}
@@ -0,0 +1,298 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const METRICS_PREFIX = "tarsnap_restore_"
+
+type BatchMetrics struct {
+	Index    int
+	User     string
+	Maildir  string
+	Files    int
+	Size     int64
+	Duration time.Duration
+	ExitCode int
+	Failed   bool
+}
+
+type Metrics struct {
+	mutex            sync.Mutex
+	Archive          string
+	FilesPlanned     int64
+	BytesPlanned     int64
+	FilesRestored    int64
+	BytesRestored    int64
+	BatchesPlanned   int
+	BatchesRunning   int
+	BatchesCompleted int
+	BatchesFailed    int
+	BatchesRetried   int
+	ExitCodes        map[int]int
+	Batches          map[int]*BatchMetrics
+	StartTime        time.Time
+	EndTime          time.Time
+	listen           string
+	textfile         string
+	server           *http.Server
+}
+
+func NewMetrics(archive string) *Metrics {
+	return &Metrics{
+		Archive:   archive,
+		ExitCodes: make(map[int]int),
+		Batches:   make(map[int]*BatchMetrics),
+		listen:    viper.GetString("metrics_listen"),
+		textfile:  ExpandPath(viper.GetString("metrics_textfile")),
+	}
+}
+
+func (m *Metrics) Plan(p *Process) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.BatchesPlanned += 1
+	m.FilesPlanned += int64(len(p.Files))
+	m.BytesPlanned += p.Size
+	m.Batches[p.Index] = &BatchMetrics{
+		Index:    p.Index,
+		User:     p.User,
+		Maildir:  p.Maildir,
+		Files:    len(p.Files),
+		Size:     p.Size,
+		ExitCode: -1,
+	}
+}
+
+// PlanStream records the files of a stream restore, which runs no batches
+func (m *Metrics) PlanStream(files []MaildirFile) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, file := range files {
+		m.FilesPlanned += 1
+		m.BytesPlanned += file.Size
+	}
+}
+
+func (m *Metrics) BatchStarted(p *Process) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.BatchesRunning += 1
+}
+
+func (m *Metrics) BatchFinished(p *Process) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if p.Started {
+		m.BatchesRunning -= 1
+	}
+	m.ExitCodes[p.ExitCode] += 1
+	if p.err != nil {
+		m.BatchesFailed += 1
+	} else {
+		m.BatchesCompleted += 1
+	}
+	batch, ok := m.Batches[p.Index]
+	if ok {
+		batch.ExitCode = p.ExitCode
+		batch.Failed = p.err != nil
+		if p.Started {
+			batch.Duration = p.EndTime.Sub(p.StartTime)
+		}
+	}
+}
+
+// BatchRetried records a batch queued to retry the remaining files of a killed batch
+func (m *Metrics) BatchRetried(p *Process) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.BatchesRetried += 1
+	m.Batches[p.Index] = &BatchMetrics{
+		Index:    p.Index,
+		User:     p.User,
+		Maildir:  p.Maildir,
+		Files:    len(p.Files),
+		Size:     p.Size,
+		ExitCode: -1,
+	}
+}
+
+func (m *Metrics) SetRestored(files, bytes int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.FilesRestored = files
+	m.BytesRestored = bytes
+}
+
+// Start records the run start time and starts the /metrics endpoint if configured
+func (m *Metrics) Start() {
+	m.mutex.Lock()
+	m.StartTime = time.Now()
+	m.mutex.Unlock()
+	if m.listen == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		fmt.Fprint(w, m.Format())
+	})
+	m.server = &http.Server{Addr: m.listen, Handler: mux}
+	go func() {
+		slog.Info("metrics: listening", "address", m.listen)
+		err := m.server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			slog.Error("metrics: listener failed", "error", err)
+		}
+	}()
+}
+
+// Finish records the run end time, writes the textfile if configured and stops the endpoint
+func (m *Metrics) Finish() error {
+	m.mutex.Lock()
+	m.EndTime = time.Now()
+	m.mutex.Unlock()
+	if m.server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err := m.server.Shutdown(ctx)
+		if err != nil {
+			slog.Error("metrics: shutdown failed", "error", err)
+		}
+		m.server = nil
+	}
+	if m.textfile != "" {
+		return m.WriteTextfile(m.textfile)
+	}
+	return nil
+}
+
+// WriteTextfile atomically replaces pathname with the current metrics for the node_exporter textfile collector
+func (m *Metrics) WriteTextfile(pathname string) error {
+	dir, filename := filepath.Split(pathname)
+	if dir == "" {
+		dir = "."
+	}
+	file, err := os.CreateTemp(dir, "."+filename+".*")
+	if err != nil {
+		return fmt.Errorf("failed creating metrics textfile: %v", err)
+	}
+	_, err = file.WriteString(m.Format())
+	if err == nil {
+		err = file.Chmod(0644)
+	}
+	cerr := file.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), pathname)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("failed writing metrics textfile: %v", err)
+	}
+	return nil
+}
+
+type metricsWriter struct {
+	b strings.Builder
+}
+
+func (w *metricsWriter) header(name, kind, help string) {
+	fmt.Fprintf(&w.b, "# HELP %s%s %s\n", METRICS_PREFIX, name, help)
+	fmt.Fprintf(&w.b, "# TYPE %s%s %s\n", METRICS_PREFIX, name, kind)
+}
+
+func (w *metricsWriter) sample(name string, value any, labels ...string) {
+	pairs := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], escapeLabel(labels[i+1])))
+	}
+	fmt.Fprintf(&w.b, "%s%s{%s} %v\n", METRICS_PREFIX, name, strings.Join(pairs, ","), value)
+}
+
+func escapeLabel(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	return strings.ReplaceAll(value, "\n", `\n`)
+}
+
+func unixSeconds(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) / 1e9
+}
+
+// Format returns the metrics in the Prometheus text exposition format
+func (m *Metrics) Format() string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	a := m.Archive
+	w := metricsWriter{}
+
+	w.header("files_planned", "gauge", "Number of files selected for restore.")
+	w.sample("files_planned", m.FilesPlanned, "archive", a)
+	w.header("bytes_planned", "gauge", "Number of bytes selected for restore.")
+	w.sample("bytes_planned", m.BytesPlanned, "archive", a)
+	w.header("files_restored", "gauge", "Number of selected files present in the output directory.")
+	w.sample("files_restored", m.FilesRestored, "archive", a)
+	w.header("bytes_restored", "gauge", "Number of bytes of selected files present in the output directory.")
+	w.sample("bytes_restored", m.BytesRestored, "archive", a)
+
+	w.header("batches", "gauge", "Number of restore batches by state.")
+	w.sample("batches", m.BatchesPlanned, "archive", a, "state", "planned")
+	w.sample("batches", m.BatchesRunning, "archive", a, "state", "running")
+	w.sample("batches", m.BatchesCompleted, "archive", a, "state", "completed")
+	w.sample("batches", m.BatchesFailed, "archive", a, "state", "failed")
+	w.header("batches_retried_total", "counter", "Number of restore batches queued for retry.")
+	w.sample("batches_retried_total", m.BatchesRetried, "archive", a)
+
+	w.header("tarsnap_exit_codes_total", "counter", "Number of tarsnap processes by exit code.")
+	codes := []int{}
+	for code := range m.ExitCodes {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		w.sample("tarsnap_exit_codes_total", m.ExitCodes[code], "archive", a, "code", fmt.Sprintf("%d", code))
+	}
+
+	w.header("batch_duration_seconds", "gauge", "Run time of each finished restore batch.")
+	indexes := []int{}
+	for index, batch := range m.Batches {
+		if batch.ExitCode != -1 || batch.Failed {
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Ints(indexes)
+	for _, index := range indexes {
+		batch := m.Batches[index]
+		w.sample("batch_duration_seconds", batch.Duration.Seconds(),
+			"archive", a,
+			"batch", fmt.Sprintf("%d", batch.Index),
+			"user", batch.User,
+			"maildir", batch.Maildir,
+		)
+	}
+
+	w.header("start_timestamp_seconds", "gauge", "Unix time the restore run started.")
+	w.sample("start_timestamp_seconds", unixSeconds(m.StartTime), "archive", a)
+	w.header("end_timestamp_seconds", "gauge", "Unix time the restore run finished, 0 while running.")
+	w.sample("end_timestamp_seconds", unixSeconds(m.EndTime), "archive", a)
+
+	return w.b.String()
+}
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsTextfile(t *testing.T) {
+	m := NewMetrics("2025-03-01.mail1")
+	m.Start()
+	batches := []*Process{
+		{Index: 0, User: "alice", Maildir: "INBOX", Files: make([]MaildirFile, 3), Size: 300},
+		{Index: 1, User: "bob", Maildir: `.Say "hi"`, Files: make([]MaildirFile, 2), Size: 200},
+		{Index: 2, User: "carol", Maildir: "INBOX", Files: make([]MaildirFile, 1), Size: 100},
+	}
+	for _, p := range batches {
+		m.Plan(p)
+	}
+	start := time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)
+	for _, p := range batches[:2] {
+		p.Started = true
+		p.StartTime = start
+		m.BatchStarted(p)
+	}
+	batches[0].EndTime = start.Add(1500 * time.Millisecond)
+	m.BatchFinished(batches[0])
+	batches[1].EndTime = start.Add(2 * time.Second)
+	batches[1].ExitCode = 1
+	batches[1].err = errors.New("tarsnap failed")
+	m.BatchFinished(batches[1])
+	m.SetRestored(3, 300)
+
+	textfile := filepath.Join(t.TempDir(), "tarsnap_restore.prom")
+	m.textfile = textfile
+	require.Nil(t, m.Finish())
+	data, err := os.ReadFile(textfile)
+	require.Nil(t, err)
+	text := string(data)
+	archive := `archive="2025-03-01.mail1"`
+	for _, line := range []string{
+		"# TYPE tarsnap_restore_files_planned gauge",
+		"tarsnap_restore_files_planned{" + archive + "} 6",
+		"tarsnap_restore_bytes_planned{" + archive + "} 600",
+		"tarsnap_restore_files_restored{" + archive + "} 3",
+		"tarsnap_restore_bytes_restored{" + archive + "} 300",
+		"tarsnap_restore_batches{" + archive + `,state="planned"} 3`,
+		"tarsnap_restore_batches{" + archive + `,state="running"} 0`,
+		"tarsnap_restore_batches{" + archive + `,state="completed"} 1`,
+		"tarsnap_restore_batches{" + archive + `,state="failed"} 1`,
+		"tarsnap_restore_tarsnap_exit_codes_total{" + archive + `,code="0"} 1`,
+		"tarsnap_restore_tarsnap_exit_codes_total{" + archive + `,code="1"} 1`,
+		"tarsnap_restore_batch_duration_seconds{" + archive + `,batch="0",user="alice",maildir="INBOX"} 1.5`,
+		"tarsnap_restore_batch_duration_seconds{" + archive + `,batch="1",user="bob",maildir=".Say \"hi\""} 2`,
+	} {
+		require.Contains(t, text, line+"\n")
+	}
+	require.NotContains(t, text, `batch="2"`)
+	require.NotContains(t, text, "end_timestamp_seconds{"+archive+"} 0\n")
+	require.True(t, strings.HasSuffix(text, "\n"))
+	entries, err := os.ReadDir(filepath.Dir(textfile))
+	require.Nil(t, err)
+	require.Len(t, entries, 1)
+}
@@ -0,0 +1,194 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// MIME_MAX_DEPTH limits the nesting of multipart bodies walked
+const MIME_MAX_DEPTH = 16
+
+var HTML_TAG_PATTERN = regexp.MustCompile(`(?s)<(script|style)[^>]*>.*?</(script|style)>|<[^>]*>`)
+var BLANK_LINES_PATTERN = regexp.MustCompile(`\n\s*\n\s*\n+`)
+
+// MessagePart is a leaf part of a MIME message with its transfer encoding removed
+type MessagePart struct {
+	// ID numbers the part by its position in the multipart tree: 1, 1.2, ...
+	ID          string
+	MediaType   string
+	Params      map[string]string    `json:"-"`
+	Disposition string               `json:",omitempty"`
+	Filename    string               `json:",omitempty"`
+	Header      textproto.MIMEHeader `json:"-"`
+	Body        []byte               `json:"-"`
+}
+
+// MIMEMessage is a parsed message: the top level header and the leaf parts in order
+type MIMEMessage struct {
+	Header mail.Header
+	Parts  []*MessagePart
+}
+
+// ParseMIMEMessage parses a message, decoding the transfer encoding of each leaf part
+// Malformed multipart bodies are kept as a single undecoded part rather than rejected.
+func ParseMIMEMessage(data []byte) (*MIMEMessage, error) {
+	message, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed reading message header: %v", err)
+	}
+	body, err := io.ReadAll(message.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading message body: %v", err)
+	}
+	m := MIMEMessage{Header: message.Header, Parts: []*MessagePart{}}
+	m.walk(textproto.MIMEHeader(message.Header), body, "1", 0)
+	return &m, nil
+}
+
+func (m *MIMEMessage) walk(header textproto.MIMEHeader, body []byte, id string, depth int) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+		params = map[string]string{}
+	}
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" && depth < MIME_MAX_DEPTH {
+		reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		parts := 0
+		for {
+			part, err := reader.NextRawPart()
+			if err != nil {
+				break
+			}
+			data, err := io.ReadAll(part)
+			if err != nil {
+				break
+			}
+			parts += 1
+			m.walk(part.Header, data, fmt.Sprintf("%s.%d", id, parts), depth+1)
+		}
+		if parts > 0 {
+			return
+		}
+	}
+	p := MessagePart{
+		ID:        strings.TrimPrefix(id, "1."),
+		MediaType: mediaType,
+		Params:    params,
+		Header:    header,
+		Body:      decodeTransferEncoding(header.Get("Content-Transfer-Encoding"), body),
+	}
+	disposition, dispositionParams, err := mime.ParseMediaType(header.Get("Content-Disposition"))
+	if err == nil {
+		p.Disposition = disposition
+		p.Filename = dispositionParams["filename"]
+	}
+	if p.Filename == "" {
+		p.Filename = params["name"]
+	}
+	p.Filename = DecodeHeader(p.Filename)
+	m.Parts = append(m.Parts, &p)
+}
+
+func decodeTransferEncoding(encoding string, body []byte) []byte {
+	var reader io.Reader
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		reader = base64.NewDecoder(base64.StdEncoding, &base64Cleaner{bytes.NewReader(body)})
+	case "quoted-printable":
+		reader = quotedprintable.NewReader(bytes.NewReader(body))
+	default:
+		return body
+	}
+	decoded, err := io.ReadAll(reader)
+	if err != nil && len(decoded) == 0 {
+		return body
+	}
+	return decoded
+}
+
+// base64Cleaner drops the line breaks and whitespace of a base64 body
+type base64Cleaner struct {
+	reader io.Reader
+}
+
+func (c *base64Cleaner) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	clean := 0
+	for _, b := range p[:n] {
+		switch b {
+		case '\r', '\n', ' ', '\t':
+		default:
+			p[clean] = b
+			clean += 1
+		}
+	}
+	return clean, err
+}
+
+// IsAttachment returns true for parts with an attachment disposition or a filename
+func (p *MessagePart) IsAttachment() bool {
+	return p.Disposition == "attachment" || p.Filename != ""
+}
+
+// Text returns the body of a text part converted from its charset to UTF-8
+func (p *MessagePart) Text() string {
+	charset := p.Params["charset"]
+	if charset == "" || strings.EqualFold(charset, "utf-8") || strings.EqualFold(charset, "us-ascii") {
+		return string(p.Body)
+	}
+	encoding, err := htmlindex.Get(charset)
+	if err != nil {
+		return string(p.Body)
+	}
+	text, err := encoding.NewDecoder().Bytes(p.Body)
+	if err != nil {
+		return string(p.Body)
+	}
+	return string(text)
+}
+
+// TextBody returns the first inline text/plain part, or the first inline text/html part with the markup removed
+func (m *MIMEMessage) TextBody() string {
+	var htmlPart *MessagePart
+	for _, p := range m.Parts {
+		if p.IsAttachment() {
+			continue
+		}
+		switch p.MediaType {
+		case "text/plain":
+			return p.Text()
+		case "text/html":
+			if htmlPart == nil {
+				htmlPart = p
+			}
+		}
+	}
+	if htmlPart != nil {
+		text := html.UnescapeString(HTML_TAG_PATTERN.ReplaceAllString(htmlPart.Text(), ""))
+		return strings.TrimSpace(BLANK_LINES_PATTERN.ReplaceAllString(text, "\n\n"))
+	}
+	return ""
+}
+
+// Attachments returns the attachment parts
+func (m *MIMEMessage) Attachments() []*MessagePart {
+	attachments := []*MessagePart{}
+	for _, p := range m.Parts {
+		if p.IsAttachment() {
+			attachments = append(attachments, p)
+		}
+	}
+	return attachments
+}
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const mimeTestMessage = `From: alice@example.org
+To: bob@example.org
+Subject: =?UTF-8?Q?Angebot_f=C3=BCr_Q3?=
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="outer"
+
+--outer
+Content-Type: multipart/alternative; boundary="inner"
+
+--inner
+Content-Type: text/plain; charset=iso-8859-1
+Content-Transfer-Encoding: quoted-printable
+
+Gr=FC=DFe aus K=F6ln
+--inner
+Content-Type: text/html; charset=utf-8
+
+<p>Gr&uuml;&szlig;e</p>
+--inner--
+
+--outer
+Content-Type: application/pdf; name="offer.pdf"
+Content-Disposition: attachment; filename="=?UTF-8?Q?Angebot_Q3.pdf?="
+Content-Transfer-Encoding: base64
+
+JVBERi0x
+LjQK
+--outer--
+`
+
+func TestParseMIMEMessage(t *testing.T) {
+	m, err := ParseMIMEMessage([]byte(strings.ReplaceAll(mimeTestMessage, "\n", "\r\n")))
+	require.Nil(t, err)
+	require.Equal(t, "Angebot für Q3", DecodeHeader(m.Header.Get("Subject")))
+	require.Len(t, m.Parts, 3)
+	require.Equal(t, "1.1", m.Parts[0].ID)
+	require.Equal(t, "1.2", m.Parts[1].ID)
+	require.Equal(t, "2", m.Parts[2].ID)
+	require.Equal(t, "Grüße aus Köln", m.TextBody())
+
+	attachments := m.Attachments()
+	require.Len(t, attachments, 1)
+	require.Equal(t, "Angebot Q3.pdf", attachments[0].Filename)
+	require.Equal(t, "application/pdf", attachments[0].MediaType)
+	require.Equal(t, "%PDF-1.4\n", string(attachments[0].Body))
+
+	html := strings.Replace(mimeTestMessage, "Content-Type: text/plain", "Content-Type: text/x-other", 1)
+	m, err = ParseMIMEMessage([]byte(html))
+	require.Nil(t, err)
+	require.Equal(t, "Grüße", m.TextBody())
+
+	m, err = ParseMIMEMessage([]byte("Subject: plain\n\nhello\n"))
+	require.Nil(t, err)
+	require.Len(t, m.Parts, 1)
+	require.Equal(t, "1", m.Parts[0].ID)
+	require.Equal(t, "hello\n", m.TextBody())
+	require.Empty(t, m.Attachments())
+}
@@ -0,0 +1,302 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// STAGING_DIRNAME is the output subdirectory receiving conflicting files under the rename-conflicts policy
+const STAGING_DIRNAME = ".tarsnap-restore.staging"
+
+// OverwritePolicy selects how files already present in the output directory are handled
+type OverwritePolicy string
+
+const (
+	OVERWRITE        OverwritePolicy = "overwrite"
+	NO_OVERWRITE     OverwritePolicy = "no-overwrite"
+	KEEP_NEWER       OverwritePolicy = "keep-newer"
+	RENAME_CONFLICTS OverwritePolicy = "rename-conflicts"
+)
+
+var OVERWRITE_POLICIES = []OverwritePolicy{OVERWRITE, NO_OVERWRITE, KEEP_NEWER, RENAME_CONFLICTS}
+
+// OverwritePolicyOption returns the policy selected by the --overwrite, --no-overwrite,
+// --keep-newer and --rename-conflicts switches, defaulting to overwrite
+func OverwritePolicyOption() (OverwritePolicy, error) {
+	selected := []OverwritePolicy{}
+	for _, policy := range OVERWRITE_POLICIES {
+		if viper.GetBool(ViperKey(string(policy))) {
+			selected = append(selected, policy)
+		}
+	}
+	switch len(selected) {
+	case 0:
+		return OVERWRITE, nil
+	case 1:
+		return selected[0], nil
+	}
+	return "", fmt.Errorf("overwrite policies are mutually exclusive: --%s and --%s", selected[0], selected[1])
+}
+
+// TarsnapArgs returns the tarsnap extract options implementing the policy
+func (o OverwritePolicy) TarsnapArgs() []string {
+	switch o {
+	case NO_OVERWRITE:
+		return []string{"-k"}
+	case KEEP_NEWER:
+		return []string{"--keep-newer-files"}
+	}
+	return []string{}
+}
+
+// existingFile records an output file present before the restore started
+// Name is the archive path of the existing file, which differs from the restored
+// name when a message was found under the same Maildir unique name.
+type existingFile struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// unchanged returns true if the file at pathname is still the pre-existing file
+func (e *existingFile) unchanged(pathname string) bool {
+	stat, err := os.Lstat(pathname)
+	return err == nil && stat.Size() == e.Size && stat.ModTime().Equal(e.ModTime)
+}
+
+// PlanFiles applies the overwrite policy to the files of one maildir, returning the files
+// restored in place and the conflicting files restored through the staging directory
+// Messages conflict with an existing message of the same Maildir unique name in the
+// cur or new directory of the folder, so that messages whose flags changed or which
+// were moved from new to cur since the backup are not restored a second time.
+// Conflicts under another name are always staged, as tarsnap only sees the restored name.
+func (s *ProcessSet) PlanFiles(files []MaildirFile) ([]MaildirFile, []MaildirFile) {
+	restore := []MaildirFile{}
+	staged := []MaildirFile{}
+	folders := make(map[string]map[string]string)
+	for _, file := range files {
+		if strings.HasSuffix(file.Name, "/") {
+			restore = append(restore, file)
+			continue
+		}
+		name := file.Name
+		stat, err := os.Lstat(filepath.Join(s.outputDir, name))
+		if err != nil && file.Message != nil && IsMessageFile(file.Name) {
+			folder := path.Dir(path.Dir(file.Name))
+			uniqueNames, ok := folders[folder]
+			if !ok {
+				uniqueNames = indexMessages(s.outputDir, folder)
+				folders[folder] = uniqueNames
+			}
+			existingName, ok := uniqueNames[file.Message.Unique]
+			if ok {
+				name = existingName
+				stat, err = os.Lstat(filepath.Join(s.outputDir, name))
+			}
+		}
+		if err != nil {
+			restore = append(restore, file)
+			continue
+		}
+		s.existing[file.Name] = &existingFile{Name: name, Size: stat.Size(), ModTime: stat.ModTime()}
+		switch {
+		case s.policy == NO_OVERWRITE:
+			s.skipped += 1
+			if s.debug {
+				s.logger.Debug("skipping existing file", "file", name)
+			}
+		case s.policy == RENAME_CONFLICTS || name != file.Name:
+			if s.debug && name != file.Name {
+				s.logger.Debug("existing message renamed", "file", file.Name, "existing", name)
+			}
+			staged = append(staged, file)
+		default:
+			restore = append(restore, file)
+		}
+	}
+	return restore, staged
+}
+
+// indexMessages returns the archive paths of the messages in the cur and new
+// directories of a folder below outputDir by Maildir unique name
+func indexMessages(outputDir, folder string) map[string]string {
+	uniqueNames := make(map[string]string)
+	for _, subdir := range []string{"cur", "new"} {
+		entries, err := os.ReadDir(filepath.Join(outputDir, folder, subdir))
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() {
+				continue
+			}
+			name, err := ParseMaildirName(entry.Name())
+			if err != nil {
+				continue
+			}
+			uniqueNames[name.Unique] = ArchivePath(path.Join(folder, subdir, entry.Name()))
+		}
+	}
+	return uniqueNames
+}
+
+// reportConflicts logs the pre-existing files found while planning the restore
+func (s *ProcessSet) reportConflicts() {
+	if len(s.existing) == 0 {
+		return
+	}
+	switch s.policy {
+	case OVERWRITE:
+		s.logger.Warn("existing files will be replaced", "files", len(s.existing), "policy", s.policy)
+	case NO_OVERWRITE:
+		s.logger.Info("skipping existing files", "files", s.skipped, "policy", s.policy)
+	default:
+		s.logger.Info("existing files found", "files", len(s.existing), "policy", s.policy)
+	}
+}
+
+// keptExisting returns true if the policy left the pre-existing output file name in place
+func (s *ProcessSet) keptExisting(name string) bool {
+	if s.policy == OVERWRITE {
+		return false
+	}
+	existing, ok := s.existing[name]
+	return ok && existing.unchanged(filepath.Join(s.outputDir, existing.Name))
+}
+
+// moveStaged moves the complete files of a staged batch into the output directory
+// Under --rename-conflicts files that conflict with a different existing message are given
+// a new Maildir unique name; otherwise an existing message of the same unique name is
+// replaced, under --keep-newer only if it is older than the restored copy.
+func (s *ProcessSet) moveStaged(p *Process) {
+	for _, file := range p.Files {
+		if strings.HasSuffix(file.Name, "/") {
+			continue
+		}
+		source := filepath.Join(p.dir, file.Name)
+		stat, err := os.Lstat(source)
+		if err != nil || !stat.Mode().IsRegular() || stat.Size() != file.Size {
+			continue
+		}
+		target := filepath.Join(s.outputDir, file.Name)
+		conflict := target
+		existing, ok := s.existing[file.Name]
+		if ok {
+			conflict = filepath.Join(s.outputDir, existing.Name)
+		}
+		replaced := ""
+		conflictStat, err := os.Lstat(conflict)
+		if err == nil {
+			switch {
+			case s.policy == RENAME_CONFLICTS && sameContent(source, conflict):
+				if s.debug {
+					p.logger.Debug("existing file is identical", "file", conflict)
+				}
+				os.Remove(source)
+				continue
+			case s.policy == RENAME_CONFLICTS && !IsMessageFile(file.Name):
+				p.logger.Warn("keeping existing file", "file", conflict)
+				os.Remove(source)
+				continue
+			case s.policy == RENAME_CONFLICTS:
+				target = UniqueMessagePath(target)
+			case s.policy == KEEP_NEWER && !conflictStat.ModTime().Before(stat.ModTime()):
+				if s.debug {
+					p.logger.Debug("keeping newer existing file", "file", conflict)
+				}
+				os.Remove(source)
+				continue
+			default:
+				replaced = conflict
+			}
+		}
+		err = os.MkdirAll(filepath.Dir(target), 0700)
+		if err == nil {
+			err = os.Rename(source, target)
+		}
+		if err != nil {
+			p.logger.Error("failed moving staged file", "file", source, "error", err)
+			continue
+		}
+		if replaced != "" && replaced != target {
+			err = os.Remove(replaced)
+			if err != nil {
+				p.logger.Error("failed removing replaced file", "file", replaced, "error", err)
+			}
+		}
+		if s.verbose {
+			p.logger.Info("restored conflicting file", "file", file.Name, "target", target)
+		}
+	}
+}
+
+// sameContent returns true if the regular files a and b have identical contents
+func sameContent(a, b string) bool {
+	statA, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	statB, err := os.Stat(b)
+	if err != nil || !statB.Mode().IsRegular() || statA.Size() != statB.Size() {
+		return false
+	}
+	dataA, err := os.ReadFile(a)
+	if err != nil {
+		return false
+	}
+	dataB, err := os.ReadFile(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(dataA, dataB)
+}
+
+// IsMessageFile returns true if pathname is a message in a Maildir cur, new or tmp directory
+func IsMessageFile(pathname string) bool {
+	switch path.Base(path.Dir(filepath.ToSlash(pathname))) {
+	case "cur", "new", "tmp":
+		return true
+	}
+	return false
+}
+
+var uniqueSequence atomic.Int64
+
+// UniqueMessagePath returns pathname renamed with a new Maildir unique name,
+// keeping the size attributes and info flags of the original name
+//
+//	TIME.MusecPpidQseq.HOST[,S=size...][:2,FLAGS]
+func UniqueMessagePath(pathname string) string {
+	dir, filename := filepath.Split(pathname)
+	base, info, hasInfo := strings.Cut(filename, ":")
+	attributes := ""
+	index := strings.Index(base, ",")
+	if index >= 0 {
+		attributes = base[index:]
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	host = strings.ReplaceAll(host, "/", `\057`)
+	host = strings.ReplaceAll(host, ":", `\072`)
+	for {
+		now := time.Now()
+		name := fmt.Sprintf("%d.M%dP%dQ%d.%s%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), uniqueSequence.Add(1), host, attributes)
+		if hasInfo {
+			name += ":" + info
+		}
+		_, err := os.Lstat(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			return filepath.Join(dir, name)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOverwritePolicy(t *testing.T) {
+	policy, err := OverwritePolicyOption()
+	require.Nil(t, err)
+	require.Equal(t, OVERWRITE, policy)
+	viper.Set("keep_newer", true)
+	defer viper.Set("keep_newer", false)
+	policy, err = OverwritePolicyOption()
+	require.Nil(t, err)
+	require.Equal(t, KEEP_NEWER, policy)
+	require.Equal(t, []string{"--keep-newer-files"}, policy.TarsnapArgs())
+	viper.Set("no_overwrite", true)
+	defer viper.Set("no_overwrite", false)
+	_, err = OverwritePolicyOption()
+	require.NotNil(t, err)
+}
+
+func TestOverwritePlanFiles(t *testing.T) {
+	dir := t.TempDir()
+	existing := "./alice/Maildir/cur/1.M1P1.host,S=5:2,S"
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "alice/Maildir/cur"), 0700))
+	require.Nil(t, os.WriteFile(filepath.Join(dir, existing), []byte("live"), 0600))
+	files := []MaildirFile{
+		{Name: "./alice/Maildir/cur/", Size: 0},
+		{Name: existing, Size: 5},
+		{Name: "./alice/Maildir/cur/2.M1P1.host,S=5:2,S", Size: 5},
+	}
+	for _, policy := range OVERWRITE_POLICIES {
+		s := ProcessSet{outputDir: dir, policy: policy, existing: make(map[string]*existingFile), logger: slog.Default()}
+		restore, staged := s.PlanFiles(files)
+		switch policy {
+		case NO_OVERWRITE:
+			require.Len(t, restore, 2)
+			require.Len(t, staged, 0)
+		case RENAME_CONFLICTS:
+			require.Len(t, restore, 2)
+			require.Equal(t, existing, staged[0].Name)
+		default:
+			require.Len(t, restore, 3)
+		}
+		require.Equal(t, policy != OVERWRITE, s.keptExisting(existing))
+	}
+}
+
+func TestOverwriteUniqueName(t *testing.T) {
+	require.True(t, IsMessageFile("./alice/Maildir/.Sent/cur/1.M1P1.host:2,S"))
+	require.False(t, IsMessageFile("./alice/Maildir/dovecot-uidlist"))
+
+	renamed := UniqueMessagePath("/restore/alice/Maildir/cur/1.M1P1.host,S=300:2,RS")
+	dir, name := filepath.Split(renamed)
+	require.Equal(t, "/restore/alice/Maildir/cur/", dir)
+	require.True(t, strings.HasSuffix(name, ",S=300:2,RS"))
+	require.NotEqual(t, renamed, UniqueMessagePath("/restore/alice/Maildir/cur/1.M1P1.host,S=300:2,RS"))
+	require.False(t, strings.Contains(UniqueMessagePath("/restore/alice/Maildir/new/1.M1P1.host"), ":"))
+}
+
+func TestOverwriteUniqueNameConflicts(t *testing.T) {
+	archived := map[string]string{
+		// the flags of the message changed since the backup
+		"./alice/Maildir/cur/1.M1P1.host,S=5:2,S": "one\r\n",
+		// the message was moved from new to cur since the backup
+		"./alice/Maildir/new/2.M1P1.host,S=5": "two\r\n",
+	}
+	live := map[string]string{
+		"./alice/Maildir/cur/1.M1P1.host,S=5:2,RS": "ONE\r\n",
+		"./alice/Maildir/cur/2.M1P1.host,S=5:2,":   "two\r\n",
+	}
+	backup := time.Date(2024, 4, 1, 10, 0, 0, 0, time.UTC)
+	for _, policy := range OVERWRITE_POLICIES {
+		dir := t.TempDir()
+		for _, subdir := range MAILDIR_SUBDIRS {
+			require.Nil(t, os.MkdirAll(filepath.Join(dir, "alice", "Maildir", subdir), 0700))
+		}
+		for name, content := range live {
+			require.Nil(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0600))
+		}
+		maildir := Maildir{}
+		for _, name := range SortedKeys(archived) {
+			maildir.AddFile(name, int64(len(archived[name])))
+		}
+		s := ProcessSet{outputDir: dir, stagingDir: filepath.Join(dir, STAGING_DIRNAME), policy: policy, existing: make(map[string]*existingFile), logger: slog.Default()}
+		restore, staged := s.PlanFiles(maildir.Files)
+		require.Empty(t, restore, policy)
+		if policy == NO_OVERWRITE {
+			require.Empty(t, staged)
+			continue
+		}
+		require.Len(t, staged, 2, policy)
+
+		// extract the staged batch
+		p := Process{Files: staged, dir: s.stagingDir, logger: slog.Default()}
+		for _, file := range staged {
+			source := filepath.Join(p.dir, file.Name)
+			require.Nil(t, os.MkdirAll(filepath.Dir(source), 0700))
+			require.Nil(t, os.WriteFile(source, []byte(archived[file.Name]), 0600))
+			require.Nil(t, os.Chtimes(source, backup, backup))
+		}
+		s.moveStaged(&p)
+
+		names := []string{}
+		for _, subdir := range []string{"cur", "new"} {
+			entries, err := os.ReadDir(filepath.Join(dir, "alice", "Maildir", subdir))
+			require.Nil(t, err)
+			for _, entry := range entries {
+				names = append(names, "./alice/Maildir/"+subdir+"/"+entry.Name())
+			}
+		}
+		switch policy {
+		case OVERWRITE:
+			require.ElementsMatch(t, SortedKeys(archived), names)
+		case KEEP_NEWER:
+			require.ElementsMatch(t, SortedKeys(live), names)
+		case RENAME_CONFLICTS:
+			// the changed message is restored under a new unique name, the identical one is dropped
+			require.Len(t, names, 3)
+			require.Subset(t, names, SortedKeys(live))
+		}
+	}
+}
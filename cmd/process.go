@@ -2,50 +2,109 @@ package cmd
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/schollz/progressbar/v3"
 	"github.com/spf13/viper"
-	"log"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const PROCESS_COUNT = 8
+const DEFAULT_GRACE_PERIOD = 10 * time.Second
+const DEFAULT_BATCH_RETRIES = 2
+const MONITOR_INTERVAL = 1 * time.Second
 
 type Process struct {
 	CommandLine string
 	Cmd         *exec.Cmd
 	obuf        bytes.Buffer
 	ebuf        bytes.Buffer
-	Files       []string
+	Files       []MaildirFile
 	Size        int64
 	Index       int
+	Archive     string
+	User        string
+	Maildir     string
+	Attempt     int
+	Rate        int64
+	args        []string
+	dir         string
+	staged      bool
 	Started     bool
 	Running     bool
+	Completed   bool
+	Interrupted bool
+	TimedOut    bool
+	Stalled     bool
+	Requeued    bool
+	ExitCode    int
+	StartTime   time.Time
+	EndTime     time.Time
 	err         error
 	verbose     bool
 	debug       bool
 	done        chan int
+	logger      *slog.Logger
+	stderr      *lineWriter
+	// extracted counts the files tarsnap -v reported extracting
+	extracted atomic.Int64
 }
 
 type ProcessSet struct {
-	procs   []*Process
-	verbose bool
-	debug   bool
+	procs           []*Process
+	files           []MaildirFile
+	metrics         *Metrics
+	logger          *slog.Logger
+	outputDir       string
+	gracePeriod     time.Duration
+	monitorInterval time.Duration
+	batchTimeout    time.Duration
+	stallTimeout    time.Duration
+	batchRetries    int
+	bandwidth       *Bandwidth
+	prefix          []string
+	spaceReserve    int64
+	skipSpaceCheck  bool
+	policy          OverwritePolicy
+	existing        map[string]*existingFile
+	skipped         int
+	stagingDir      string
+	mutex           sync.Mutex
+	queue           []*Process
+	active          int
+	wake            chan struct{}
+	verbose         bool
+	debug           bool
+}
+
+// RestoreSummary reports the outcome of a ProcessSet run
+type RestoreSummary struct {
+	Batches      int
+	Completed    []int
+	Failed       []int
+	Interrupted  []int
+	NotStarted   []int
+	Retried      []int
+	RemovedFiles []string
 }
 
 func NewProcess(name string, args []string) *Process {
 	p := Process{
-		Cmd:     exec.Command(name, args...),
-		obuf:    bytes.Buffer{},
-		ebuf:    bytes.Buffer{},
-		Files:   []string{},
-		verbose: viper.GetBool("verbose"),
-		debug:   viper.GetBool("debug"),
+		Cmd:      exec.Command(name, args...),
+		obuf:     bytes.Buffer{},
+		ebuf:     bytes.Buffer{},
+		Files:    []MaildirFile{},
+		ExitCode: -1,
+		verbose:  viper.GetBool("verbose"),
+		debug:    viper.GetBool("debug"),
+		logger:   slog.Default(),
 	}
 	p.Cmd.Stdout = &p.obuf
 	p.Cmd.Stderr = &p.ebuf
@@ -54,21 +113,104 @@ func NewProcess(name string, args []string) *Process {
 
 func (p *Process) Run() (string, string, error) {
 	p.Running = true
-	if p.debug {
-		log.Printf("Process.Run: %+v\n", p.Cmd)
-	}
+	p.logger.Debug("Process.Run", "command", p.Cmd.String())
 	err := p.Cmd.Run()
 	p.Running = false
 	return p.obuf.String(), p.ebuf.String(), err
 }
 
-func NewProcessSet() *ProcessSet {
+// captureStderr replaces the stderr buffer with per-line log records
+// tarsnap -v reports each extracted file as "x PATHNAME"; anything else is a warning
+func (p *Process) captureStderr() {
+	p.stderr = newLineWriter(func(line string) {
+		if strings.HasPrefix(line, "x ") {
+			p.extracted.Add(1)
+			p.logger.Debug("extracted", "file", strings.TrimPrefix(line, "x "))
+		} else {
+			p.logger.Warn("tarsnap stderr", "stderr", line)
+		}
+	})
+	p.Cmd.Stderr = p.stderr
+}
+
+// terminate sends SIGTERM to the process group, then SIGKILL if it has not exited within the grace period
+func (p *Process) terminate(grace time.Duration, exited chan struct{}) {
+	p.logger.Warn("terminating", "pid", p.Cmd.Process.Pid)
+	err := signalProcessGroup(p.Cmd, false)
+	if err != nil {
+		p.logger.Debug("SIGTERM failed", "error", err)
+	}
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-exited:
+	case <-timer.C:
+		p.logger.Warn("killing after grace period", "pid", p.Cmd.Process.Pid, "grace_period", grace.String())
+		err := signalProcessGroup(p.Cmd, true)
+		if err != nil {
+			p.logger.Debug("SIGKILL failed", "error", err)
+		}
+	}
+}
+
+func NewProcessSet(archiveName string) (*ProcessSet, error) {
+	grace := DEFAULT_GRACE_PERIOD
+	if viper.GetString("grace_period") != "" {
+		grace = viper.GetDuration("grace_period")
+	}
+	retries := DEFAULT_BATCH_RETRIES
+	if viper.IsSet("batch_retries") {
+		retries = viper.GetInt("batch_retries")
+	}
+	var budget int64
+	if viper.GetString("maxbw_rate") != "" {
+		var err error
+		budget, err = ParseSize(viper.GetString("maxbw_rate"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid maxbw_rate: %v", err)
+		}
+	}
+	bandwidth, err := NewBandwidth(budget)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := PriorityPrefix()
+	if err != nil {
+		return nil, err
+	}
+	reserve, err := ParseSize(viper.GetString("space_reserve"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid space_reserve: %v", err)
+	}
+	policy, err := OverwritePolicyOption()
+	if err != nil {
+		return nil, err
+	}
+	outputDir := ExpandPath(viper.GetString("output_dir"))
 	s := ProcessSet{
-		procs:   []*Process{},
-		verbose: viper.GetBool("verbose"),
-		debug:   viper.GetBool("debug"),
+		procs:           []*Process{},
+		files:           []MaildirFile{},
+		metrics:         NewMetrics(archiveName),
+		logger:          slog.Default().With("archive", archiveName),
+		outputDir:       outputDir,
+		gracePeriod:     grace,
+		monitorInterval: MONITOR_INTERVAL,
+		batchTimeout:    viper.GetDuration("batch_timeout"),
+		stallTimeout:    viper.GetDuration("stall_timeout"),
+		batchRetries:    retries,
+		bandwidth:       bandwidth,
+		prefix:          prefix,
+		spaceReserve:    reserve,
+		skipSpaceCheck:  viper.GetBool("skip_space_check"),
+		policy:          policy,
+		existing:        make(map[string]*existingFile),
+		stagingDir:      filepath.Join(outputDir, STAGING_DIRNAME),
+		queue:           []*Process{},
+		wake:            make(chan struct{}, 1),
+		verbose:         viper.GetBool("verbose"),
+		debug:           viper.GetBool("debug"),
 	}
-	return &s
+	return &s, nil
 }
 
 func NewTarsnapProcess(args []string) *Process {
@@ -77,154 +219,543 @@ func NewTarsnapProcess(args []string) *Process {
 	return NewProcess(cmdline[0], cmdline[1:])
 }
 
-func (s *ProcessSet) AddRestore(archiveName, userName, maildirName string, files []string, size int64) error {
+func (s *ProcessSet) AddRestore(archiveName, userName, maildirName string, files []MaildirFile) error {
+	return s.addRestore(s.outputDir, archiveName, userName, maildirName, files)
+}
+
+// AddStagedRestore adds a batch extracted to the staging directory and moved into place when it exits
+func (s *ProcessSet) AddStagedRestore(archiveName, userName, maildirName string, files []MaildirFile) error {
+	return s.addRestore(s.stagingDir, archiveName, userName, maildirName, files)
+}
+
+func (s *ProcessSet) addRestore(dir, archiveName, userName, maildirName string, files []MaildirFile) error {
+	p := s.newRestoreProcess(dir, archiveName, userName, maildirName, files)
 	if s.verbose {
-		log.Printf("AddRestore: %s %s %s (%d files) (%d bytes)\n", archiveName, userName, maildirName, len(files), size)
+		p.logger.Info("AddRestore", "tarsnap_archive", archiveName, "files", len(p.Files), "bytes", p.Size, "staged", p.staged)
 	}
+	s.procs = append(s.procs, p)
+	s.queue = append(s.queue, p)
+	s.files = append(s.files, files...)
+	s.metrics.Plan(p)
+	return nil
+}
+
+func (s *ProcessSet) newRestoreProcess(dir, archiveName, userName, maildirName string, files []MaildirFile) *Process {
 	args := []string{
 		"-x",
 		"--fast-read",
-		"-C", ExpandPath(viper.GetString("output_dir")),
+		"-C", dir,
+	}
+	if dir == s.outputDir {
+		args = append(args, s.policy.TarsnapArgs()...)
+	}
+	args = append(args,
 		"-v", "--keyfile", ExpandPath(viper.GetString("keyfile")),
 		"-f", archiveName,
+	)
+	var size int64
+	for _, file := range files {
+		args = append(args, file.Name)
+		size += file.Size
 	}
-	args = append(args, files...)
 	p := NewTarsnapProcess(args)
+	p.args = args
+	p.dir = dir
+	p.staged = dir != s.outputDir
 	p.Files = append(p.Files, files...)
 	p.Size = size
 	p.Index = len(s.procs)
-	s.procs = append(s.procs, p)
-	return nil
+	p.Archive = archiveName
+	p.User = userName
+	p.Maildir = maildirName
+	p.logger = s.logger.With("user", userName, "maildir", maildirName, "batch", p.Index)
+	p.captureStderr()
+	s.setCommand(p, 0)
+	return p
+}
+
+// setCommand builds the command for p with the configured priority wrappers and bandwidth rate
+func (s *ProcessSet) setCommand(p *Process, rate int64) {
+	p.Cmd = NewRestoreCommand(s.prefix, rate, p.args)
+	setProcessGroup(p.Cmd)
+	p.Cmd.WaitDelay = s.gracePeriod
+	p.Cmd.Stdout = &p.obuf
+	p.Cmd.Stderr = p.stderr
+	p.Rate = rate
+}
+
+// pending returns the number of queued and running batches
+func (s *ProcessSet) pending() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.queue) + s.active
+}
+
+// requeue adds a new batch for the files a timed out or stalled batch did not restore
+func (s *ProcessSet) requeue(p *Process, files []MaildirFile) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	retry := s.newRestoreProcess(p.dir, p.Archive, p.User, p.Maildir, files)
+	retry.Attempt = p.Attempt + 1
+	s.procs = append(s.procs, retry)
+	s.queue = append(s.queue, retry)
+	p.Requeued = true
+	s.metrics.BatchRetried(retry)
+	retry.logger.Warn("requeued", "from_batch", p.Index, "attempt", retry.Attempt, "files", len(files), "bytes", retry.Size)
+}
+
+// next returns the next queued batch, waiting while running batches may still requeue files
+// It returns nil when the queue is exhausted or ctx is cancelled.
+func (s *ProcessSet) next(ctx context.Context) *Process {
+	for {
+		s.mutex.Lock()
+		if len(s.queue) > 0 {
+			p := s.queue[0]
+			s.queue = s.queue[1:]
+			s.active += 1
+			s.mutex.Unlock()
+			return p
+		}
+		active := s.active
+		s.mutex.Unlock()
+		if active == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-s.wake:
+		}
+	}
+}
+
+// finished marks a batch returned by next as done and wakes the scheduler
+func (s *ProcessSet) finished() {
+	s.mutex.Lock()
+	s.active -= 1
+	s.mutex.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// runProcess starts p and waits for it to exit, terminating it if ctx is cancelled
+func (s *ProcessSet) runProcess(ctx context.Context, p *Process) {
+	defer s.metrics.BatchFinished(p)
+
+	rate := s.bandwidth.Allocate(p.Index, s.pending())
+	defer s.bandwidth.Release(p.Index)
+	if rate > 0 {
+		s.setCommand(p, rate)
+		p.logger.Info("bandwidth allocated", "maxbw_rate", rate)
+	}
+
+	if p.staged {
+		err := os.MkdirAll(p.dir, 0700)
+		if err != nil {
+			p.err = fmt.Errorf("failed creating staging directory: %v", err)
+			p.logger.Error("start failed", "error", p.err)
+			return
+		}
+	}
+
+	p.logger.Debug("starting", "command", p.Cmd.String())
+	p.StartTime = time.Now()
+	err := p.Cmd.Start()
+	if err != nil {
+		p.err = fmt.Errorf("Start failed: %v", err)
+		p.logger.Error("start failed", "error", err)
+		return
+	}
+	if p.staged {
+		defer s.moveStaged(p)
+	}
+	if s.verbose {
+		p.logger.Info("running", "pid", p.Cmd.Process.Pid)
+	}
+	p.Started = true
+	p.Running = true
+	s.metrics.BatchStarted(p)
+
+	exited := make(chan struct{})
+	var watchGroup sync.WaitGroup
+	watchGroup.Add(1)
+	go func() {
+		defer watchGroup.Done()
+		s.watchProcess(ctx, p, exited)
+	}()
+
+	err = p.Cmd.Wait()
+	close(exited)
+	watchGroup.Wait()
+	p.stderr.Flush()
+	p.Running = false
+	p.EndTime = time.Now()
+	p.ExitCode = p.Cmd.ProcessState.ExitCode()
+	if p.Interrupted {
+		p.err = fmt.Errorf("interrupted: %v", ctx.Err())
+		p.logger.Warn("batch interrupted", "exit_code", p.ExitCode)
+		return
+	}
+	if p.TimedOut || p.Stalled {
+		if p.TimedOut {
+			p.err = fmt.Errorf("batch timeout after %v", s.batchTimeout)
+		} else {
+			p.err = fmt.Errorf("batch stalled for %v", s.stallTimeout)
+		}
+		p.logger.Warn("batch killed", "error", p.err, "exit_code", p.ExitCode)
+		s.removePartialFiles(p)
+		remaining := s.remainingFiles(p)
+		if len(remaining) == 0 {
+			p.err = nil
+			p.Completed = true
+			return
+		}
+		if p.Attempt < s.batchRetries {
+			s.requeue(p, remaining)
+		} else {
+			p.logger.Error("batch retries exhausted", "attempts", p.Attempt+1, "remaining_files", len(remaining))
+		}
+		return
+	}
+	if err != nil {
+		p.err = fmt.Errorf("Wait failed: %v", err)
+		p.logger.Error("batch failed", "error", err, "exit_code", p.ExitCode)
+		return
+	}
+	p.err = nil
+	p.Completed = true
+	if s.verbose {
+		p.logger.Info("exited", "pid", p.Cmd.Process.Pid, "exit_code", p.ExitCode, "duration", p.EndTime.Sub(p.StartTime).String())
+	}
+}
+
+// watchProcess terminates p when ctx is cancelled, the batch timeout expires,
+// or no files or bytes have been written and no file extraction reported for the stall timeout
+// tarsnap reads an archive sequentially, so a batch of files near the end of a large
+// archive shows no progress while the preceding data is read; the stall timeout is off by default.
+func (s *ProcessSet) watchProcess(ctx context.Context, p *Process, exited chan struct{}) {
+	ticker := time.NewTicker(s.monitorInterval)
+	defer ticker.Stop()
+	lastCount, lastSize := s.batchProgress(p)
+	lastExtracted := p.extracted.Load()
+	lastProgress := time.Now()
+	for {
+		select {
+		case <-exited:
+			return
+		case <-ctx.Done():
+			p.Interrupted = true
+			p.terminate(s.gracePeriod, exited)
+			return
+		case now := <-ticker.C:
+			if s.batchTimeout > 0 && now.Sub(p.StartTime) > s.batchTimeout {
+				p.TimedOut = true
+				p.logger.Warn("batch timeout", "timeout", s.batchTimeout.String())
+				p.terminate(s.gracePeriod, exited)
+				return
+			}
+			if s.stallTimeout > 0 {
+				count, size := s.batchProgress(p)
+				extracted := p.extracted.Load()
+				if count != lastCount || size != lastSize || extracted != lastExtracted {
+					lastCount, lastSize, lastExtracted = count, size, extracted
+					lastProgress = now
+				} else if now.Sub(lastProgress) > s.stallTimeout {
+					p.Stalled = true
+					p.logger.Warn("batch stalled", "stall_timeout", s.stallTimeout.String(), "files", count, "bytes", size)
+					p.terminate(s.gracePeriod, exited)
+					return
+				}
+			}
+		}
+	}
+}
+
+// batchProgress returns the count and size of the batch files present in the batch directory
+func (s *ProcessSet) batchProgress(p *Process) (int, int64) {
+	var count int
+	var size int64
+	for _, file := range p.Files {
+		stat, err := os.Stat(filepath.Join(p.dir, file.Name))
+		if err == nil {
+			count += 1
+			if stat.Mode().IsRegular() {
+				size += stat.Size()
+			}
+		}
+	}
+	return count, size
+}
+
+// remainingFiles returns the batch files not present in the batch directory with the expected size
+// Existing files kept by the overwrite policy are not remaining.
+func (s *ProcessSet) remainingFiles(p *Process) []MaildirFile {
+	remaining := []MaildirFile{}
+	for _, file := range p.Files {
+		stat, err := os.Stat(filepath.Join(p.dir, file.Name))
+		if err == nil && (stat.IsDir() || stat.Size() == file.Size) {
+			continue
+		}
+		if !p.staged && s.keptExisting(file.Name) {
+			continue
+		}
+		remaining = append(remaining, file)
+	}
+	return remaining
 }
 
-func (s *ProcessSet) Run() error {
+// Run executes the restore batches with at most PROCESS_COUNT running concurrently
+// When ctx is cancelled no further batches are started, running batches are terminated
+// and partially written files are removed.
+func (s *ProcessSet) Run(ctx context.Context) (*RestoreSummary, error) {
 
 	var processGroup sync.WaitGroup
-	var progressGroup sync.WaitGroup
+	var monitorGroup sync.WaitGroup
 
 	limit := make(chan struct{}, PROCESS_COUNT)
 
 	progress := !viper.GetBool("no_progress")
 	done := make(chan bool)
 
+	s.metrics.Start()
+
+	var totalSize int64
+	for _, proc := range s.procs {
+		totalSize += proc.Size
+	}
+
 	processGroup.Add(1)
 	go func() {
 		defer processGroup.Done()
-		for _, proc := range s.procs {
-			limit <- struct{}{}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case limit <- struct{}{}:
+			}
+			if !s.waitForSpace(ctx) {
+				<-limit
+				return
+			}
+			proc := s.next(ctx)
+			if proc == nil || ctx.Err() != nil {
+				if proc != nil {
+					s.finished()
+				}
+				<-limit
+				return
+			}
 			processGroup.Add(1)
 			go func(p *Process) {
 				defer processGroup.Done()
 				defer func() { <-limit }()
-
-				if p.debug {
-					log.Printf("[%d] starting: %v\n", p.Index, p.Cmd)
-				}
-				err := p.Cmd.Start()
-				if err != nil {
-					p.err = fmt.Errorf("Start failed: %v", err)
-					log.Printf("[%d] %v\n", p.Index, p.err)
-					return
-				}
-				if s.verbose {
-					log.Printf("[%d] running as pid %d\n", p.Index, p.Cmd.Process.Pid)
-				}
-				p.Started = true
-				p.Running = true
-				err = p.Cmd.Wait()
-				p.Running = false
-				if err != nil {
-					p.err = fmt.Errorf("Wait failed: %v\n", err)
-					log.Printf("[%d] %v\n", p.Index, p.err)
-					return
-				}
-				p.err = nil
-				if s.verbose {
-					log.Printf("[%d] pid %d exited %d\n", p.Index, p.Cmd.Process.Pid, p.Cmd.ProcessState.ExitCode())
-				}
+				defer s.finished()
+				s.runProcess(ctx, p)
 			}(proc)
 		}
 	}()
 
-	if progress {
-		var totalSize int64
-		var totalCount int
-		files := []string{}
-		for _, proc := range s.procs {
-			totalSize += proc.Size
-			totalCount += len(proc.Files)
-			files = append(files, proc.Files...)
-		}
-
-		go func() {
-			progressGroup.Add(1)
-			defer progressGroup.Done()
-			ticker := time.NewTicker(1 * time.Second)
-			defer ticker.Stop()
-			stopped := false
-			bar := progressbar.Default(totalSize)
-			for {
-				select {
-				case <-done:
-					log.Printf("progress: read done channel\n")
-					stopped = true
-				case <-ticker.C:
-					log.Printf("progress: tick\n")
-					var count int
-					var size int64
-					for _, file := range files {
-						targetFile := filepath.Join(ExpandPath(viper.GetString("output_dir")), file)
-						if s.debug {
-							log.Printf("progress: checking %s\n", targetFile)
-						}
-						stat, err := os.Stat(targetFile)
-						if err == nil {
-							count += 1
-							if stat.Mode().IsRegular() {
-								size += stat.Size()
-							}
-							if s.debug {
-								log.Printf("progress: found %d %s\n", size, targetFile)
-							}
-						} else if os.IsNotExist(err) {
-							if s.debug {
-								log.Printf("progress: not found %s\n", targetFile)
-							}
-						} else {
-							log.Fatalf("progress: Stat failed: %v", err)
-						}
-					}
-					//log.Printf("progress: [%d of %d] %v %v\n", count, totalCount, size, totalSize)
+	monitorGroup.Add(1)
+	go func() {
+		defer monitorGroup.Done()
+		ticker := time.NewTicker(1 * time.Second)
+		defer ticker.Stop()
+		var bar *progressbar.ProgressBar
+		if progress {
+			bar = progressbar.Default(totalSize)
+		}
+		for {
+			select {
+			case <-done:
+				s.logger.Debug("progress: read done channel")
+				count, size := s.restoredTotals()
+				s.metrics.SetRestored(count, size)
+				if bar != nil {
+					bar.Set64(size)
+				}
+				return
+			case <-ticker.C:
+				count, size := s.restoredTotals()
+				s.metrics.SetRestored(count, size)
+				if bar != nil {
 					bar.Set64(size)
-					if stopped {
-						return
-					}
 				}
 			}
-		}()
-	}
+		}
+	}()
 
 	if s.verbose {
-		log.Printf("waiting on process group...\n")
+		s.logger.Info("waiting on process group")
 	}
 	processGroup.Wait()
 	if s.verbose {
-		log.Printf("all processes exited\n")
+		s.logger.Info("all processes exited")
 	}
 	close(limit)
 
-	if progress {
-		done <- true
-		if s.verbose {
-			log.Printf("waiting on progress group...\n")
-		}
-		progressGroup.Wait()
-		if s.verbose {
-			log.Printf("progress group exited\n")
+	summary := s.summarize(ctx)
+
+	if IsDir(s.stagingDir) {
+		err := os.RemoveAll(s.stagingDir)
+		if err != nil {
+			s.logger.Error("failed removing staging directory", "dir", s.stagingDir, "error", err)
 		}
+	}
 
+	done <- true
+	if s.verbose {
+		s.logger.Info("waiting on monitor group")
+	}
+	monitorGroup.Wait()
+	if s.verbose {
+		s.logger.Info("monitor group exited")
 	}
 	close(done)
 
+	err := s.metrics.Finish()
+	if err != nil {
+		return summary, err
+	}
+
+	if ctx.Err() != nil {
+		return summary, fmt.Errorf("restore interrupted: %d of %d batches completed, %d partial files removed", len(summary.Completed), summary.Batches, len(summary.RemovedFiles))
+	}
+	if len(summary.Failed) > 0 {
+		return summary, fmt.Errorf("restore failed: %d of %d batches failed", len(summary.Failed), summary.Batches)
+	}
+	return summary, nil
+}
+
+// summarize records the state of each batch and removes partial files left by interrupted batches
+func (s *ProcessSet) summarize(ctx context.Context) *RestoreSummary {
+	summary := RestoreSummary{
+		Batches:      len(s.procs),
+		Completed:    []int{},
+		Failed:       []int{},
+		Interrupted:  []int{},
+		NotStarted:   []int{},
+		Retried:      []int{},
+		RemovedFiles: []string{},
+	}
+	for _, p := range s.procs {
+		switch {
+		case p.Requeued:
+			summary.Retried = append(summary.Retried, p.Index)
+		case p.Completed:
+			summary.Completed = append(summary.Completed, p.Index)
+		case p.Interrupted:
+			summary.Interrupted = append(summary.Interrupted, p.Index)
+			summary.RemovedFiles = append(summary.RemovedFiles, s.removePartialFiles(p)...)
+		case p.Started || p.err != nil:
+			summary.Failed = append(summary.Failed, p.Index)
+		default:
+			summary.NotStarted = append(summary.NotStarted, p.Index)
+		}
+	}
+	if ctx.Err() != nil {
+		s.logger.Warn("restore interrupted",
+			"completed", summary.Completed,
+			"interrupted", summary.Interrupted,
+			"failed", summary.Failed,
+			"not_started", summary.NotStarted,
+			"removed_files", len(summary.RemovedFiles),
+		)
+	}
+	return &summary
+}
+
+// removePartialFiles deletes files of an interrupted batch whose size does not match the metadata
+// Pre-existing output files not yet replaced by tarsnap are left in place.
+func (s *ProcessSet) removePartialFiles(p *Process) []string {
+	removed := []string{}
+	for _, file := range p.Files {
+		if strings.HasSuffix(file.Name, "/") {
+			continue
+		}
+		targetFile := filepath.Join(p.dir, file.Name)
+		stat, err := os.Lstat(targetFile)
+		if err != nil || !stat.Mode().IsRegular() || stat.Size() == file.Size {
+			continue
+		}
+		existing, ok := s.existing[file.Name]
+		if ok && !p.staged && existing.unchanged(targetFile) {
+			continue
+		}
+		err = os.Remove(targetFile)
+		if err != nil {
+			p.logger.Error("failed removing partial file", "file", targetFile, "error", err)
+			continue
+		}
+		p.logger.Warn("removed partial file", "file", targetFile, "bytes", stat.Size(), "expected", file.Size)
+		removed = append(removed, targetFile)
+	}
+	return removed
+}
+
+// Verify checks each restored file against its metadata size and, for messages,
+// the ,S= size recorded in the Maildir filename
+// Pre-existing files kept by the overwrite policy are not checked.
+func (s *ProcessSet) Verify() error {
+	var checked, missing, mismatched int
+	for _, file := range s.files {
+		if strings.HasSuffix(file.Name, "/") {
+			continue
+		}
+		_, existing := s.existing[file.Name]
+		if existing && s.policy != OVERWRITE {
+			continue
+		}
+		checked += 1
+		targetFile := filepath.Join(s.outputDir, file.Name)
+		stat, err := os.Stat(targetFile)
+		if err != nil {
+			s.logger.Error("verify: missing", "file", targetFile, "error", err)
+			missing += 1
+			continue
+		}
+		if stat.Size() != file.Size {
+			s.logger.Error("verify: size mismatch", "file", targetFile, "bytes", stat.Size(), "expected", file.Size)
+			mismatched += 1
+			continue
+		}
+		if file.Message != nil && file.Message.Size > 0 && stat.Size() != file.Message.Size {
+			s.logger.Error("verify: size attribute mismatch", "file", targetFile, "bytes", stat.Size(), "expected", file.Message.Size)
+			mismatched += 1
+		}
+	}
+	if s.verbose {
+		s.logger.Info("verify complete", "files", checked, "missing", missing, "mismatched", mismatched)
+	}
+	if missing > 0 || mismatched > 0 {
+		return fmt.Errorf("verify failed: %d of %d files missing, %d size mismatches", missing, checked, mismatched)
+	}
 	return nil
 }
+
+// restoredTotals returns the count and size of the selected files present in the output directory
+func (s *ProcessSet) restoredTotals() (int64, int64) {
+	var count int64
+	var size int64
+	for _, file := range s.files {
+		targetFile := filepath.Join(s.outputDir, file.Name)
+		stat, err := os.Stat(targetFile)
+		if err == nil {
+			count += 1
+			if stat.Mode().IsRegular() {
+				size += stat.Size()
+			}
+			if s.debug {
+				s.logger.Debug("progress: found", "file", targetFile, "bytes", size)
+			}
+		} else if os.IsNotExist(err) {
+			if s.debug {
+				s.logger.Debug("progress: not found", "file", targetFile)
+			}
+		} else {
+			s.logger.Warn("progress: Stat failed", "file", targetFile, "error", err)
+		}
+	}
+	return count, size
+}
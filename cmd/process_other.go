@@ -0,0 +1,15 @@
+//go:build !unix
+
+package cmd
+
+import (
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+// signalProcessGroup kills the started cmd; without process groups and SIGTERM there is no graceful stop
+func signalProcessGroup(cmd *exec.Cmd, kill bool) error {
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,238 @@
+//go:build unix
+
+package cmd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const FAKE_TARSNAP_ARGS = `#!/bin/sh
+dir=.
+files=""
+while [ $# -gt 0 ]; do
+  case "$1" in
+    -C) shift; dir="$1";;
+    -f|--keyfile|--maxbw-rate) shift;;
+    -*) ;;
+    *) files="$files $1";;
+  esac
+  shift
+done
+cd "$dir" || exit 1
+`
+
+// fakeTarsnap writes a tarsnap command script running body in the -C directory with
+// the archive paths of the command line in $files
+func fakeTarsnap(t *testing.T, body string) string {
+	script := filepath.Join(t.TempDir(), "tarsnap")
+	require.Nil(t, os.WriteFile(script, []byte(FAKE_TARSNAP_ARGS+body+"\n"), 0700))
+	return script
+}
+
+// newTestProcessSet returns a process set restoring to a temporary output directory with the fake tarsnap script
+func newTestProcessSet(t *testing.T, script string, options map[string]any) *ProcessSet {
+	values := map[string]any{
+		"output_dir":       filepath.Join(t.TempDir(), "restore"),
+		"tarsnap_command":  script,
+		"keyfile":          "",
+		"no_progress":      true,
+		"skip_space_check": true,
+		"space_reserve":    "0",
+		"maxbw_rate":       "",
+		"nice":             0,
+		"ionice_idle":      false,
+		"grace_period":     "10s",
+		"batch_timeout":    "0",
+		"stall_timeout":    "0",
+		"batch_retries":    DEFAULT_BATCH_RETRIES,
+		"metrics_listen":   "",
+		"metrics_textfile": "",
+		"overwrite":        false,
+		"no_overwrite":     false,
+		"keep_newer":       false,
+		"rename_conflicts": false,
+	}
+	for key, value := range options {
+		values[key] = value
+	}
+	restore := OverrideOptions(values)
+	t.Cleanup(restore)
+	s, err := NewProcessSet("2025-03-01.mail1")
+	require.Nil(t, err)
+	require.Nil(t, os.MkdirAll(s.outputDir, 0700))
+	return s
+}
+
+func testMaildirFiles(names map[string]int64) []MaildirFile {
+	m := Maildir{}
+	for _, name := range SortedKeys(names) {
+		m.AddFile(name, names[name])
+	}
+	return m.Files
+}
+
+// cancelWhenPresent cancels the restore once pathname exists
+func cancelWhenPresent(t *testing.T, pathname string, cancel context.CancelFunc) {
+	go func() {
+		defer cancel()
+		deadline := time.Now().Add(10 * time.Second)
+		for !IsFile(pathname) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+}
+
+func TestProcessSetCancel(t *testing.T) {
+	script := fakeTarsnap(t, `for f in $files; do mkdir -p $(dirname $f); printf partial > $f; break; done
+sleep 30`)
+	s := newTestProcessSet(t, script, nil)
+	files := testMaildirFiles(map[string]int64{
+		"./alice/Maildir/cur/1.M1P1.host:2,S": 100,
+		"./alice/Maildir/cur/2.M1P1.host:2,S": 100,
+	})
+	// a pre-existing output file not yet replaced is kept
+	existing := filepath.Join(s.outputDir, "alice", "Maildir", "cur", "2.M1P1.host:2,S")
+	require.Nil(t, os.MkdirAll(filepath.Dir(existing), 0700))
+	require.Nil(t, os.WriteFile(existing, []byte("existing"), 0600))
+	restore, staged := s.PlanFiles(files)
+	require.Empty(t, staged)
+	require.Nil(t, s.AddRestore("2025-03-01.mail1.alice.maildir", "alice", "INBOX", restore))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	partial := filepath.Join(s.outputDir, "alice", "Maildir", "cur", "1.M1P1.host:2,S")
+	cancelWhenPresent(t, partial, cancel)
+	start := time.Now()
+	summary, err := s.Run(ctx)
+	require.NotNil(t, err)
+	require.Less(t, time.Since(start), 10*time.Second)
+	require.Equal(t, []int{0}, summary.Interrupted)
+	require.Equal(t, []string{partial}, summary.RemovedFiles)
+	require.False(t, IsFile(partial))
+	data, err := os.ReadFile(existing)
+	require.Nil(t, err)
+	require.Equal(t, "existing", string(data))
+}
+
+func TestProcessSetGracePeriodKill(t *testing.T) {
+	// the batch ignores SIGTERM and is killed after the grace period
+	script := fakeTarsnap(t, `trap '' TERM
+for f in $files; do mkdir -p $(dirname $f); printf partial > $f; break; done
+sleep 30`)
+	s := newTestProcessSet(t, script, map[string]any{"grace_period": "200ms"})
+	files := testMaildirFiles(map[string]int64{"./alice/Maildir/cur/1.M1P1.host:2,S": 100})
+	require.Nil(t, s.AddRestore("2025-03-01.mail1.alice.maildir", "alice", "INBOX", files))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	partial := filepath.Join(s.outputDir, "alice", "Maildir", "cur", "1.M1P1.host:2,S")
+	cancelWhenPresent(t, partial, cancel)
+	start := time.Now()
+	summary, err := s.Run(ctx)
+	require.NotNil(t, err)
+	require.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+	require.Less(t, time.Since(start), 10*time.Second)
+	require.Equal(t, []int{0}, summary.Interrupted)
+	require.True(t, s.procs[0].Interrupted)
+	require.NotEqual(t, 0, s.procs[0].ExitCode)
+	require.False(t, IsFile(partial))
+}
+
+func TestRemovePartialFiles(t *testing.T) {
+	s := newTestProcessSet(t, "/bin/false", nil)
+	files := testMaildirFiles(map[string]int64{
+		"./alice/Maildir/cur/1.M1P1.host:2,S": 4,
+		"./alice/Maildir/cur/2.M1P1.host:2,S": 4,
+		"./alice/Maildir/cur/3.M1P1.host:2,S": 4,
+	})
+	write := func(name, content string) string {
+		pathname := filepath.Join(s.outputDir, name)
+		require.Nil(t, os.MkdirAll(filepath.Dir(pathname), 0700))
+		require.Nil(t, os.WriteFile(pathname, []byte(content), 0600))
+		return pathname
+	}
+	complete := write(files[0].Name, "done")
+	partial := write(files[1].Name, "pa")
+	p := s.newRestoreProcess(s.outputDir, "2025-03-01.mail1.alice.maildir", "alice", "INBOX", files)
+	removed := s.removePartialFiles(p)
+	require.Equal(t, []string{partial}, removed)
+	require.True(t, IsFile(complete))
+	require.False(t, IsFile(partial))
+}
+
+func TestProcessSetBatchTimeout(t *testing.T) {
+	script := fakeTarsnap(t, `sleep 30`)
+	s := newTestProcessSet(t, script, map[string]any{"batch_timeout": "300ms", "batch_retries": 0, "grace_period": "1s"})
+	s.monitorInterval = 50 * time.Millisecond
+	files := testMaildirFiles(map[string]int64{"./alice/Maildir/cur/1.M1P1.host:2,S": 5})
+	require.Nil(t, s.AddRestore("2025-03-01.mail1.alice.maildir", "alice", "INBOX", files))
+	start := time.Now()
+	summary, err := s.Run(context.Background())
+	require.NotNil(t, err)
+	require.Less(t, time.Since(start), 10*time.Second)
+	require.True(t, s.procs[0].TimedOut)
+	require.Equal(t, []int{0}, summary.Failed)
+	require.Empty(t, summary.Retried)
+}
+
+func TestProcessSetStallRequeue(t *testing.T) {
+	// the first attempt restores one file and stalls, the retry restores the rest
+	state := filepath.Join(t.TempDir(), "attempted")
+	script := fakeTarsnap(t, `if [ ! -e `+state+` ]; then
+  touch `+state+`
+  for f in $files; do mkdir -p $(dirname $f); printf hello > $f; break; done
+  sleep 30
+fi
+for f in $files; do mkdir -p $(dirname $f); printf hello > $f; done`)
+	s := newTestProcessSet(t, script, map[string]any{"stall_timeout": "300ms", "grace_period": "1s"})
+	s.monitorInterval = 50 * time.Millisecond
+	files := testMaildirFiles(map[string]int64{
+		"./alice/Maildir/cur/1.M1P1.host:2,S": 5,
+		"./alice/Maildir/cur/2.M1P1.host:2,S": 5,
+		"./alice/Maildir/cur/3.M1P1.host:2,S": 5,
+	})
+	require.Nil(t, s.AddRestore("2025-03-01.mail1.alice.maildir", "alice", "INBOX", files))
+	summary, err := s.Run(context.Background())
+	require.Nil(t, err)
+	require.True(t, s.procs[0].Stalled)
+	require.Equal(t, []int{0}, summary.Retried)
+	require.Equal(t, []int{1}, summary.Completed)
+	require.Len(t, s.procs, 2)
+	require.Equal(t, 1, s.procs[1].Attempt)
+	require.Equal(t, files[1:], s.procs[1].Files)
+	for _, file := range files {
+		require.True(t, IsFile(filepath.Join(s.outputDir, file.Name)))
+	}
+}
+
+func TestProcessSetStallRetriesExhausted(t *testing.T) {
+	script := fakeTarsnap(t, `sleep 30`)
+	s := newTestProcessSet(t, script, map[string]any{"stall_timeout": "200ms", "batch_retries": 1, "grace_period": "1s"})
+	s.monitorInterval = 50 * time.Millisecond
+	files := testMaildirFiles(map[string]int64{"./alice/Maildir/cur/1.M1P1.host:2,S": 5})
+	require.Nil(t, s.AddRestore("2025-03-01.mail1.alice.maildir", "alice", "INBOX", files))
+	summary, err := s.Run(context.Background())
+	require.NotNil(t, err)
+	require.Len(t, s.procs, 2)
+	require.Equal(t, []int{0}, summary.Retried)
+	require.Equal(t, []int{1}, summary.Failed)
+}
+
+func TestProcessSetExtractionProgress(t *testing.T) {
+	// reported extractions count as progress while no batch file is written
+	script := fakeTarsnap(t, `for i in 1 2 3 4 5 6 7 8; do echo "x ./alice/Maildir/cur/other.$i" >&2; sleep 0.1; done
+for f in $files; do mkdir -p $(dirname $f); printf hello > $f; done`)
+	s := newTestProcessSet(t, script, map[string]any{"stall_timeout": "300ms", "grace_period": "1s"})
+	s.monitorInterval = 50 * time.Millisecond
+	files := testMaildirFiles(map[string]int64{"./alice/Maildir/cur/1.M1P1.host:2,S": 5})
+	require.Nil(t, s.AddRestore("2025-03-01.mail1.alice.maildir", "alice", "INBOX", files))
+	summary, err := s.Run(context.Background())
+	require.Nil(t, err)
+	require.False(t, s.procs[0].Stalled)
+	require.Equal(t, []int{0}, summary.Completed)
+	require.Equal(t, int64(8), s.procs[0].extracted.Load())
+}
@@ -0,0 +1,22 @@
+//go:build unix
+
+package cmd
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup runs cmd in a separate process group so a terminal interrupt reaches only us
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// signalProcessGroup sends SIGTERM, or SIGKILL if kill is set, to the process group of a started cmd
+func signalProcessGroup(cmd *exec.Cmd, kill bool) error {
+	signal := syscall.SIGTERM
+	if kill {
+		signal = syscall.SIGKILL
+	}
+	return syscall.Kill(-cmd.Process.Pid, signal)
+}
@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// MIN_MAXBW_RATE is the lowest --maxbw-rate tarsnap accepts
+const MIN_MAXBW_RATE = 8000
+
+// IONICE_IDLE is the ionice scheduling class for idle IO priority
+const IONICE_IDLE = "3"
+
+// Bandwidth divides a global bandwidth budget across concurrently running batches
+// Each batch is started with a share of the unallocated budget; shares are
+// returned when batches exit so that later batches receive the freed bandwidth.
+type Bandwidth struct {
+	mutex     sync.Mutex
+	budget    int64
+	allocated map[int]int64
+}
+
+// NewBandwidth returns the allocator of budget bytes per second, or nil if budget is zero
+// The budget must cover the minimum tarsnap rate for each concurrent batch.
+func NewBandwidth(budget int64) (*Bandwidth, error) {
+	if budget == 0 {
+		return nil, nil
+	}
+	if budget < PROCESS_COUNT*MIN_MAXBW_RATE {
+		return nil, fmt.Errorf("maxbw_rate %d is below %d: %d concurrent batches at the minimum tarsnap rate of %d", budget, PROCESS_COUNT*MIN_MAXBW_RATE, PROCESS_COUNT, MIN_MAXBW_RATE)
+	}
+	return &Bandwidth{
+		budget:    budget,
+		allocated: make(map[int]int64),
+	}, nil
+}
+
+// Allocate returns the rate for batch index given the number of batches not yet finished
+// A zero rate means no limit.
+func (b *Bandwidth) Allocate(index, pending int) int64 {
+	if b == nil || b.budget == 0 {
+		return 0
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var used int64
+	for _, rate := range b.allocated {
+		used += rate
+	}
+	slots := PROCESS_COUNT - len(b.allocated)
+	if pending-len(b.allocated) < slots {
+		slots = pending - len(b.allocated)
+	}
+	if slots < 1 {
+		slots = 1
+	}
+	rate := (b.budget - used) / int64(slots)
+	if rate < MIN_MAXBW_RATE {
+		slog.Warn("bandwidth budget exhausted; allocating the minimum rate", "maxbw_rate", b.budget, "allocated", used, "rate", MIN_MAXBW_RATE)
+		rate = MIN_MAXBW_RATE
+	}
+	b.allocated[index] = rate
+	return rate
+}
+
+func (b *Bandwidth) Release(index int) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.allocated, index)
+}
+
+// PriorityPrefix returns the command prefix running a child under the configured nice level and IO priority
+func PriorityPrefix() ([]string, error) {
+	prefix := []string{}
+	nice := viper.GetInt("nice")
+	if nice != 0 {
+		if nice < -20 || nice > 19 {
+			return nil, fmt.Errorf("nice level out of range: %d", nice)
+		}
+		prefix = append(prefix, "nice", "-n", fmt.Sprintf("%d", nice))
+	}
+	if viper.GetBool("ionice_idle") {
+		_, err := exec.LookPath("ionice")
+		if err != nil {
+			slog.Warn("ionice not available; IO priority unchanged", "error", err)
+		} else {
+			prefix = append(prefix, "ionice", "-c", IONICE_IDLE)
+		}
+	}
+	return prefix, nil
+}
+
+// NewRestoreCommand returns the tarsnap command with args, wrapped in prefix and limited to rate bytes per second
+func NewRestoreCommand(prefix []string, rate int64, args []string) *exec.Cmd {
+	cmdline := append([]string{}, prefix...)
+	cmdline = append(cmdline, strings.Split(viper.GetString("tarsnap_command"), " ")...)
+	if rate > 0 {
+		cmdline = append(cmdline, "--maxbw-rate", fmt.Sprintf("%d", rate))
+	}
+	cmdline = append(cmdline, args...)
+	return exec.Command(cmdline[0], cmdline[1:]...)
+}
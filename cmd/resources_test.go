@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSize(t *testing.T) {
+	for value, expected := range map[string]int64{
+		"0":      0,
+		"512":    512,
+		"64K":    64 << 10,
+		"64k":    64 << 10,
+		"1M":     1 << 20,
+		"1MB":    1 << 20,
+		"1MiB":   1 << 20,
+		" 2G ":   2 << 30,
+		"1T":     1 << 40,
+		"100000": 100000,
+	} {
+		size, err := ParseSize(value)
+		require.Nil(t, err, value)
+		require.Equal(t, expected, size, value)
+	}
+	for _, value := range []string{"", "K", "-1", "1.5M", "1X", "ten"} {
+		_, err := ParseSize(value)
+		require.NotNil(t, err, value)
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	unlimited, err := NewBandwidth(0)
+	require.Nil(t, err)
+	require.Nil(t, unlimited)
+	require.Equal(t, int64(0), unlimited.Allocate(0, 3))
+	unlimited.Release(0)
+
+	_, err = NewBandwidth(PROCESS_COUNT*MIN_MAXBW_RATE - 1)
+	require.NotNil(t, err)
+
+	b, err := NewBandwidth(800000)
+	require.Nil(t, err)
+	// a single pending batch receives the whole budget
+	require.Equal(t, int64(800000), b.Allocate(0, 1))
+	b.Release(0)
+
+	// the budget is divided across the pending batches up to PROCESS_COUNT
+	require.Equal(t, int64(400000), b.Allocate(1, 2))
+	require.Equal(t, int64(400000), b.Allocate(2, 2))
+	b.Release(1)
+	b.Release(2)
+	var total int64
+	for i := 0; i < PROCESS_COUNT; i++ {
+		total += b.Allocate(10+i, 20)
+	}
+	require.Equal(t, int64(800000), total)
+
+	// a released share is given to the next batch
+	b.Release(10)
+	require.Equal(t, int64(100000), b.Allocate(20, 20))
+}
+
+func TestBandwidthMinimumRate(t *testing.T) {
+	b, err := NewBandwidth(PROCESS_COUNT * MIN_MAXBW_RATE)
+	require.Nil(t, err)
+	var total int64
+	for i := 0; i < PROCESS_COUNT; i++ {
+		rate := b.Allocate(i, PROCESS_COUNT)
+		require.Equal(t, int64(MIN_MAXBW_RATE), rate)
+		total += rate
+	}
+	require.Equal(t, int64(PROCESS_COUNT*MIN_MAXBW_RATE), total)
+}
+
+func TestPriorityPrefix(t *testing.T) {
+	restore := OverrideOptions(map[string]any{"nice": 0, "ionice_idle": false})
+	defer restore()
+	prefix, err := PriorityPrefix()
+	require.Nil(t, err)
+	require.Empty(t, prefix)
+
+	OverrideOptions(map[string]any{"nice": 10})
+	prefix, err = PriorityPrefix()
+	require.Nil(t, err)
+	require.Equal(t, []string{"nice", "-n", "10"}, prefix)
+
+	for _, nice := range []int{-21, 20} {
+		OverrideOptions(map[string]any{"nice": nice})
+		_, err = PriorityPrefix()
+		require.NotNil(t, err, nice)
+	}
+
+	OverrideOptions(map[string]any{"nice": 0, "ionice_idle": true})
+	prefix, err = PriorityPrefix()
+	require.Nil(t, err)
+	_, lookErr := exec.LookPath("ionice")
+	if lookErr == nil {
+		require.Equal(t, []string{"ionice", "-c", IONICE_IDLE}, prefix)
+	} else {
+		require.Empty(t, prefix)
+	}
+
+	OverrideOptions(map[string]any{"tarsnap_command": "tarsnap", "ionice_idle": false})
+	cmd := NewRestoreCommand([]string{"nice", "-n", "5"}, 16000, []string{"-x", "-f", "a"})
+	require.Equal(t, []string{"nice", "-n", "5", "tarsnap", "--maxbw-rate", "16000", "-x", "-f", "a"}, cmd.Args)
+}
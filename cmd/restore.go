@@ -31,6 +31,11 @@ POSSIBILITY OF SUCH DAMAGE.
 package cmd
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -40,16 +45,95 @@ var restoreCmd = &cobra.Command{
 	Short: "restore maildirs from archive",
 	Long: `
 Restore maildirs from ARCHIVE_NAME
+
+Each archived path is classified as a message, folder metadata (uid lists,
+indexes, keywords), mailbox metadata (subscriptions, quota) or unknown;
+--classes selects the classes restored. Maildir++ (.A.B) and LAYOUT=fs
+(A/B) folders are recognized. Directories are not extracted; the cur, new
+and tmp directories of each restored folder are created.
+
+With --files-from FILE, only the archive paths listed in FILE, one per
+line, are restored; use - to read the list from stdin. The output of the
+files command is accepted. A listed directory, such as
+./USER/Maildir/.Sent/, selects every file below it. Every listed path
+must be present in the archive metadata and selected by the filter
+options.
+
+SIGINT or SIGTERM stops scheduling new batches and terminates running
+tarsnap processes, killing any still running after --grace-period.
+Partially written files are removed and a summary of the completed
+batches is reported.
+
+The output directory is locked for the duration of the restore. A lock
+left by a process that is no longer running on this host is removed;
+use --force-unlock to remove a lock held by another host.
+
+Files already present in the output directory are handled by the
+overwrite policy: --overwrite (default) replaces them, --no-overwrite
+keeps them, --keep-newer keeps those newer than the archived copy, and
+--rename-conflicts restores conflicting messages under a new Maildir
+unique name next to the existing message. A message conflicts with an
+existing message of the same Maildir unique name in the cur or new
+directory of its folder, also when its flags changed or it was moved
+from new to cur since the backup.
+
+With --verify, each restored file is checked against the size in the
+archive metadata and, for messages, the ,S= size in the Maildir filename.
+
+With --stream, each maildir archive is read as a tar stream from tarsnap
+-r and the selected files are written by the restore process itself,
+reporting progress in bytes. tarsnap reads the archive from its start;
+reading stops once every selected file has been seen. Hard linked files,
+such as messages Dovecot shares between folders, are written with the
+content of their link target, read by a second pass over the archive;
+without --stream, tarsnap extracts a hard link only with its target.
+Streamed files pass through a chain of sinks:
+
+  --rewrite OLD=NEW,...  replace target path prefixes; an empty NEW drops
+                         the files below OLD
+  --hash-file FILE       write the sha256sum of each written file to FILE
+  --verify               check sizes as the files are streamed
+  --mbox                 write the messages of each folder to
+                         OUTPUT/USER/FOLDER.mbox (mboxrd) instead of files;
+                         existing mbox files are replaced, so only the
+                         default --overwrite policy is accepted
+  --output-layout folders
+                         write USER/FOLDER/cur/NAME paths using the folder
+                         display names instead of USER/Maildir/...
+
+With --output-archive FILE, the selected files are streamed into a single
+archive instead of the output directory: FILE.tar, FILE.tar.gz (.tgz) or
+FILE.zip, or - to write a tar stream to stdout, e.g. for piping over ssh.
+No output directory is created or locked. The archive is written under a
+temporary name and renamed when complete. An existing FILE is replaced
+under the default --overwrite policy; other policies refuse to replace it.
+
+--stream, --output-archive and the stream sinks apply to the restore
+command only; the commands restoring messages to a temporary directory
+(index, attachments, ediscovery-export, restore-thread) ignore them.
 `,
 	Args: cobra.RangeArgs(0, 1),
 	Run: func(cmd *cobra.Command, args []string) {
-		archiveName := viper.GetString("archive")
-		if len(args) > 0 {
-			archiveName = args[0]
-		}
+		archiveName, err := ArchiveBaseName(args)
+		cobra.CheckErr(err)
 		tarsnap, err := NewTarsnap(archiveName)
 		cobra.CheckErr(err)
-		err = tarsnap.Restore()
+		if viper.GetString("files_from") != "" {
+			paths, err := ReadPathList(viper.GetString("files_from"))
+			cobra.CheckErr(err)
+			err = tarsnap.SelectFiles(paths)
+			cobra.CheckErr(err)
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		switch {
+		case viper.GetString("output_archive") != "" && !viper.GetBool("dryrun"):
+			err = tarsnap.RestoreArchive(ctx, viper.GetString("output_archive"))
+		case viper.GetBool("stream") && !viper.GetBool("dryrun"):
+			err = tarsnap.RestoreStream(ctx)
+		default:
+			err = tarsnap.Restore(ctx)
+		}
 		cobra.CheckErr(err)
 	},
 }
@@ -0,0 +1,69 @@
+//go:build unix
+
+package cmd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestoreScratchOptions(t *testing.T) {
+	src := t.TempDir()
+	name := "./alice/Maildir/cur/1.M1P1.host,S=6:2,S"
+	require.Nil(t, os.MkdirAll(filepath.Join(src, filepath.Dir(name)), 0700))
+	require.Nil(t, os.WriteFile(filepath.Join(src, name), []byte("hello\n"), 0600))
+	metadataDir := t.TempDir()
+	require.Nil(t, os.WriteFile(filepath.Join(metadataDir, "2025-06-25.mailbox.alice.file_list"),
+		[]byte("-rw------- 1 alice alice 6 Jun 25 10:00 "+name+"\n"), 0600))
+
+	// the fake tarsnap -x copies the listed files from the source directory
+	script := fakeTarsnap(t, `for f in $files; do mkdir -p $(dirname $f); cp `+src+`/$f $f; done`)
+	outputArchive := filepath.Join(t.TempDir(), "output.tar")
+	newTestProcessSet(t, script, map[string]any{
+		"metadata_dir":   metadataDir,
+		"dryrun":         false,
+		"output_archive": outputArchive,
+		"stream":         true,
+		"mbox":           true,
+		"rewrite":        "alice/Maildir=bob/Maildir",
+		"output_layout":  OUTPUT_LAYOUT_FOLDERS,
+	})
+
+	// the restore output options apply only to the restore command
+	scratch := t.TempDir()
+	_, err := RestoreScratch(context.Background(), "2025-06-25.mailbox", scratch, nil)
+	require.Nil(t, err)
+	data, err := os.ReadFile(filepath.Join(scratch, filepath.FromSlash(name)))
+	require.Nil(t, err)
+	require.Equal(t, "hello\n", string(data))
+	require.False(t, IsFile(outputArchive))
+}
+
+func TestRestoreScratchFolders(t *testing.T) {
+	src := t.TempDir()
+	names := []string{"./alice/Maildir/cur/1.M1P1.host,S=6:2,S", "./alice/Maildir/.Sent/cur/2.M1P1.host,S=6:2,S"}
+	list := ""
+	for _, name := range names {
+		require.Nil(t, os.MkdirAll(filepath.Join(src, filepath.Dir(name)), 0700))
+		require.Nil(t, os.WriteFile(filepath.Join(src, name), []byte("hello\n"), 0600))
+		list += "-rw------- 1 alice alice 6 Jun 25 10:00 " + name + "\n"
+	}
+	metadataDir := t.TempDir()
+	require.Nil(t, os.WriteFile(filepath.Join(metadataDir, "2025-06-25.mailbox.alice.file_list"), []byte(list), 0600))
+	script := fakeTarsnap(t, `for f in $files; do mkdir -p $(dirname $f); cp `+src+`/$f $f; done`)
+	newTestProcessSet(t, script, map[string]any{"metadata_dir": metadataDir, "dryrun": false})
+
+	// the folders of listed paths are complete Maildirs
+	scratch := t.TempDir()
+	_, err := RestoreScratch(context.Background(), "2025-06-25.mailbox", scratch, names[1:])
+	require.Nil(t, err)
+	require.True(t, IsFile(filepath.Join(scratch, filepath.FromSlash(names[1]))))
+	for _, subdir := range MAILDIR_SUBDIRS {
+		require.True(t, IsDir(filepath.Join(scratch, "alice", "Maildir", ".Sent", subdir)), subdir)
+	}
+	require.False(t, IsDir(filepath.Join(scratch, "alice", "Maildir", "cur")))
+}
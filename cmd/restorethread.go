@@ -0,0 +1,154 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var restoreThreadCmd = &cobra.Command{
+	Use:   "restore-thread [ARCHIVE_NAME] PATH|MESSAGE-ID",
+	Short: "restore the conversation thread of one message",
+	Long: `
+Restore every message of the conversation containing one message, given
+its archive path or Message-ID.
+
+The headers of the candidate messages are read from the tar stream of
+the maildir archives and added to the --catalog; the candidates are not
+written to disk, and messages already cataloged are not read again.
+Given a PATH, the candidates are all messages of the user holding it;
+given a MESSAGE-ID, all messages of the users selected with --user. A
+MESSAGE-ID containing / must be enclosed in <>. The message is looked
+up, and the thread reconstructed from the Message-ID, In-Reply-To and
+References headers and restored, in all folders, including Sent,
+regardless of --maildir and --filter.
+`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		archiveName, err := ArchiveBaseName(args[:len(args)-1])
+		cobra.CheckErr(err)
+		catalog, err := OpenCatalog(viper.GetString("catalog"))
+		cobra.CheckErr(err)
+		defer catalog.Close()
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		err = RestoreThread(ctx, catalog, archiveName, args[len(args)-1])
+		cobra.CheckErr(err)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(restoreThreadCmd)
+}
+
+// RestoreThread restores the thread of the message at an archive path or with a Message-ID
+func RestoreThread(ctx context.Context, catalog *Catalog, archiveName, seed string) error {
+	// the seed and its thread are looked up in all folders
+	defer OverrideOptions(map[string]any{"maildir": ".*", "filter": "", "files_from": ""})()
+	tarsnap, err := NewTarsnap(archiveName)
+	if err != nil {
+		return err
+	}
+	pathname := ArchivePath(seed)
+	userFilter := viper.GetString("user")
+	messageID := ""
+	owner, _, err := tarsnap.FindFile(pathname)
+	if err == nil {
+		for name, user := range tarsnap.Users {
+			if user == owner {
+				userFilter = "^" + regexp.QuoteMeta(name) + "$"
+			}
+		}
+	} else {
+		if strings.Contains(seed, "/") && !strings.HasPrefix(seed, "<") {
+			return err
+		}
+		pathname = ""
+		messageID = NormalizeMessageID(seed)
+	}
+
+	defer OverrideOptions(map[string]any{"user": userFilter})()
+	summary, err := StreamIndexArchive(ctx, catalog, archiveName)
+	if err != nil {
+		return err
+	}
+	if tarsnap.verbose {
+		tarsnap.logger.Info("thread candidates", "indexed", summary.Indexed, "cataloged", summary.Skipped)
+	}
+	candidates, err := NewTarsnap(archiveName)
+	if err != nil {
+		return err
+	}
+	cataloged, err := catalog.Search(CatalogQuery{Archive: archiveName})
+	if err != nil {
+		return err
+	}
+	messages := []CatalogMessage{}
+	seeds := []CatalogMessage{}
+	for _, message := range cataloged {
+		if candidates.Users[message.User] == nil {
+			continue
+		}
+		messages = append(messages, message)
+		if message.Path == pathname || messageID != "" && message.MessageID == messageID {
+			seeds = append(seeds, message)
+		}
+	}
+	if len(seeds) == 0 {
+		return fmt.Errorf("message not found in %s catalog: %s", archiveName, seed)
+	}
+
+	thread := ThreadMessages(messages, seeds)
+	paths := []string{}
+	for _, message := range thread {
+		if tarsnap.verbose {
+			tarsnap.logger.Info("thread message", "file", message.Path, "date", message.Date, "subject", message.Subject)
+		}
+		paths = append(paths, message.Path)
+	}
+	if tarsnap.verbose {
+		tarsnap.logger.Info("restoring thread", "messages", len(paths))
+	}
+	err = candidates.SelectFiles(paths)
+	if err != nil {
+		return err
+	}
+	return candidates.Restore(ctx)
+}
@@ -0,0 +1,61 @@
+//go:build unix
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestoreThreadSeedFolder(t *testing.T) {
+	src := t.TempDir()
+	messages := map[string]string{
+		"./alice/Maildir/cur/1.M1P1.host:2,S":       "Message-ID: <a@example.org>\r\nSubject: question\r\n\r\n?\r\n",
+		"./alice/Maildir/.Sent/cur/2.M1P1.host:2,S": "Message-ID: <b@example.org>\r\nIn-Reply-To: <a@example.org>\r\nSubject: Re: question\r\n\r\n!\r\n",
+	}
+	list := ""
+	for _, name := range SortedKeys(messages) {
+		require.Nil(t, os.MkdirAll(filepath.Join(src, filepath.Dir(name)), 0700))
+		require.Nil(t, os.WriteFile(filepath.Join(src, name), []byte(messages[name]), 0600))
+		list += fmt.Sprintf("-rw------- 1 alice alice %d Jun 25 10:00 %s\n", len(messages[name]), name)
+	}
+	metadataDir := t.TempDir()
+	require.Nil(t, os.WriteFile(filepath.Join(metadataDir, "2025-06-25.mailbox.alice.file_list"), []byte(list), 0600))
+
+	// the fake tarsnap writes the tar stream of the source directory for -r and copies the listed files for -x
+	script := filepath.Join(t.TempDir(), "tarsnap")
+	require.Nil(t, os.WriteFile(script, []byte(`#!/bin/sh
+dir=.
+files=""
+stream=""
+while [ $# -gt 0 ]; do
+  case "$1" in
+    -r) stream=1;;
+    -C) shift; dir="$1";;
+    -f|--keyfile|--maxbw-rate) shift;;
+    -*) ;;
+    *) files="$files $1";;
+  esac
+  shift
+done
+if [ -n "$stream" ]; then cd `+src+` && exec tar -cf - ./alice; fi
+cd "$dir" || exit 1
+for f in $files; do mkdir -p $(dirname $f); cp `+src+`/$f $f; done
+`), 0700))
+	s := newTestProcessSet(t, script, map[string]any{"metadata_dir": metadataDir, "dryrun": false, "maildir": "^INBOX$", "filter": "", "files_from": "", "user": ".*"})
+	catalog, err := OpenCatalog(filepath.Join(t.TempDir(), "catalog.db"))
+	require.Nil(t, err)
+	defer catalog.Close()
+
+	// the seed is outside the --maildir selection
+	err = RestoreThread(context.Background(), catalog, "2025-06-25.mailbox", "./alice/Maildir/.Sent/cur/2.M1P1.host:2,S")
+	require.Nil(t, err)
+	for _, name := range SortedKeys(messages) {
+		require.True(t, IsFile(filepath.Join(s.outputDir, filepath.FromSlash(name))), name)
+	}
+}
@@ -59,6 +59,8 @@ func Execute() {
 func init() {
 	cobra.OnInitialize(InitConfig)
 	OptionString("logfile", "l", "", "log filename")
+	OptionString("log-format", "", "text", "log output format (text, logfmt, json)")
+	OptionString("log-level", "", "", "log level (debug, info, warn, error)")
 	OptionString("config", "c", "", "config file")
 	OptionSwitch("debug", "", "produce debug output")
 	OptionSwitch("verbose", "v", "increase verbosity")
@@ -66,9 +68,67 @@ func init() {
 	OptionSwitch("no-progress", "P", "suppress progress bar display")
 	OptionString("keyfile", "k", "", "tarsnap key file")
 	OptionString("archive", "a", "", "archive base name YYYY-MM-DD.hostname")
+	OptionSwitch("latest", "L", "select the latest archive")
+	OptionString("date", "d", "", "select archive by date (YYYY-MM-DD, today, yesterday)")
+	OptionString("host", "H", "", "select archive by hostname")
+	OptionSwitch("group", "g", "group archive list by host and date")
 	OptionString("user", "u", ".*", "username select filter (regex)")
 	OptionString("maildir", "m", ".*", "maildir select filter (regex)")
+	OptionString("path-template", "", DEFAULT_PATH_TEMPLATE, "archive path of each Maildir: {domain}, {user} and {folder} placeholders")
+	OptionString("filter", "F", "", "file select rules: include|exclude EXPR; ... (see help filter)")
+	OptionString("explain", "", "", "report the filter decision for each path matching REGEX")
+	OptionString("classes", "", "all", "file classes selected: message, folder-metadata, mailbox-metadata, unknown or all")
+	OptionString("files-from", "", "", "restore only the archive paths listed in FILE (- for stdin)")
 	OptionString("output-dir", "O", "./restore", "restore destination directory")
 	OptionString("metadata-dir", "M", "", "preloaded metadata directory")
 	OptionString("tarsnap-command", "T", "/usr/local/bin/tarsnap", "tarsnap command")
+	OptionInt("days", "", 7, "watch-trends window size in days")
+	OptionInt("drop-percent", "", 50, "watch-trends drop threshold percent")
+	OptionInt("spike-percent", "", 100, "watch-trends spike threshold percent")
+	OptionInt("flag-change-percent", "", 25, "watch-trends flag change threshold percent")
+	OptionInt("min-messages", "", 100, "watch-trends minimum message count evaluated")
+	OptionString("grace-period", "", "10s", "time allowed for tarsnap to exit after interrupt")
+	OptionString("batch-timeout", "", "0", "kill restore batches running longer than DURATION")
+	OptionString("stall-timeout", "", "0", "kill restore batches writing no data for DURATION (0 disables)")
+	OptionInt("batch-retries", "", 2, "retry count for remaining files of killed batches")
+	OptionString("maxbw-rate", "", "", "total restore bandwidth limit in bytes per second (K, M, G suffix)")
+	OptionInt("nice", "", 0, "run tarsnap restore processes at CPU nice level")
+	OptionSwitch("ionice-idle", "", "run tarsnap restore processes at idle IO priority")
+	OptionString("space-reserve", "", "1G", "free space to keep on the output filesystem (K, M, G suffix)")
+	OptionSwitch("skip-space-check", "", "skip the output filesystem free space checks")
+	OptionSwitch("force-unlock", "", "remove an existing output directory lock before restoring")
+	OptionSwitch("overwrite", "", "replace existing files in the output directory (default)")
+	OptionSwitch("no-overwrite", "", "keep existing files in the output directory")
+	OptionSwitch("keep-newer", "", "keep existing files newer than the archived copy")
+	OptionSwitch("rename-conflicts", "", "restore conflicting messages under a new Maildir unique name")
+	OptionSwitch("verify", "", "check restored file sizes against the metadata and Maildir ,S= sizes")
+	OptionSwitch("stream", "", "restore by reading the archive tar stream from tarsnap -r")
+	OptionString("hash-file", "", "", "write the sha256sum of each streamed file to FILE (stream)")
+	OptionString("rewrite", "", "", "replace target path prefixes: OLD=NEW[,OLD=NEW...]; an empty NEW drops the files (stream)")
+	OptionSwitch("mbox", "", "write the streamed messages of each folder to OUTPUT/USER/FOLDER.mbox (stream)")
+	OptionString("output-archive", "", "", "stream the restore into FILE.tar, FILE.tar.gz, FILE.zip or - (tar to stdout) instead of the output directory")
+	OptionString("output-layout", "", OUTPUT_LAYOUT_MAILDIR, "streamed file paths: maildir (USER/Maildir/...) or folders (USER/FOLDER/cur/NAME)")
+	OptionString("metrics-listen", "", "", "serve prometheus /metrics on ADDRESS:PORT during restore")
+	OptionString("metrics-textfile", "", "", "write node_exporter textfile metrics to FILE after restore")
+	OptionString("catalog", "", DEFAULT_CATALOG, "message header catalog database for index and search")
+	OptionString("from", "", "", "select messages with From containing TEXT (search, attachments)")
+	OptionString("to", "", "", "select messages with To or Cc containing TEXT (search, attachments)")
+	OptionString("subject", "", "", "select messages with Subject containing TEXT (search, attachments)")
+	OptionString("message-id", "", "", "search messages by Message-ID")
+	OptionString("until", "", "today", "audit missing days through YYYY-MM-DD, today or yesterday")
+	OptionString("since", "", "", "select messages dated on or after YYYY-MM-DD (search, attachments)")
+	OptionString("before", "", "", "select messages dated before YYYY-MM-DD (search, attachments)")
+	OptionInt("limit", "", 0, "maximum number of search results (0 for no limit)")
+	OptionSwitch("paths", "", "output only the archive paths of search results")
+	OptionSwitch("restore-matches", "", "restore the messages matched by search")
+	OptionSwitch("raw", "", "show the original message bytes")
+	OptionString("attachment-pattern", "", "", "attachment filename or media type select filter (regex)")
+	OptionString("signing-key", "", DEFAULT_SIGNING_KEY, "ed25519 private key file signing ediscovery manifests")
+	OptionString("verify-key", "", "", "ed25519 public key file verifying ediscovery manifests")
+	OptionString("imap-listen", "", "localhost:1143", "serve-imap listen ADDRESS:PORT")
+	OptionString("imap-password", "", "", "serve-imap login password of a single user (generated if empty)")
+	OptionString("imap-passwords", "", "", "serve-imap password FILE of USER:BCRYPT_HASH lines")
+	OptionString("imap-cache", "", DEFAULT_IMAP_CACHE, "serve-imap message cache directory")
+	OptionString("imap-tls-cert", "", "", "serve-imap TLS certificate file")
+	OptionString("imap-tls-key", "", "", "serve-imap TLS private key file")
 }
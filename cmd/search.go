@@ -0,0 +1,151 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var searchCmd = &cobra.Command{
+	Use:   "search [TEXT...]",
+	Short: "search the message header catalog",
+	Long: `
+Query the --catalog database built by the index command. Each TEXT word
+must appear in the Subject, From, To or Cc header; --from, --to,
+--subject, --message-id, --since and --before narrow the search, and
+--archive selects one archive base name. Matches are listed oldest first.
+
+With --paths only the archive paths are written, one per line, for use
+with restore --files-from. With --restore-matches the matching messages
+are restored to the output directory; the matches must be from a single
+archive.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		query, err := SearchQuery(args)
+		cobra.CheckErr(err)
+		catalog, err := OpenCatalog(viper.GetString("catalog"))
+		cobra.CheckErr(err)
+		defer catalog.Close()
+		messages, err := catalog.Search(*query)
+		cobra.CheckErr(err)
+		switch {
+		case viper.GetBool("restore_matches"):
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			err = RestoreMessages(ctx, messages)
+			cobra.CheckErr(err)
+		case viper.GetBool("json"):
+			fmt.Println(FormatJSON(messages))
+		case viper.GetBool("paths"):
+			for _, message := range messages {
+				fmt.Println(message.Path)
+			}
+		default:
+			for _, message := range messages {
+				date := "(no date)"
+				if !message.Date.IsZero() {
+					date = message.Date.Format("2006-01-02 15:04")
+				}
+				fmt.Printf("%s %s %s\n", date, message.Archive, message.Path)
+				fmt.Printf("  From: %s\n", message.From)
+				fmt.Printf("  Subject: %s\n", message.Subject)
+			}
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(searchCmd)
+}
+
+// SearchQuery returns the catalog query selected by the search words and options
+func SearchQuery(words []string) (*CatalogQuery, error) {
+	query := CatalogQuery{
+		Archive:   viper.GetString("archive"),
+		Text:      words,
+		From:      viper.GetString("from"),
+		To:        viper.GetString("to"),
+		Subject:   viper.GetString("subject"),
+		MessageID: viper.GetString("message_id"),
+		Limit:     viper.GetInt("limit"),
+	}
+	var err error
+	if viper.GetString("since") != "" {
+		query.Since, err = ParseDate(viper.GetString("since"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if viper.GetString("before") != "" {
+		query.Before, err = ParseDate(viper.GetString("before"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &query, nil
+}
+
+// RestoreMessages restores cataloged messages of a single archive to the output directory
+func RestoreMessages(ctx context.Context, messages []CatalogMessage) error {
+	if len(messages) == 0 {
+		return fmt.Errorf("no matching messages")
+	}
+	paths := make(map[string][]string)
+	for _, message := range messages {
+		paths[message.Archive] = append(paths[message.Archive], message.Path)
+	}
+	if len(paths) > 1 {
+		archives := []string{}
+		for archive := range paths {
+			archives = append(archives, archive)
+		}
+		sort.Strings(archives)
+		return fmt.Errorf("matches span %d archives %v: select one with --archive", len(archives), archives)
+	}
+	archive := messages[0].Archive
+	tarsnap, err := NewTarsnap(archive)
+	if err != nil {
+		return err
+	}
+	err = tarsnap.SelectFiles(paths[archive])
+	if err != nil {
+		return err
+	}
+	return tarsnap.Restore(ctx)
+}
@@ -0,0 +1,158 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/emersion/go-imap/server"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var serveIMAPCmd = &cobra.Command{
+	Use:   "serve-imap [ARCHIVE_NAME]",
+	Short: "serve an archive as a read-only IMAP server",
+	Long: `
+Serve the maildirs of ARCHIVE_NAME, or the archive selected with --latest
+or --date, as a read-only IMAP4rev1 server listening on --imap-listen.
+
+Each user selected by --user logs in with their user name (user@domain
+with a {domain} path template) and the password given for the user in
+the --imap-passwords file of USER:HASH lines with bcrypt hashes, such as
+written by htpasswd -B. Without a password file exactly one user must be
+selected, who logs in with the --imap-password; if no password is
+configured a random password is generated and logged at startup. The
+user's Maildir folders are the mailboxes, named with the decoded folder
+names and / as the hierarchy separator.
+
+Mailbox listings, flags, sizes and dates come from the archive metadata.
+When a client first reads a message, the messages of its mailbox are
+extracted from the tar stream of the maildir archive and kept in
+--imap-cache; remove the cache directory to reclaim the space.
+
+With --imap-tls-cert and --imap-tls-key the server requires TLS (IMAPS);
+otherwise passwords are sent in the clear, so listen on a loopback
+address or use an SSH tunnel.
+`,
+	Args: cobra.RangeArgs(0, 1),
+	Run: func(cmd *cobra.Command, args []string) {
+		archiveName, err := ArchiveBaseName(args)
+		cobra.CheckErr(err)
+		tarsnap, err := NewTarsnap(archiveName)
+		cobra.CheckErr(err)
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		err = ServeIMAP(ctx, tarsnap)
+		cobra.CheckErr(err)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(serveIMAPCmd)
+}
+
+// ServeIMAP serves the loaded archive metadata over IMAP until ctx is done
+func ServeIMAP(ctx context.Context, tarsnap *Tarsnap) error {
+	cache, err := NewMessageCache(viper.GetString("imap_cache"), tarsnap)
+	if err != nil {
+		return err
+	}
+	var hashes map[string][]byte
+	if viper.GetString("imap_passwords") != "" {
+		hashes, err = ReadIMAPPasswords(viper.GetString("imap_passwords"))
+		if err != nil {
+			return err
+		}
+	}
+	password := viper.GetString("imap_password")
+	if password == "" && hashes == nil && len(tarsnap.Users) == 1 {
+		secret := make([]byte, 12)
+		_, err := rand.Read(secret)
+		if err != nil {
+			return err
+		}
+		password = base64.RawURLEncoding.EncodeToString(secret)
+		tarsnap.logger.Warn("generated imap password", "password", password)
+	}
+
+	backend, err := NewIMAPBackend(tarsnap, cache, password, hashes)
+	if err != nil {
+		return err
+	}
+	s := server.New(backend)
+	s.ErrorLog = log.New(os.Stderr, "imap: ", log.LstdFlags)
+	listen := viper.GetString("imap_listen")
+	var listener net.Listener
+	certFile := viper.GetString("imap_tls_cert")
+	if certFile != "" {
+		certificate, err := tls.LoadX509KeyPair(ExpandPath(certFile), ExpandPath(viper.GetString("imap_tls_key")))
+		if err != nil {
+			return fmt.Errorf("failed loading TLS certificate: %v", err)
+		}
+		s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{certificate}}
+		listener, err = tls.Listen("tcp", listen, s.TLSConfig)
+		if err != nil {
+			return fmt.Errorf("imap listen failed: %v", err)
+		}
+	} else {
+		s.AllowInsecureAuth = true
+		listener, err = net.Listen("tcp", listen)
+		if err != nil {
+			return fmt.Errorf("imap listen failed: %v", err)
+		}
+		host, _, _ := net.SplitHostPort(listen)
+		ip := net.ParseIP(host)
+		if host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			tarsnap.logger.Warn("imap passwords are not encrypted without --imap-tls-cert", "listen", listen)
+		}
+	}
+	tarsnap.logger.Info("serving imap", "listen", listener.Addr().String(), "users", len(tarsnap.Users))
+
+	go func() {
+		<-ctx.Done()
+		s.Close()
+	}()
+	err = s.Serve(listener)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,194 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var showCmd = &cobra.Command{
+	Use:   "show [ARCHIVE_NAME] PATH",
+	Short: "display one archived message",
+	Long: `
+Extract the file PATH from the maildir archive holding it and write the
+message to stdout without restoring it to disk. The archive metadata
+selects the user archive; PATH is an archive path as output by the files
+command.
+
+The Date, From, To, Cc, Subject and Message-ID headers are shown decoded,
+followed by the text body and a list of attachments. With --raw the
+original message is written unchanged. The JSON output includes all
+headers, the text body and the attachment list.
+`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		archiveName, err := ArchiveBaseName(args[:len(args)-1])
+		cobra.CheckErr(err)
+		pathname := ArchivePath(args[len(args)-1])
+		tarsnap, err := NewTarsnap(archiveName)
+		cobra.CheckErr(err)
+		data, err := tarsnap.ExtractFile(pathname)
+		cobra.CheckErr(err)
+		if viper.GetBool("raw") {
+			_, err := os.Stdout.Write(data)
+			cobra.CheckErr(err)
+			return
+		}
+		message, err := ParseMIMEMessage(data)
+		cobra.CheckErr(err)
+		if viper.GetBool("json") {
+			fmt.Println(FormatJSON(NewMessageView(archiveName, pathname, message)))
+		} else {
+			PrintMessage(message)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(showCmd)
+}
+
+var SHOW_HEADERS = []string{"Date", "From", "To", "Cc", "Subject", "Message-Id"}
+
+// MessageView is the JSON output of the show command
+type MessageView struct {
+	Archive     string
+	Path        string
+	Header      map[string][]string
+	Body        string
+	Attachments []AttachmentView
+}
+
+type AttachmentView struct {
+	Part      string
+	Filename  string
+	MediaType string
+	Size      int
+}
+
+func NewMessageView(archive, pathname string, message *MIMEMessage) *MessageView {
+	v := MessageView{
+		Archive:     archive,
+		Path:        pathname,
+		Header:      make(map[string][]string),
+		Body:        message.TextBody(),
+		Attachments: []AttachmentView{},
+	}
+	for key, values := range message.Header {
+		for _, value := range values {
+			v.Header[key] = append(v.Header[key], DecodeHeader(value))
+		}
+	}
+	for _, part := range message.Attachments() {
+		v.Attachments = append(v.Attachments, AttachmentView{part.ID, part.Filename, part.MediaType, len(part.Body)})
+	}
+	return &v
+}
+
+// PrintMessage writes the decoded headers, text body and attachment list of message to stdout
+func PrintMessage(message *MIMEMessage) {
+	for _, key := range SHOW_HEADERS {
+		value := message.Header.Get(key)
+		if value != "" {
+			fmt.Printf("%s: %s\n", key, DecodeHeader(value))
+		}
+	}
+	fmt.Println()
+	body := message.TextBody()
+	if body != "" {
+		fmt.Println(strings.TrimRight(body, "\r\n"))
+	}
+	attachments := message.Attachments()
+	if len(attachments) > 0 {
+		fmt.Printf("\nAttachments:\n")
+		for _, part := range attachments {
+			filename := part.Filename
+			if filename == "" {
+				filename = "(unnamed)"
+			}
+			fmt.Printf("  %s %s %s %d bytes\n", part.ID, filename, part.MediaType, len(part.Body))
+		}
+	}
+}
+
+// FindFile returns the user holding the archive path and its metadata entry
+func (t *Tarsnap) FindFile(pathname string) (*User, *MaildirFile, error) {
+	for _, user := range t.Users {
+		for _, maildir := range user.Maildirs {
+			for _, file := range maildir.Files {
+				if file.Name == pathname {
+					return user, &file, nil
+				}
+			}
+		}
+	}
+	return nil, nil, fmt.Errorf("path not found in %s metadata or not selected by filters: %s", t.Archive, pathname)
+}
+
+// ExtractFile extracts one file from the maildir archive holding it to memory
+// tarsnap stops reading the archive once the file has been extracted.
+func (t *Tarsnap) ExtractFile(pathname string) ([]byte, error) {
+	user, file, err := t.FindFile(pathname)
+	if err != nil {
+		return nil, err
+	}
+	if file.Class == CLASS_DIRECTORY {
+		return nil, fmt.Errorf("path is a directory: %s", pathname)
+	}
+	archiveName := MaildirArchiveName(t.Archive, user.Archive)
+	args := []string{
+		"-x", "-O", "--fast-read",
+		"--keyfile", ExpandPath(viper.GetString("keyfile")),
+		"-f", archiveName,
+		pathname,
+	}
+	if t.verbose {
+		t.logger.Info("extracting file", "tarsnap_archive", archiveName, "file", pathname)
+	}
+	p := NewTarsnapProcess(args)
+	p.logger = t.logger
+	stdout, stderr, err := p.Run()
+	if stderr != "" {
+		t.logger.Warn("tarsnap stderr", "tarsnap_archive", archiveName, "stderr", strings.TrimSpace(stderr))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("extract failed: %v", err)
+	}
+	if int64(len(stdout)) != file.Size {
+		t.logger.Warn("extracted size differs from metadata", "file", pathname, "size", len(stdout), "expected", file.Size)
+	}
+	return []byte(stdout), nil
+}
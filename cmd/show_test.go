@@ -0,0 +1,34 @@
+//go:build unix
+
+package cmd
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractFile(t *testing.T) {
+	// the fake tarsnap writes its command line as the extracted file
+	script := filepath.Join(t.TempDir(), "tarsnap")
+	require.Nil(t, os.WriteFile(script, []byte("#!/bin/sh\necho \"$@\"\n"), 0700))
+	restore := OverrideOptions(map[string]any{"tarsnap_command": script, "keyfile": "tarsnap.key"})
+	defer restore()
+	tarsnap := Tarsnap{Archive: "2025-03-01.mail1", Users: make(map[string]*User), logger: slog.Default()}
+	tarsnap.getUser("alice").getMaildir("INBOX").AddFile("./alice/Maildir/cur/", 0)
+	tarsnap.getUser("alice").getMaildir("INBOX").AddFile("./alice/Maildir/cur/1.M1P1.host:2,S", 100)
+
+	data, err := tarsnap.ExtractFile("./alice/Maildir/cur/1.M1P1.host:2,S")
+	require.Nil(t, err)
+	require.Equal(t, []string{"-x", "-O", "--fast-read", "--keyfile", "tarsnap.key", "-f", MaildirArchiveName("2025-03-01.mail1", "alice"), "./alice/Maildir/cur/1.M1P1.host:2,S"},
+		strings.Fields(string(data)))
+
+	_, err = tarsnap.ExtractFile("./alice/Maildir/cur/")
+	require.NotNil(t, err)
+	_, err = tarsnap.ExtractFile("./alice/Maildir/cur/2.M1P1.host:2,S")
+	require.NotNil(t, err)
+}
@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// DEFAULT_SIGNING_KEY is the default ed25519 key file signing ediscovery manifests
+const DEFAULT_SIGNING_KEY = "~/.tarsnap-maildir-restore/ediscovery.key"
+
+// LoadSigningKey reads a PEM encoded PKCS #8 ed25519 private key
+// If filename does not exist a new key is generated and written to it, with
+// the public key written to filename.pub.
+func LoadSigningKey(filename string) (ed25519.PrivateKey, error) {
+	filename = ExpandPath(filename)
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return generateSigningKey(filename)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed reading signing key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("invalid signing key %s: expected PEM PRIVATE KEY", filename)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key %s: %v", filename, err)
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("invalid signing key %s: not an ed25519 key", filename)
+	}
+	return privateKey, nil
+}
+
+func generateSigningKey(filename string) (ed25519.PrivateKey, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	privateData, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	publicData, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(filepath.Dir(filename), 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating signing key directory: %v", err)
+	}
+	err = os.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateData}), 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed writing signing key: %v", err)
+	}
+	err = os.WriteFile(filename+".pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicData}), 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed writing public key: %v", err)
+	}
+	slog.Warn("generated signing key", "file", filename, "fingerprint", KeyFingerprint(publicKey))
+	return privateKey, nil
+}
+
+// LoadPublicKey reads a PEM encoded PKIX ed25519 public key
+func LoadPublicKey(filename string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(ExpandPath(filename))
+	if err != nil {
+		return nil, fmt.Errorf("failed reading public key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("invalid public key %s: expected PEM PUBLIC KEY", filename)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key %s: %v", filename, err)
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("invalid public key %s: not an ed25519 key", filename)
+	}
+	return publicKey, nil
+}
+
+// KeyFingerprint returns the SHA256:BASE64 fingerprint of a public key
+func KeyFingerprint(publicKey ed25519.PublicKey) string {
+	sum := sha256.Sum256(publicKey)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,432 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/mail"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// streamTarget returns the output path of entry below dir, rejecting targets outside dir
+func streamTarget(dir string, entry *StreamEntry) (string, error) {
+	target := filepath.FromSlash(strings.TrimPrefix(ArchivePath(entry.Target), "./"))
+	if !filepath.IsLocal(target) {
+		return "", fmt.Errorf("invalid target path: %s", entry.Target)
+	}
+	return filepath.Join(dir, target), nil
+}
+
+// FileSink writes entries below an output directory applying the overwrite policy
+// Files are written under a temporary name and renamed when complete; the cur, new
+// and tmp directories of the folder of each message are created.
+// As with the batch restore, a message conflicts with an existing message of the same
+// Maildir unique name in the cur or new directory of its folder.
+type FileSink struct {
+	dir     string
+	policy  OverwritePolicy
+	skipped int
+	folders map[string]map[string]string
+	logger  *slog.Logger
+}
+
+func NewFileSink(dir string, policy OverwritePolicy) *FileSink {
+	return &FileSink{dir: dir, policy: policy, folders: make(map[string]map[string]string), logger: slog.Default()}
+}
+
+// existingMessage returns the path of an existing message with the Maildir unique name of entry
+// in the folder of target; folders are indexed when first written, before any of their messages
+func (s *FileSink) existingMessage(target string, entry *StreamEntry) (string, bool) {
+	if entry.File.Message == nil || !IsMessageFile(target) {
+		return "", false
+	}
+	relative, err := filepath.Rel(s.dir, target)
+	if err != nil {
+		return "", false
+	}
+	folder := path.Dir(path.Dir(ArchivePath(filepath.ToSlash(relative))))
+	uniqueNames, ok := s.folders[folder]
+	if !ok {
+		uniqueNames = indexMessages(s.dir, folder)
+		s.folders[folder] = uniqueNames
+	}
+	existing, ok := uniqueNames[entry.File.Message.Unique]
+	if !ok {
+		return "", false
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(strings.TrimPrefix(existing, "./"))), true
+}
+
+func (s *FileSink) Write(entry *StreamEntry, content io.Reader) (string, error) {
+	target, err := streamTarget(s.dir, entry)
+	if err != nil {
+		return "", err
+	}
+	conflict := target
+	stat, err := os.Lstat(target)
+	existing, found := s.existingMessage(target, entry)
+	if err != nil && found {
+		conflict = existing
+		stat, err = os.Lstat(conflict)
+	}
+	exists := err == nil
+	if exists {
+		switch s.policy {
+		case NO_OVERWRITE:
+			s.skipped += 1
+			return "", nil
+		case KEEP_NEWER:
+			if !stat.ModTime().Before(entry.ModTime) {
+				s.skipped += 1
+				return "", nil
+			}
+		}
+	}
+	dir := filepath.Dir(target)
+	if IsMessageFile(target) {
+		for _, subdir := range MAILDIR_SUBDIRS {
+			err = os.MkdirAll(filepath.Join(filepath.Dir(dir), subdir), 0700)
+			if err != nil {
+				return "", fmt.Errorf("failed creating folder directory: %v", err)
+			}
+		}
+	} else {
+		err = os.MkdirAll(dir, 0700)
+		if err != nil {
+			return "", fmt.Errorf("failed creating directory: %v", err)
+		}
+	}
+	temp, err := s.writeTemp(dir, entry, content)
+	if err != nil {
+		return "", err
+	}
+	replaced := ""
+	if exists {
+		switch {
+		case s.policy == RENAME_CONFLICTS && sameContent(temp, conflict):
+			os.Remove(temp)
+			return "", nil
+		case s.policy == RENAME_CONFLICTS && !IsMessageFile(target):
+			s.logger.Warn("keeping existing file", "file", conflict)
+			os.Remove(temp)
+			return "", nil
+		case s.policy == RENAME_CONFLICTS:
+			target = UniqueMessagePath(target)
+		default:
+			replaced = conflict
+		}
+	}
+	err = os.Rename(temp, target)
+	if err != nil {
+		os.Remove(temp)
+		return "", fmt.Errorf("failed writing %s: %v", target, err)
+	}
+	if replaced != "" && replaced != target {
+		err = os.Remove(replaced)
+		if err != nil {
+			s.logger.Error("failed removing replaced file", "file", replaced, "error", err)
+		}
+	}
+	written, err := filepath.Rel(s.dir, target)
+	if err != nil {
+		return "", err
+	}
+	return ArchivePath(filepath.ToSlash(written)), nil
+}
+
+func (s *FileSink) writeTemp(dir string, entry *StreamEntry, content io.Reader) (string, error) {
+	file, err := os.CreateTemp(dir, ".stream-*")
+	if err != nil {
+		return "", fmt.Errorf("failed creating output file: %v", err)
+	}
+	_, err = io.Copy(file, content)
+	cerr := file.Close()
+	if err == nil {
+		err = cerr
+	}
+	mode := entry.Mode
+	if mode == 0 {
+		mode = 0600
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), mode)
+	}
+	if err == nil && !entry.ModTime.IsZero() {
+		err = os.Chtimes(file.Name(), entry.ModTime, entry.ModTime)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("failed writing %s: %v", entry.Target, err)
+	}
+	return file.Name(), nil
+}
+
+func (s *FileSink) Close() error {
+	if s.skipped > 0 {
+		s.logger.Info("skipped existing files", "files", s.skipped, "policy", s.policy)
+	}
+	return nil
+}
+
+// HashSink computes the SHA-256 of each entry written by the next sink, optionally
+// writing a sha256sum format file of the written paths and verifying entry sizes
+// against the metadata and Maildir ,S= sizes; entries skipped by the next sink are not listed
+type HashSink struct {
+	next       EntrySink
+	filename   string
+	verify     bool
+	lines      []string
+	checked    int
+	mismatched int
+	logger     *slog.Logger
+}
+
+func NewHashSink(next EntrySink, filename string, verify bool) *HashSink {
+	return &HashSink{next: next, filename: filename, verify: verify, lines: []string{}, logger: slog.Default()}
+}
+
+func (s *HashSink) Write(entry *StreamEntry, content io.Reader) (string, error) {
+	hash := sha256.New()
+	counter := &countingWriter{writer: hash}
+	tee := io.TeeReader(content, counter)
+	written, err := s.next.Write(entry, tee)
+	if err != nil || written == "" {
+		return written, err
+	}
+	_, err = io.Copy(io.Discard, tee)
+	if err != nil {
+		return "", err
+	}
+	s.lines = append(s.lines, hex.EncodeToString(hash.Sum(nil))+"  "+strings.TrimPrefix(written, "./"))
+	if s.verify {
+		s.checked += 1
+		file := entry.File
+		switch {
+		case counter.count != file.Size:
+			s.logger.Error("verify: size mismatch", "file", entry.Name, "bytes", counter.count, "expected", file.Size)
+			s.mismatched += 1
+		case file.Message != nil && file.Message.Size > 0 && counter.count != file.Message.Size:
+			s.logger.Error("verify: size attribute mismatch", "file", entry.Name, "bytes", counter.count, "expected", file.Message.Size)
+			s.mismatched += 1
+		}
+	}
+	return written, nil
+}
+
+func (s *HashSink) Close() error {
+	err := s.next.Close()
+	if err != nil {
+		return err
+	}
+	if s.filename != "" {
+		data := strings.Join(s.lines, "\n")
+		if len(s.lines) > 0 {
+			data += "\n"
+		}
+		err := os.WriteFile(s.filename, []byte(data), 0600)
+		if err != nil {
+			return fmt.Errorf("failed writing hash file: %v", err)
+		}
+	}
+	if s.verify {
+		s.logger.Info("verify complete", "files", s.checked, "mismatched", s.mismatched)
+		if s.mismatched > 0 {
+			return fmt.Errorf("verify failed: %d of %d files with size mismatches", s.mismatched, s.checked)
+		}
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	writer io.Writer
+	count  int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.count += int64(n)
+	return n, err
+}
+
+// PathRewriter replaces the leading archive path prefix of each entry target
+// before passing it to the next sink; entries rewritten to an empty prefix are dropped
+//
+//	OLD=NEW[,OLD=NEW...]   the first matching OLD prefix is replaced
+type PathRewriter struct {
+	next  EntrySink
+	rules [][2]string
+}
+
+func NewPathRewriter(next EntrySink, rules string) (*PathRewriter, error) {
+	r := PathRewriter{next: next, rules: [][2]string{}}
+	for _, rule := range strings.Split(rules, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		old, replacement, ok := strings.Cut(rule, "=")
+		old = strings.TrimSpace(old)
+		if !ok || old == "" {
+			return nil, fmt.Errorf("invalid rewrite rule: %s", rule)
+		}
+		replacement = strings.TrimSpace(replacement)
+		if replacement != "" {
+			replacement = ArchivePath(replacement)
+		}
+		r.rules = append(r.rules, [2]string{ArchivePath(old), replacement})
+	}
+	return &r, nil
+}
+
+// Rewrite returns the rewritten target, or false if the target is dropped
+func (r *PathRewriter) Rewrite(target string) (string, bool) {
+	target = ArchivePath(target)
+	for _, rule := range r.rules {
+		old, replacement := rule[0], rule[1]
+		if target != old && !strings.HasPrefix(target, strings.TrimSuffix(old, "/")+"/") {
+			continue
+		}
+		if replacement == "" {
+			return "", false
+		}
+		return strings.TrimSuffix(replacement, "/") + strings.TrimPrefix(target, strings.TrimSuffix(old, "/")), true
+	}
+	return target, true
+}
+
+func (r *PathRewriter) Write(entry *StreamEntry, content io.Reader) (string, error) {
+	target, ok := r.Rewrite(entry.Target)
+	if !ok {
+		return "", nil
+	}
+	rewritten := *entry
+	rewritten.Target = target
+	return r.next.Write(&rewritten, content)
+}
+
+func (r *PathRewriter) Close() error {
+	return r.next.Close()
+}
+
+// MboxSink appends the messages of each folder to OUTPUT/USER/FOLDER.mbox in mboxrd
+// format, quoting body lines starting with any number of > followed by "From "
+// Files other than messages are dropped. The entries of a user are streamed together,
+// so the mbox files of a user are closed when the entries of the next user begin.
+type MboxSink struct {
+	dir     string
+	user    string
+	files   map[string]*os.File
+	written map[string]bool
+	logger  *slog.Logger
+}
+
+func NewMboxSink(dir string) *MboxSink {
+	return &MboxSink{dir: dir, files: make(map[string]*os.File), written: make(map[string]bool), logger: slog.Default()}
+}
+
+// MboxFilename returns the mbox path of the folder of entry relative to the output directory
+func MboxFilename(entry *StreamEntry) string {
+	components := []string{AttachmentFilename(entry.User, "user")}
+	for _, component := range strings.Split(entry.Folder, "/") {
+		components = append(components, AttachmentFilename(component, "folder"))
+	}
+	return filepath.Join(components...) + ".mbox"
+}
+
+// Write appends a message to its mbox, returning the message target
+func (s *MboxSink) Write(entry *StreamEntry, content io.Reader) (string, error) {
+	if entry.File.Class != CLASS_MESSAGE {
+		return "", nil
+	}
+	if entry.User != s.user {
+		err := s.closeFiles()
+		if err != nil {
+			return "", err
+		}
+		s.user = entry.User
+	}
+	filename := filepath.Join(s.dir, MboxFilename(entry))
+	file, ok := s.files[filename]
+	if !ok {
+		err := os.MkdirAll(filepath.Dir(filename), 0700)
+		if err != nil {
+			return "", fmt.Errorf("failed creating mbox directory: %v", err)
+		}
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if s.written[filename] {
+			flags = os.O_WRONLY | os.O_APPEND
+		}
+		file, err = os.OpenFile(filename, flags, 0600)
+		if err != nil {
+			return "", fmt.Errorf("failed creating mbox: %v", err)
+		}
+		s.files[filename] = file
+		s.written[filename] = true
+	}
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return "", err
+	}
+	_, err = file.Write(MboxMessage(data, entry.File.Message, entry.ModTime))
+	if err != nil {
+		return "", fmt.Errorf("failed writing %s: %v", filename, err)
+	}
+	return entry.Target, nil
+}
+
+// closeFiles closes the open mbox files
+func (s *MboxSink) closeFiles() error {
+	var result error
+	for _, filename := range SortedKeys(s.files) {
+		err := s.files[filename].Close()
+		if err != nil && result == nil {
+			result = fmt.Errorf("failed writing %s: %v", filename, err)
+		}
+	}
+	s.files = make(map[string]*os.File)
+	return result
+}
+
+func (s *MboxSink) Close() error {
+	return s.closeFiles()
+}
+
+// MboxMessage returns the mboxrd record of a message: the From_ separator line using the
+// Return-Path sender and the delivery time, the quoted message with LF line endings, and a blank line
+func MboxMessage(data []byte, name *MaildirName, modTime time.Time) []byte {
+	sender := "MAILER-DAEMON"
+	message, err := mail.ReadMessage(bytes.NewReader(data))
+	if err == nil {
+		returnPath := NormalizeMessageID(message.Header.Get("Return-Path"))
+		if returnPath != "" && !strings.ContainsAny(returnPath, " \t") {
+			sender = returnPath
+		}
+	}
+	date := modTime
+	if name != nil && !name.Time.IsZero() {
+		date = name.Time
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From %s %s\n", sender, date.UTC().Format(time.ANSIC))
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), len(data)+1)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			buf.WriteString(">")
+		}
+		buf.WriteString(line)
+		buf.WriteString("\n")
+	}
+	buf.WriteString("\n")
+	return buf.Bytes()
+}
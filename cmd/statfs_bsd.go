@@ -0,0 +1,20 @@
+//go:build darwin || freebsd
+
+package cmd
+
+import "syscall"
+
+const statfsSupported = true
+
+func statfs(path string) (*DiskSpace, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return nil, err
+	}
+	return &DiskSpace{
+		BlockSize:  int64(stat.Bsize),
+		FreeBytes:  int64(stat.Bavail) * int64(stat.Bsize),
+		FreeInodes: int64(stat.Ffree),
+	}, nil
+}
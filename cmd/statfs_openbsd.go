@@ -0,0 +1,18 @@
+package cmd
+
+import "syscall"
+
+const statfsSupported = true
+
+func statfs(path string) (*DiskSpace, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return nil, err
+	}
+	return &DiskSpace{
+		BlockSize:  int64(stat.F_bsize),
+		FreeBytes:  stat.F_bavail * int64(stat.F_bsize),
+		FreeInodes: stat.F_favail,
+	}, nil
+}
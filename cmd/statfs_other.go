@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !freebsd && !openbsd
+
+package cmd
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// statfsSupported is false where the free space checks are skipped
+const statfsSupported = false
+
+func statfs(path string) (*DiskSpace, error) {
+	return nil, fmt.Errorf("filesystem space check not supported on %s", runtime.GOOS)
+}
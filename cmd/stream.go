@@ -0,0 +1,409 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+	"github.com/spf13/viper"
+)
+
+// StreamEntry is a selected file read from the tar stream of a maildir archive
+type StreamEntry struct {
+	// Name is the archive path; Target is the output path, initially Name, which sinks may rewrite
+	Name    string
+	Target  string
+	User    string
+	Maildir string
+	// Folder is the display name of the maildir
+	Folder string
+	File   MaildirFile
+	// Size is the size of the archived content
+	Size    int64
+	ModTime time.Time
+	Mode    os.FileMode
+}
+
+// EntrySink consumes the entries of a stream restore
+// Write is called once per entry and must not retain content after returning; it returns
+// the target path written, or an empty path if the entry was skipped.
+// Close is called once after the last entry, also when the restore fails.
+type EntrySink interface {
+	Write(entry *StreamEntry, content io.Reader) (string, error)
+	Close() error
+}
+
+// streamSelection is the set of files selected from one maildir archive
+type streamSelection struct {
+	archive string
+	user    string
+	files   map[string]*StreamEntry
+}
+
+// StreamRestore extracts the selected files by reading each maildir archive as a tar stream
+// from tarsnap -r and passing the selected entries to sink, reporting progress in bytes written.
+// tarsnap reads an archive from its start; reading stops as soon as every selected file of the archive has been seen.
+func (t *Tarsnap) StreamRestore(ctx context.Context, sink EntrySink) error {
+	selections := []*streamSelection{}
+	var total int64
+	for _, userName := range SortedKeys(t.Users) {
+		user := t.Users[userName]
+		selection := streamSelection{archive: MaildirArchiveName(t.Archive, user.Archive), user: userName, files: make(map[string]*StreamEntry)}
+		for maildirName, maildir := range user.Maildirs {
+			for _, file := range maildir.Files {
+				if file.Class == CLASS_DIRECTORY {
+					continue
+				}
+				selection.files[file.Name] = &StreamEntry{Name: file.Name, Target: file.Name, User: userName, Maildir: maildirName, Folder: maildir.DisplayName, File: file}
+				total += file.Size
+			}
+		}
+		if len(selection.files) > 0 {
+			selections = append(selections, &selection)
+		}
+	}
+
+	var bar *progressbar.ProgressBar
+	if !viper.GetBool("no_progress") {
+		bar = progressbar.DefaultBytes(total, "restore")
+	}
+	var written atomic.Int64
+	progress := func(n int) {
+		written.Add(int64(n))
+		if bar != nil {
+			bar.Add(n)
+		}
+	}
+
+	var err error
+	for _, selection := range selections {
+		err = t.streamArchive(ctx, selection, sink, progress)
+		if err != nil {
+			break
+		}
+	}
+	if bar != nil {
+		bar.Finish()
+	}
+	cerr := sink.Close()
+	if err == nil {
+		err = cerr
+	}
+	if t.verbose {
+		t.logger.Info("stream restore complete", "archives", len(selections), "bytes", written.Load(), "expected", total)
+	}
+	return err
+}
+
+// streamArchive passes the selected files of one maildir archive to sink
+// Hard linked files are resolved by a second pass reading the content of their link targets.
+func (t *Tarsnap) streamArchive(ctx context.Context, selection *streamSelection, sink EntrySink, progress func(int)) error {
+	logger := t.logger.With("tarsnap_archive", selection.archive, "user", selection.user)
+	if t.verbose {
+		logger.Info("streaming archive", "files", len(selection.files))
+	}
+	links := make(map[string][]*StreamEntry)
+	err := t.readArchive(ctx, logger, selection.archive, selection.files, links, sink, progress)
+	if err != nil || len(links) == 0 {
+		return err
+	}
+	targets := make(map[string]*StreamEntry)
+	for name := range links {
+		targets[name] = &StreamEntry{Name: name, Target: name}
+	}
+	if t.verbose {
+		logger.Info("streaming hard link targets", "files", len(targets))
+	}
+	return t.readArchive(ctx, logger, selection.archive, targets, nil, &linkSink{links: links, next: sink, progress: progress}, nil)
+}
+
+// readArchive reads the tar stream of archive from tarsnap -r, passing the entries in selected to sink
+func (t *Tarsnap) readArchive(ctx context.Context, logger *slog.Logger, archive string, selected map[string]*StreamEntry, links map[string][]*StreamEntry, sink EntrySink, progress func(int)) error {
+	prefix, err := PriorityPrefix()
+	if err != nil {
+		return err
+	}
+	var rate int64
+	if viper.GetString("maxbw_rate") != "" {
+		rate, err = ParseSize(viper.GetString("maxbw_rate"))
+		if err != nil {
+			return fmt.Errorf("invalid maxbw_rate: %v", err)
+		}
+	}
+	cmd := NewRestoreCommand(prefix, rate, []string{"-r", "--keyfile", ExpandPath(viper.GetString("keyfile")), "-f", archive})
+	stderr := newLineWriter(func(line string) {
+		logger.Warn("tarsnap stderr", "stderr", line)
+	})
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("failed starting tarsnap: %v", err)
+	}
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cmd.Process.Kill()
+		case <-stopped:
+		}
+	}()
+
+	readErr := ReadTarStream(stdout, selected, links, sink, progress)
+	if t.debug {
+		logger.Debug("tar stream finished", "remaining", len(selected))
+	}
+
+	complete := len(selected) == 0
+	if complete || readErr != nil {
+		// the remaining archive is not needed
+		cmd.Process.Kill()
+	}
+	err = cmd.Wait()
+	stderr.Flush()
+	switch {
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case readErr != nil:
+		return readErr
+	case err != nil && !complete:
+		return fmt.Errorf("tarsnap failed: %v", err)
+	case !complete:
+		for name := range selected {
+			logger.Warn("file not found in archive", "file", name)
+		}
+		return fmt.Errorf("%d selected files not found in %s", len(selected), archive)
+	}
+	return nil
+}
+
+// ReadTarStream passes the regular files of a tar stream present in selected to sink,
+// removing each from selected; it returns at the end of the stream or when selected is empty
+// Selected hard links are removed from selected and added to links under their link target,
+// whose content precedes them in the stream; if links is nil, hard links are not matched.
+func ReadTarStream(input io.Reader, selected map[string]*StreamEntry, links map[string][]*StreamEntry, sink EntrySink, progress func(int)) error {
+	reader := tar.NewReader(input)
+	for len(selected) > 0 {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed reading tar stream: %v", err)
+		}
+		if header.Typeflag != tar.TypeReg && (header.Typeflag != tar.TypeLink || links == nil) {
+			continue
+		}
+		entry, ok := selected[ArchivePath(header.Name)]
+		if !ok {
+			continue
+		}
+		delete(selected, entry.Name)
+		entry.Size = header.Size
+		entry.ModTime = header.ModTime
+		entry.Mode = os.FileMode(header.Mode).Perm()
+		if header.Typeflag == tar.TypeLink {
+			target := ArchivePath(header.Linkname)
+			links[target] = append(links[target], entry)
+			continue
+		}
+		var content io.Reader = reader
+		if progress != nil {
+			content = &progressReader{reader: reader, progress: progress}
+		}
+		_, err = sink.Write(entry, content)
+		if err != nil {
+			return err
+		}
+		// count the content of entries skipped by the sink
+		_, err = io.Copy(io.Discard, content)
+		if err != nil {
+			return fmt.Errorf("failed reading tar stream: %v", err)
+		}
+	}
+	return nil
+}
+
+// linkSink writes the content of each link target to next once for every hard link to it
+type linkSink struct {
+	links    map[string][]*StreamEntry
+	next     EntrySink
+	progress func(int)
+}
+
+func (s *linkSink) Write(target *StreamEntry, content io.Reader) (string, error) {
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return "", fmt.Errorf("failed reading tar stream: %v", err)
+	}
+	for _, entry := range s.links[target.Name] {
+		if s.progress != nil {
+			s.progress(int(entry.File.Size))
+		}
+		entry.Size = int64(len(data))
+		if entry.File.Size == 0 {
+			// archive listings report hard links with size 0
+			entry.File.Size = entry.Size
+		}
+		_, err := s.next.Write(entry, bytes.NewReader(data))
+		if err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// Close does not close next, which is closed by the stream restore
+func (s *linkSink) Close() error {
+	return nil
+}
+
+// progressReader reports the bytes read through it
+type progressReader struct {
+	reader   io.Reader
+	progress func(int)
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.progress(n)
+	}
+	return n, err
+}
+
+// RestoreStream streams the selected files into the output directory through the sinks selected by
+// the restore options, holding the output directory lock for the duration
+func (t *Tarsnap) RestoreStream(ctx context.Context) error {
+	unlock, err := t.lockOutputDir()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	sink, err := NewStreamSink(t.destDir)
+	if err != nil {
+		return err
+	}
+	restores, err := t.streamRestores(t.destDir)
+	if err != nil {
+		return err
+	}
+	return t.guardedRestore(ctx, restores, sink)
+}
+
+// streamRestores returns the restore set accounting a stream restore into outputDir after the
+// space preflight of the selected files; an empty outputDir, such as stdout, skips the space checks
+func (t *Tarsnap) streamRestores(outputDir string) (*ProcessSet, error) {
+	restores, err := NewProcessSet(t.Archive)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range t.MaildirFiles() {
+		if file.Class != CLASS_DIRECTORY {
+			restores.files = append(restores.files, file)
+		}
+	}
+	if outputDir == "" {
+		restores.skipSpaceCheck = true
+	} else {
+		restores.outputDir = outputDir
+	}
+	err = restores.Preflight()
+	if err != nil {
+		return nil, err
+	}
+	return restores, nil
+}
+
+// guardedRestore is StreamRestore pausing between entries while free space on the output
+// filesystem is below the reserve, and recording the restore metrics of restores
+func (t *Tarsnap) guardedRestore(ctx context.Context, restores *ProcessSet, sink EntrySink) error {
+	guard := &spaceGuard{ctx: ctx, restores: restores, next: sink}
+	restores.metrics.PlanStream(restores.files)
+	restores.metrics.Start()
+	err := t.StreamRestore(ctx, guard)
+	restores.metrics.SetRestored(guard.files, guard.bytes)
+	merr := restores.metrics.Finish()
+	if err == nil {
+		err = merr
+	}
+	return err
+}
+
+// spaceGuard waits for free space above the reserve before passing each entry to next
+// and counts the files written
+type spaceGuard struct {
+	ctx      context.Context
+	restores *ProcessSet
+	next     EntrySink
+	files    int64
+	bytes    int64
+}
+
+func (s *spaceGuard) Write(entry *StreamEntry, content io.Reader) (string, error) {
+	if !s.restores.waitForSpace(s.ctx) {
+		return "", s.ctx.Err()
+	}
+	written, err := s.next.Write(entry, content)
+	if err != nil || written == "" {
+		return written, err
+	}
+	s.files += 1
+	s.bytes += entry.Size
+	s.restores.metrics.SetRestored(s.files, s.bytes)
+	return written, nil
+}
+
+func (s *spaceGuard) Close() error {
+	return s.next.Close()
+}
+
+// NewStreamSink returns the sink chain selected by the restore options writing to outputDir:
+// the --mbox writer or the filesystem, wrapped by StreamFilters
+func NewStreamSink(outputDir string) (EntrySink, error) {
+	policy, err := OverwritePolicyOption()
+	if err != nil {
+		return nil, err
+	}
+	if viper.GetBool("mbox") {
+		if policy != OVERWRITE {
+			return nil, fmt.Errorf("--mbox replaces existing mbox files and cannot be combined with --%s", policy)
+		}
+		return StreamFilters(NewMboxSink(outputDir))
+	}
+	return StreamFilters(NewFileSink(outputDir, policy))
+}
+
+// StreamFilters wraps sink with the filters selected by the restore options, applied in order:
+// the --output-layout folder layout, the --rewrite path rewriter, and the --hash-file and --verify hash verifier
+func StreamFilters(sink EntrySink) (EntrySink, error) {
+	if viper.GetString("hash_file") != "" || viper.GetBool("verify") {
+		sink = NewHashSink(sink, ExpandPath(viper.GetString("hash_file")), viper.GetBool("verify"))
+	}
+	if viper.GetString("rewrite") != "" {
+		rewriter, err := NewPathRewriter(sink, viper.GetString("rewrite"))
+		if err != nil {
+			return nil, err
+		}
+		sink = rewriter
+	}
+	switch viper.GetString("output_layout") {
+	case "", OUTPUT_LAYOUT_MAILDIR:
+	case OUTPUT_LAYOUT_FOLDERS:
+		sink = &FolderLayout{next: sink}
+	default:
+		return nil, fmt.Errorf("unknown output layout: %s", viper.GetString("output_layout"))
+	}
+	return sink, nil
+}
@@ -0,0 +1,286 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func streamTestArchive(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	writer := tar.NewWriter(&buf)
+	require.Nil(t, writer.WriteHeader(&tar.Header{Name: "alice/Maildir/", Typeflag: tar.TypeDir, Mode: 0700}))
+	for _, name := range SortedKeys(files) {
+		header := tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0640, Size: int64(len(files[name])), ModTime: time.Date(2024, 4, 1, 10, 0, 0, 0, time.UTC)}
+		require.Nil(t, writer.WriteHeader(&header))
+		_, err := writer.Write([]byte(files[name]))
+		require.Nil(t, err)
+	}
+	require.Nil(t, writer.Close())
+	return buf.Bytes()
+}
+
+func streamTestSelection(files map[string]string, names ...string) map[string]*StreamEntry {
+	selected := make(map[string]*StreamEntry)
+	for _, name := range names {
+		m := Maildir{}
+		m.AddFile(ArchivePath(name), int64(len(files[name])))
+		file := m.Files[0]
+		selected[file.Name] = &StreamEntry{Name: file.Name, Target: file.Name, User: "alice", Maildir: "INBOX", Folder: "INBOX", File: file}
+	}
+	return selected
+}
+
+func TestReadTarStream(t *testing.T) {
+	files := map[string]string{
+		"alice/Maildir/cur/1.M1P1.host,S=6:2,S": "hello\n",
+		"alice/Maildir/cur/2.M1P1.host,S=9:2,S": "unused\n",
+		"alice/Maildir/dovecot-uidlist":         "3 V1 N3\n",
+	}
+	outputDir := t.TempDir()
+	hashFile := filepath.Join(t.TempDir(), "sha256")
+	selected := streamTestSelection(files, "alice/Maildir/cur/1.M1P1.host,S=6:2,S", "alice/Maildir/dovecot-uidlist")
+	sink, err := NewPathRewriter(NewHashSink(NewFileSink(outputDir, OVERWRITE), hashFile, true), "alice/Maildir=bob/Maildir")
+	require.Nil(t, err)
+	var progress int
+	err = ReadTarStream(bytes.NewReader(streamTestArchive(t, files)), selected, nil, sink, func(n int) { progress += n })
+	require.Nil(t, err)
+	require.Empty(t, selected)
+	require.Nil(t, sink.Close())
+	require.Equal(t, 14, progress)
+
+	target := filepath.Join(outputDir, "bob", "Maildir", "cur", "1.M1P1.host,S=6:2,S")
+	data, err := os.ReadFile(target)
+	require.Nil(t, err)
+	require.Equal(t, "hello\n", string(data))
+	stat, err := os.Stat(target)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0640), stat.Mode().Perm())
+	require.True(t, stat.ModTime().Equal(time.Date(2024, 4, 1, 10, 0, 0, 0, time.UTC)))
+	require.True(t, IsDir(filepath.Join(outputDir, "bob", "Maildir", "new")))
+	require.False(t, IsFile(filepath.Join(outputDir, "bob", "Maildir", "cur", "2.M1P1.host,S=9:2,S")))
+
+	hashes, err := os.ReadFile(hashFile)
+	require.Nil(t, err)
+	require.Equal(t, fmt.Sprintf("%x  bob/Maildir/cur/1.M1P1.host,S=6:2,S\n%x  bob/Maildir/dovecot-uidlist\n",
+		sha256.Sum256([]byte("hello\n")), sha256.Sum256([]byte("3 V1 N3\n"))), string(hashes))
+
+	// the size attribute does not match the content
+	selected = streamTestSelection(files, "alice/Maildir/cur/2.M1P1.host,S=9:2,S")
+	hashSink := NewHashSink(NewFileSink(outputDir, OVERWRITE), "", true)
+	require.Nil(t, ReadTarStream(bytes.NewReader(streamTestArchive(t, files)), selected, nil, hashSink, nil))
+	require.NotNil(t, hashSink.Close())
+
+	// missing files remain selected
+	selected = streamTestSelection(files, "alice/Maildir/cur/3.M1P1.host:2,S")
+	require.Nil(t, ReadTarStream(bytes.NewReader(streamTestArchive(t, files)), selected, nil, NewFileSink(outputDir, OVERWRITE), nil))
+	require.Len(t, selected, 1)
+}
+
+func TestReadTarStreamLinks(t *testing.T) {
+	files := map[string]string{
+		"alice/Maildir/cur/1.M1P1.host:2,S":       "hello\n",
+		"alice/Maildir/.Sent/cur/1.M1P1.host:2,S": "",
+	}
+	var buf bytes.Buffer
+	writer := tar.NewWriter(&buf)
+	modTime := time.Date(2024, 4, 1, 10, 0, 0, 0, time.UTC)
+	require.Nil(t, writer.WriteHeader(&tar.Header{Name: "alice/Maildir/cur/1.M1P1.host:2,S", Typeflag: tar.TypeReg, Mode: 0600, Size: 6, ModTime: modTime}))
+	_, err := writer.Write([]byte("hello\n"))
+	require.Nil(t, err)
+	require.Nil(t, writer.WriteHeader(&tar.Header{Name: "alice/Maildir/.Sent/cur/1.M1P1.host:2,S", Typeflag: tar.TypeLink, Linkname: "alice/Maildir/cur/1.M1P1.host:2,S", Mode: 0600, ModTime: modTime}))
+	require.Nil(t, writer.Close())
+
+	// the link target is not selected, so its content is read by a second pass
+	outputDir := t.TempDir()
+	sink := NewHashSink(NewFileSink(outputDir, OVERWRITE), "", true)
+	selected := streamTestSelection(files, "alice/Maildir/.Sent/cur/1.M1P1.host:2,S")
+	links := make(map[string][]*StreamEntry)
+	require.Nil(t, ReadTarStream(bytes.NewReader(buf.Bytes()), selected, links, sink, nil))
+	require.Empty(t, selected)
+	require.Len(t, links["./alice/Maildir/cur/1.M1P1.host:2,S"], 1)
+	require.False(t, IsFile(filepath.Join(outputDir, "alice", "Maildir", ".Sent", "cur", "1.M1P1.host:2,S")))
+
+	targets := map[string]*StreamEntry{"./alice/Maildir/cur/1.M1P1.host:2,S": {Name: "./alice/Maildir/cur/1.M1P1.host:2,S"}}
+	require.Nil(t, ReadTarStream(bytes.NewReader(buf.Bytes()), targets, nil, &linkSink{links: links, next: sink}, nil))
+	require.Empty(t, targets)
+	require.Nil(t, sink.Close())
+	data, err := os.ReadFile(filepath.Join(outputDir, "alice", "Maildir", ".Sent", "cur", "1.M1P1.host:2,S"))
+	require.Nil(t, err)
+	require.Equal(t, "hello\n", string(data))
+	require.False(t, IsFile(filepath.Join(outputDir, "alice", "Maildir", "cur", "1.M1P1.host:2,S")))
+
+	// without a links map, hard links are not matched
+	selected = streamTestSelection(files, "alice/Maildir/.Sent/cur/1.M1P1.host:2,S")
+	require.Nil(t, ReadTarStream(bytes.NewReader(buf.Bytes()), selected, nil, NewFileSink(t.TempDir(), OVERWRITE), nil))
+	require.Len(t, selected, 1)
+}
+
+func TestFileSinkPolicy(t *testing.T) {
+	outputDir := t.TempDir()
+	name := "./alice/Maildir/cur/1.M1P1.host:2,S"
+	m := Maildir{}
+	m.AddFile(name, 4)
+	entry := StreamEntry{Name: name, Target: name, File: m.Files[0], ModTime: time.Date(2024, 4, 1, 10, 0, 0, 0, time.UTC)}
+	target := filepath.Join(outputDir, "alice", "Maildir", "cur", "1.M1P1.host:2,S")
+
+	written, err := NewFileSink(outputDir, OVERWRITE).Write(&entry, strings.NewReader("old\n"))
+	require.Nil(t, err)
+	require.Equal(t, name, written)
+	written, err = NewFileSink(outputDir, NO_OVERWRITE).Write(&entry, strings.NewReader("new\n"))
+	require.Nil(t, err)
+	require.Empty(t, written)
+	data, _ := os.ReadFile(target)
+	require.Equal(t, "old\n", string(data))
+
+	written, err = NewFileSink(outputDir, RENAME_CONFLICTS).Write(&entry, strings.NewReader("old\n"))
+	require.Nil(t, err)
+	require.Empty(t, written)
+	written, err = NewFileSink(outputDir, RENAME_CONFLICTS).Write(&entry, strings.NewReader("new\n"))
+	require.Nil(t, err)
+	require.NotEqual(t, name, written)
+	data, _ = os.ReadFile(filepath.Join(outputDir, filepath.FromSlash(written)))
+	require.Equal(t, "new\n", string(data))
+	entries, err := os.ReadDir(filepath.Dir(target))
+	require.Nil(t, err)
+	require.Len(t, entries, 2)
+
+	_, err = NewFileSink(outputDir, OVERWRITE).Write(&entry, strings.NewReader("new\n"))
+	require.Nil(t, err)
+	data, _ = os.ReadFile(target)
+	require.Equal(t, "new\n", string(data))
+
+	escape := entry
+	escape.Target = "./alice/../../escape"
+	_, err = NewFileSink(outputDir, OVERWRITE).Write(&escape, strings.NewReader("x"))
+	require.NotNil(t, err)
+}
+
+func TestFileSinkUniqueName(t *testing.T) {
+	outputDir := t.TempDir()
+	name := "./alice/Maildir/cur/1.M1P1.host:2,S"
+	m := Maildir{}
+	m.AddFile(name, 4)
+	entry := StreamEntry{Name: name, Target: name, File: m.Files[0], ModTime: time.Date(2024, 4, 1, 10, 0, 0, 0, time.UTC)}
+	target := filepath.Join(outputDir, "alice", "Maildir", "cur", "1.M1P1.host:2,S")
+	// the message was in new without flags when the output directory was written
+	existing := filepath.Join(outputDir, "alice", "Maildir", "new", "1.M1P1.host")
+	require.Nil(t, os.MkdirAll(filepath.Dir(existing), 0700))
+	require.Nil(t, os.WriteFile(existing, []byte("old\n"), 0600))
+
+	written, err := NewFileSink(outputDir, NO_OVERWRITE).Write(&entry, strings.NewReader("new\n"))
+	require.Nil(t, err)
+	require.Empty(t, written)
+	require.False(t, IsFile(target))
+
+	written, err = NewFileSink(outputDir, RENAME_CONFLICTS).Write(&entry, strings.NewReader("old\n"))
+	require.Nil(t, err)
+	require.Empty(t, written)
+	require.False(t, IsFile(target))
+
+	written, err = NewFileSink(outputDir, OVERWRITE).Write(&entry, strings.NewReader("new\n"))
+	require.Nil(t, err)
+	require.Equal(t, name, written)
+	data, _ := os.ReadFile(target)
+	require.Equal(t, "new\n", string(data))
+	require.False(t, IsFile(existing))
+}
+
+func TestStreamSinkMboxPolicy(t *testing.T) {
+	defer OverrideOptions(map[string]any{"mbox": true, "overwrite": false, "no_overwrite": true, "keep_newer": false, "rename_conflicts": false})()
+	_, err := NewStreamSink(t.TempDir())
+	require.ErrorContains(t, err, "--no-overwrite")
+}
+
+func TestHashSinkWritten(t *testing.T) {
+	outputDir := t.TempDir()
+	hashFile := filepath.Join(t.TempDir(), "sha256")
+	name := "./alice/Maildir/cur/1.M1P1.host:2,S"
+	m := Maildir{}
+	m.AddFile(name, 4)
+	entry := StreamEntry{Name: name, Target: name, File: m.Files[0], ModTime: time.Date(2024, 4, 1, 10, 0, 0, 0, time.UTC)}
+	_, err := NewFileSink(outputDir, OVERWRITE).Write(&entry, strings.NewReader("old\n"))
+	require.Nil(t, err)
+
+	// skipped entries are not hashed
+	sink := NewHashSink(NewFileSink(outputDir, NO_OVERWRITE), hashFile, false)
+	written, err := sink.Write(&entry, strings.NewReader("new\n"))
+	require.Nil(t, err)
+	require.Empty(t, written)
+	require.Nil(t, sink.Close())
+	hashes, err := os.ReadFile(hashFile)
+	require.Nil(t, err)
+	require.Empty(t, hashes)
+
+	// renamed entries are hashed under the written path
+	sink = NewHashSink(NewFileSink(outputDir, RENAME_CONFLICTS), hashFile, false)
+	written, err = sink.Write(&entry, strings.NewReader("new\n"))
+	require.Nil(t, err)
+	require.NotEqual(t, name, written)
+	require.Nil(t, sink.Close())
+	hashes, err = os.ReadFile(hashFile)
+	require.Nil(t, err)
+	require.Equal(t, fmt.Sprintf("%x  %s\n", sha256.Sum256([]byte("new\n")), strings.TrimPrefix(written, "./")), string(hashes))
+}
+
+func TestPathRewriter(t *testing.T) {
+	r, err := NewPathRewriter(nil, "alice/Maildir/.Trash=, ./alice/Maildir=/carol/Maildir")
+	require.Nil(t, err)
+	target, ok := r.Rewrite("./alice/Maildir/.Trash/cur/1:2,S")
+	require.False(t, ok)
+	target, ok = r.Rewrite("./alice/Maildir/cur/1:2,S")
+	require.True(t, ok)
+	require.Equal(t, "./carol/Maildir/cur/1:2,S", target)
+	target, ok = r.Rewrite("./alice/Maildirs/cur/1:2,S")
+	require.True(t, ok)
+	require.Equal(t, "./alice/Maildirs/cur/1:2,S", target)
+	_, err = NewPathRewriter(nil, "alice")
+	require.NotNil(t, err)
+}
+
+func TestMboxMessage(t *testing.T) {
+	name, err := ParseMaildirName("1711965600.M1P1.host:2,S")
+	require.Nil(t, err)
+	message := "Return-Path: <alice@example.org>\r\nSubject: test\r\n\r\nFrom here\r\n>From there\r\nend\r\n"
+	require.Equal(t, "From alice@example.org Mon Apr  1 10:00:00 2024\n"+
+		"Return-Path: <alice@example.org>\nSubject: test\n\n>From here\n>>From there\nend\n\n",
+		string(MboxMessage([]byte(message), name, time.Time{})))
+	entry := StreamEntry{User: "alice@example.org", Folder: "Archive/2024"}
+	require.Equal(t, filepath.Join("alice@example.org", "Archive", "2024.mbox"), MboxFilename(&entry))
+}
+
+func TestMboxSinkUsers(t *testing.T) {
+	outputDir := t.TempDir()
+	sink := NewMboxSink(outputDir)
+	write := func(user, filename string) {
+		m := Maildir{}
+		m.AddFile("./"+user+"/Maildir/cur/"+filename, 6)
+		entry := StreamEntry{Name: m.Files[0].Name, Target: m.Files[0].Name, User: user, Maildir: "INBOX", Folder: "INBOX", File: m.Files[0]}
+		written, err := sink.Write(&entry, strings.NewReader("Subject: "+filename+"\n\nhello\n"))
+		require.Nil(t, err)
+		require.Equal(t, entry.Target, written)
+	}
+	write("alice", "1.M1P1.host:2,S")
+	write("alice", "2.M1P1.host:2,S")
+	require.Len(t, sink.files, 1)
+	// the mbox files of alice are closed when the entries of bob begin
+	write("bob", "1.M1P1.host:2,S")
+	require.Len(t, sink.files, 1)
+	require.Equal(t, "bob", sink.user)
+	// a closed mbox is appended to, not replaced
+	write("alice", "3.M1P1.host:2,S")
+	require.Nil(t, sink.Close())
+	require.Empty(t, sink.files)
+
+	data, err := os.ReadFile(filepath.Join(outputDir, "alice", "INBOX.mbox"))
+	require.Nil(t, err)
+	require.Equal(t, 3, strings.Count(string(data), "\nSubject: "))
+}
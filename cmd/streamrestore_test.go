@@ -0,0 +1,63 @@
+//go:build unix
+
+package cmd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestoreStreamSpaceMetrics(t *testing.T) {
+	src := t.TempDir()
+	name := "./alice/Maildir/cur/1.M1P1.host,S=6:2,S"
+	require.Nil(t, os.MkdirAll(filepath.Join(src, filepath.Dir(name)), 0700))
+	require.Nil(t, os.WriteFile(filepath.Join(src, name), []byte("hello\n"), 0600))
+	metadataDir := t.TempDir()
+	require.Nil(t, os.WriteFile(filepath.Join(metadataDir, "2025-06-25.mailbox.alice.file_list"),
+		[]byte("-rw------- 1 alice alice 6 Jun 25 10:00 "+name+"\n"), 0600))
+
+	// the fake tarsnap -r writes the tar stream of the source directory
+	script := fakeTarsnap(t, `cd `+src+` && exec tar -cf - ./alice`)
+	textfile := filepath.Join(t.TempDir(), "restore.prom")
+	s := newTestProcessSet(t, script, map[string]any{
+		"metadata_dir":     metadataDir,
+		"dryrun":           false,
+		"stream":           true,
+		"mbox":             false,
+		"rewrite":          "",
+		"hash_file":        "",
+		"verify":           false,
+		"output_layout":    "",
+		"maildir":          ".*",
+		"filter":           "",
+		"files_from":       "",
+		"user":             ".*",
+		"skip_space_check": false,
+		"space_reserve":    "1000T",
+		"metrics_textfile": textfile,
+	})
+	// the message was delivered to new before its flags changed
+	existing := filepath.Join(s.outputDir, "alice", "Maildir", "new", "1.M1P1.host,S=6")
+	require.Nil(t, os.MkdirAll(filepath.Dir(existing), 0700))
+	require.Nil(t, os.WriteFile(existing, []byte("hello\n"), 0600))
+
+	tarsnap, err := NewTarsnap("2025-06-25.mailbox")
+	require.Nil(t, err)
+	err = tarsnap.RestoreStream(context.Background())
+	require.ErrorContains(t, err, "insufficient disk space")
+	require.False(t, IsFile(textfile))
+
+	defer OverrideOptions(map[string]any{"space_reserve": "0"})()
+	require.Nil(t, tarsnap.RestoreStream(context.Background()))
+	require.True(t, IsFile(filepath.Join(s.outputDir, filepath.FromSlash(name))))
+	require.False(t, IsFile(existing))
+	data, err := os.ReadFile(textfile)
+	require.Nil(t, err)
+	require.Contains(t, string(data), `tarsnap_restore_files_planned{archive="2025-06-25.mailbox"} 1`)
+	require.Contains(t, string(data), `tarsnap_restore_files_restored{archive="2025-06-25.mailbox"} 1`)
+	require.Contains(t, string(data), `tarsnap_restore_bytes_restored{archive="2025-06-25.mailbox"} 6`)
+}
@@ -33,11 +33,13 @@ package cmd
 
 import (
 	"bufio"
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -48,10 +50,10 @@ const CMD_LENGTH_BUFFER = 2048
 const CMD_LENGTH_MIN = 8192
 const CMD_LENGTH_LIMIT = 32767
 
-var LIST_FILENAME_PATTERN = regexp.MustCompile(`^\d{4}(?:-\d{2}){2}\.[^.]+\.([^.]+)\.file_list$`)
+const LIST_FILENAME_SUFFIX = ".file_list"
+
+var LIST_FILENAME_PATTERN = regexp.MustCompile(`^\d{4}(?:-\d{2}){2}\.[^.]+\.(.+)\.file_list$`)
 var FILE_LIST_PATTERN = regexp.MustCompile(`^(?:\S+\s+){4}(\d+)\s+[^.]+(\..+)$`)
-var USER_PATTERN = regexp.MustCompile(`^\./([^/]+)/Maildir/.*`)
-var MAILDIR_PATTERN = regexp.MustCompile(`^\./[^/]+/Maildir/([^/]+).*$`)
 
 //var CUR_PATTERN = regexp.MustCompile(`^\./[^/]+/Maildir(/[^/]+){0,1}/cur$`)
 //var CUR_NEW_TMP_PATTERN = regexp.MustCompile(`^\./[^/]+/Maildir(/[^/]+){0,1}/(cur|new|tmp)$`)
@@ -67,19 +69,43 @@ var MAILDIR_PATTERN = regexp.MustCompile(`^\./[^/]+/Maildir/([^/]+).*$`)
 //var TMP_MESSAGE_PATTERN = regexp.MustCompile(`^\./[^/]+/Maildir(/[^/]+){0,1}/tmp/.+$`)
 
 type MaildirFile struct {
-	Name string
-	Size int64
+	Name    string
+	Size    int64
+	Class   MaildirClass
+	Message *MaildirName `json:",omitempty"`
 }
 
+// Maildir is a folder of a user's mailbox; Name is the folder name as archived
+// and DisplayName the decoded folder path
 type Maildir struct {
-	Files []MaildirFile
+	Name        string
+	DisplayName string
+	Dir         string        `json:",omitempty"`
+	Layout      MaildirLayout `json:",omitempty"`
+	Files       []MaildirFile
 }
 
 func (m *Maildir) AddFile(file string, size int64) {
-	m.Files = append(m.Files, MaildirFile{Name: file, Size: size})
+	class := CLASS_UNKNOWN
+	path, err := ClassifyPath(file)
+	if err == nil {
+		class = path.Class
+	}
+	m.addFile(file, size, class)
+}
+
+func (m *Maildir) addFile(file string, size int64, class MaildirClass) {
+	var message *MaildirName
+	if class == CLASS_MESSAGE {
+		message, _ = ParseMaildirName(file)
+	}
+	m.Files = append(m.Files, MaildirFile{Name: file, Size: size, Class: class, Message: message})
 }
 
+// User is a mailbox identified by the path template; Archive is the user
+// name of the maildir archive and metadata file list holding it
 type User struct {
+	Archive  string
 	Maildirs map[string]*Maildir
 }
 
@@ -87,7 +113,9 @@ func (u *User) getMaildir(name string) *Maildir {
 	_, ok := u.Maildirs[name]
 	if !ok {
 		u.Maildirs[name] = &Maildir{
-			Files: []MaildirFile{},
+			Name:        name,
+			DisplayName: MaildirDisplayName(name),
+			Files:       []MaildirFile{},
 		}
 	}
 	return u.Maildirs[name]
@@ -99,15 +127,27 @@ type Tarsnap struct {
 	lengthLimit   int
 	userFilter    *regexp.Regexp
 	maildirFilter *regexp.Regexp
+	filter        *Filter
+	template      *PathTemplate
+	classes       []MaildirClass
+	explain       *regexp.Regexp
 	destDir       string
 	skipLogged    map[string]bool
 	debug         bool
 	verbose       bool
 	json          bool
 	dryrun        bool
+	metadataDir   string
+	extractedDir  string
+	logger        *slog.Logger
 }
 
 func NewTarsnap(name string) (*Tarsnap, error) {
+	return newTarsnap(name, ExpandPath(viper.GetString("metadata_dir")))
+}
+
+// newTarsnap loads the metadata from metadataDir, or extracts the metadata archive if metadataDir is empty
+func newTarsnap(name, metadataDir string) (*Tarsnap, error) {
 	viper.SetDefault("tarsnap_command", "tarsnap")
 	viper.SetDefault("user", ".*")
 	userFilter, err := regexp.Compile(viper.GetString("user"))
@@ -119,6 +159,27 @@ func NewTarsnap(name string) (*Tarsnap, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed maildir filter regexp compile: %v", err)
 	}
+	filter, err := ParseFilter(viper.GetString("filter"))
+	if err != nil {
+		return nil, err
+	}
+	viper.SetDefault("path_template", DEFAULT_PATH_TEMPLATE)
+	template, err := ParsePathTemplate(viper.GetString("path_template"))
+	if err != nil {
+		return nil, err
+	}
+	viper.SetDefault("classes", "all")
+	classes, err := ParseClasses(viper.GetString("classes"))
+	if err != nil {
+		return nil, err
+	}
+	var explain *regexp.Regexp
+	if viper.GetString("explain") != "" {
+		explain, err = regexp.Compile(viper.GetString("explain"))
+		if err != nil {
+			return nil, fmt.Errorf("failed explain regexp compile: %v", err)
+		}
+	}
 
 	t := Tarsnap{
 		Archive:       name,
@@ -126,12 +187,18 @@ func NewTarsnap(name string) (*Tarsnap, error) {
 		lengthLimit:   CMD_LENGTH_LIMIT,
 		userFilter:    userFilter,
 		maildirFilter: maildirFilter,
+		filter:        filter,
+		template:      template,
+		classes:       classes,
+		explain:       explain,
 		destDir:       ExpandPath(viper.GetString("output_dir")),
 		skipLogged:    make(map[string]bool),
 		debug:         viper.GetBool("debug"),
 		verbose:       viper.GetBool("verbose"),
 		json:          viper.GetBool("json"),
 		dryrun:        viper.GetBool("dryrun"),
+		metadataDir:   metadataDir,
+		logger:        slog.Default().With("archive", name),
 	}
 
 	/*
@@ -143,12 +210,21 @@ func NewTarsnap(name string) (*Tarsnap, error) {
 
 	err = t.initialize()
 	if err != nil {
+		t.Cleanup()
 		return nil, err
 	}
 
 	return &t, nil
 }
 
+// Cleanup removes the metadata directory extracted when no metadata_dir was given
+func (t *Tarsnap) Cleanup() {
+	if t.extractedDir != "" {
+		os.RemoveAll(t.extractedDir)
+		t.extractedDir = ""
+	}
+}
+
 func (t *Tarsnap) setLengthLimit() error {
 
 	envSize := 0
@@ -182,53 +258,128 @@ func (t *Tarsnap) setLengthLimit() error {
 func (t *Tarsnap) getUser(name string) *User {
 	_, ok := t.Users[name]
 	if !ok {
-		t.Users[name] = &User{Maildirs: make(map[string]*Maildir)}
+		t.Users[name] = &User{Archive: name, Maildirs: make(map[string]*Maildir)}
 	}
 	return t.Users[name]
 }
 
-func (t *Tarsnap) Restore() error {
+// lockOutputDir locks the output directory, returning the function releasing the lock
+func (t *Tarsnap) lockOutputDir() (func(), error) {
+	lock, err := LockOutputDir(t.destDir, t.Archive, viper.GetBool("force_unlock"))
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		err := lock.Unlock()
+		if err != nil {
+			t.logger.Error("unlock failed", "error", err)
+		}
+	}, nil
+}
 
-	restores := NewProcessSet()
-	files := []string{}
-	var cmdLength int
-	var size int64
+func (t *Tarsnap) Restore(ctx context.Context) error {
+
+	restores, err := NewProcessSet(t.Archive)
+	if err != nil {
+		return err
+	}
+
+	if !t.dryrun {
+		unlock, err := t.lockOutputDir()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	folders := []string{}
 	for userName, user := range t.Users {
+		archiveName := MaildirArchiveName(t.Archive, user.Archive)
 		for maildirName, maildir := range user.Maildirs {
-			archiveName := fmt.Sprintf("%s.%s.maildir", t.Archive, userName)
+			// directories are created rather than extracted: tarsnap extracts a directory with all of its contents
+			selected := []MaildirFile{}
 			for _, file := range maildir.Files {
-				if cmdLength+len(file.Name) > t.lengthLimit {
-					err := restores.AddRestore(archiveName, userName, maildirName, files, size)
-					if err != nil {
-						return err
-					}
-					size = 0
-					cmdLength = 0
-					files = []string{}
-				} else {
-					files = append(files, file.Name)
-					cmdLength += len(file.Name)
-					size += file.Size
+				if file.Class != CLASS_DIRECTORY {
+					selected = append(selected, file)
 				}
 			}
-			if len(files) > 0 {
-				err := restores.AddRestore(archiveName, userName, maildirName, files, size)
-				if err != nil {
-					return err
-				}
+			if len(selected) > 0 && maildir.Dir != "" {
+				folders = append(folders, maildir.Dir)
+			}
+			files, staged := restores.PlanFiles(selected)
+			err := t.addBatches(restores.AddRestore, archiveName, userName, maildirName, files)
+			if err != nil {
+				return err
+			}
+			err = t.addBatches(restores.AddStagedRestore, archiveName, userName, maildirName, staged)
+			if err != nil {
+				return err
 			}
 		}
 	}
+	restores.reportConflicts()
+
+	err = restores.Preflight()
+	if err != nil {
+		return err
+	}
 
 	if t.dryrun {
 		return nil
 	}
 
-	err := restores.Run()
+	err = t.createFolders(folders)
 	if err != nil {
 		return err
 	}
 
+	summary, err := restores.Run(ctx)
+	if t.verbose && summary != nil {
+		t.logger.Info("restore complete", "batches", summary.Batches, "completed", len(summary.Completed))
+	}
+	if err != nil {
+		return err
+	}
+
+	if viper.GetBool("verify") {
+		return restores.Verify()
+	}
+
+	return nil
+}
+
+// createFolders creates the cur, new and tmp directories of each restored folder in the output directory
+func (t *Tarsnap) createFolders(folders []string) error {
+	for _, folder := range folders {
+		for _, subdir := range MAILDIR_SUBDIRS {
+			err := os.MkdirAll(filepath.Join(t.destDir, folder, subdir), 0700)
+			if err != nil {
+				return fmt.Errorf("failed creating folder directory: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// addBatches splits files into batches within the command length limit
+func (t *Tarsnap) addBatches(add func(string, string, string, []MaildirFile) error, archiveName, userName, maildirName string, files []MaildirFile) error {
+	batch := []MaildirFile{}
+	var cmdLength int
+	for _, file := range files {
+		if len(batch) > 0 && cmdLength+len(file.Name) > t.lengthLimit {
+			err := add(archiveName, userName, maildirName, batch)
+			if err != nil {
+				return err
+			}
+			cmdLength = 0
+			batch = []MaildirFile{}
+		}
+		batch = append(batch, file)
+		cmdLength += len(file.Name) + 1
+	}
+	if len(batch) > 0 {
+		return add(archiveName, userName, maildirName, batch)
+	}
 	return nil
 }
 
@@ -239,63 +390,87 @@ func (t *Tarsnap) parseFile(userName, sizeStr, filename string) error {
 		return fmt.Errorf("failed converting file size: %v", err)
 	}
 
-	match := USER_PATTERN.FindStringSubmatch(filename)
-	if len(match) != 2 {
-		return fmt.Errorf("failed parsing username from: %s", filename)
+	path, err := t.template.Classify(filename)
+	if err != nil {
+		if strings.HasSuffix(filename, "/") {
+			// parent directories of the Maildir
+			return nil
+		}
+		return fmt.Errorf("failed parsing username from: %s: %v", filename, err)
 	}
-	if userName != match[1] {
-		return fmt.Errorf("unexpected username '%s' in %s", match[1], filename)
+	if userName != path.User && userName != path.LocalPart && userName != path.Domain {
+		return fmt.Errorf("unexpected username '%s' in %s", path.User, filename)
 	}
 
-	user := t.getUser(userName)
+	if !t.userFilter.MatchString(path.User) && !t.userFilter.MatchString(userName) {
+		if t.verbose && !t.skipLogged["user:"+path.User] {
+			t.logger.Info("skipping filtered user", "user", path.User)
+			t.skipLogged["user:"+path.User] = true
+		}
+		return nil
+	}
 
-	maildirName := ""
-	match = MAILDIR_PATTERN.FindStringSubmatch(filename)
+	maildirName := path.Folder
 
 	if t.debug {
-		log.Printf("\nLINE: %s\n", filename)
-		log.Printf("MAILDIR_PATTERN: %d %v\n", len(match), match)
-	}
-
-	if len(match) == 2 {
-		maildirName = match[1]
-	}
-	if maildirName == "" || !strings.HasPrefix(maildirName, ".") {
-		maildirName = "INBOX"
+		t.logger.Debug("MAILDIR", "user", path.User, "maildir", maildirName, "class", path.Class, "layout", path.Layout)
 	}
 
-	if t.debug {
-		log.Printf("MAILDIR: %s\n", maildirName)
+	if path.Class != CLASS_DIRECTORY && !slices.Contains(t.classes, path.Class) {
+		if t.explain != nil && t.explain.MatchString(filename) {
+			t.logger.Info("explain", "file", filename, "result", "rejected by --classes: "+string(path.Class))
+		}
+		return nil
 	}
 
-	if !t.maildirFilter.MatchString(maildirName) {
+	if !t.maildirFilter.MatchString(maildirName) && !t.maildirFilter.MatchString(MaildirDisplayName(maildirName)) {
+		if t.explain != nil && t.explain.MatchString(filename) {
+			t.logger.Info("explain", "file", filename, "result", "rejected by --maildir")
+		}
 		if t.verbose {
 			_, ok := t.skipLogged[maildirName]
 			if !ok {
-				log.Printf("skipping filtered maildirName: %s\n", maildirName)
+				t.logger.Info("skipping filtered maildir", "maildir", maildirName)
 				t.skipLogged[maildirName] = true
 			}
 		}
 		return nil
 	}
 
+	if len(t.filter.Rules) > 0 || t.explain != nil {
+		file := newFilterFile(path.User, maildirName, filename, size, path)
+		selected, _ := t.filter.Match(file)
+		if t.explain != nil && t.explain.MatchString(filename) {
+			t.logger.Info("explain", "file", filename, "result", t.filter.Explain(file))
+		}
+		if !selected {
+			return nil
+		}
+	}
+
+	user := t.getUser(path.User)
+	user.Archive = userName
 	maildir := user.getMaildir(maildirName)
+	if maildirName != MAILBOX_FOLDER {
+		maildir.Dir = path.FolderDir
+		maildir.Layout = path.Layout
+	}
 
 	if t.debug {
-		log.Printf("add %s %s %s\n", userName, maildirName, filename)
+		t.logger.Debug("add", "user", path.User, "maildir", maildirName, "file", filename)
 	}
 
-	maildir.AddFile(filename, size)
+	maildir.addFile(filename, size, path.Class)
 
 	return nil
 }
 
 func (t *Tarsnap) initialize() error {
 
-	metadataDir := ExpandPath(viper.GetString("metadata_dir"))
+	metadataDir := t.metadataDir
 
 	if t.verbose && metadataDir != "" {
-		log.Printf("using preloaded metadata in: %s", metadataDir)
+		t.logger.Info("using preloaded metadata", "dir", metadataDir)
 	}
 
 	if metadataDir == "" {
@@ -304,8 +479,9 @@ func (t *Tarsnap) initialize() error {
 			return err
 		}
 		metadataDir = dir
+		t.extractedDir = dir
 		//defer os.RemoveAll(metadataDir)
-		metadataArchive := fmt.Sprintf("%s.metadata", t.Archive)
+		metadataArchive := MetadataArchiveName(t.Archive)
 		args := []string{
 			"-x",
 			"--keyfile", ExpandPath(viper.GetString("keyfile")),
@@ -313,16 +489,20 @@ func (t *Tarsnap) initialize() error {
 			"-C", metadataDir,
 		}
 		if t.verbose {
-			log.Printf("extracting metadata: %s\n", metadataArchive)
+			t.logger.Info("extracting metadata", "tarsnap_archive", metadataArchive)
 		}
 		p := NewTarsnapProcess(args)
-		_, _, err = p.Run()
+		p.logger = t.logger
+		_, stderr, err := p.Run()
+		if stderr != "" {
+			t.logger.Warn("tarsnap stderr", "tarsnap_archive", metadataArchive, "stderr", strings.TrimSpace(stderr))
+		}
 		if err != nil {
 			return fmt.Errorf("metadata extract failed: %v", err)
 		}
 	}
 	if t.verbose {
-		log.Printf("reading metadata dir: %s\n", metadataDir)
+		t.logger.Info("reading metadata dir", "dir", metadataDir)
 	}
 	entries, err := os.ReadDir(metadataDir)
 	if err != nil {
@@ -331,7 +511,7 @@ func (t *Tarsnap) initialize() error {
 	for _, entry := range entries {
 		if entry.Type().IsRegular() {
 			if t.verbose {
-				log.Printf("reading metadata file: %s\n", entry.Name())
+				t.logger.Info("reading metadata file", "file", entry.Name())
 			}
 			err := t.readFileList(filepath.Join(metadataDir, entry.Name()))
 			if err != nil {
@@ -346,19 +526,19 @@ func (t *Tarsnap) readFileList(pathname string) error {
 
 	_, filename := filepath.Split(pathname)
 
-	if t.verbose {
-		log.Printf("reading %s\n", filename)
+	if t.debug {
+		t.logger.Debug("reading file_list", "file", filename)
 	}
 
-	match := LIST_FILENAME_PATTERN.FindStringSubmatch(filename)
-	if len(match) != 2 {
-		return fmt.Errorf("file_list filename parse failed: %d %v", len(match), match)
+	userName, err := t.fileListUser(filename)
+	if err != nil {
+		return err
 	}
-	userName := match[1]
 
-	if !t.userFilter.MatchString(userName) {
+	// with a {domain} template the user identities are known only from the archive paths
+	if !t.template.HasDomain() && !t.userFilter.MatchString(userName) {
 		if t.verbose {
-			log.Printf("skipping filtered username: %s\n", userName)
+			t.logger.Info("skipping filtered user", "user", userName)
 		}
 		return nil
 	}
@@ -368,6 +548,7 @@ func (t *Tarsnap) readFileList(pathname string) error {
 		return err
 	}
 	defer file.Close()
+	sizes := make(map[string]string)
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -375,7 +556,19 @@ func (t *Tarsnap) readFileList(pathname string) error {
 		if len(match) != 3 {
 			return fmt.Errorf("file_list line parse failed: %d %v", len(match), match)
 		}
-		err := t.parseFile(userName, match[1], match[2])
+		size, filename := match[1], match[2]
+		if strings.HasPrefix(line, "h") {
+			// hard links are listed as NAME link to TARGET with size 0; the target is listed before the link
+			var target string
+			filename, target, _ = strings.Cut(filename, " link to ")
+			targetSize, ok := sizes[target]
+			if ok {
+				size = targetSize
+			}
+		} else {
+			sizes[filename] = size
+		}
+		err := t.parseFile(userName, size, filename)
 		if err != nil {
 			return err
 		}
@@ -383,6 +576,42 @@ func (t *Tarsnap) readFileList(pathname string) error {
 	return nil
 }
 
+// fileListUser returns the username from a metadata filename YYYY-MM-DD.HOST.USER.file_list
+func (t *Tarsnap) fileListUser(filename string) (string, error) {
+	return FileListUser(t.Archive, filename)
+}
+
+// FileListUser strips the archive base name first so that hosts and usernames may contain dots
+func FileListUser(base, filename string) (string, error) {
+	prefix := base + "."
+	if strings.HasPrefix(filename, prefix) && strings.HasSuffix(filename, LIST_FILENAME_SUFFIX) {
+		userName := strings.TrimSuffix(strings.TrimPrefix(filename, prefix), LIST_FILENAME_SUFFIX)
+		if userName != "" {
+			return userName, nil
+		}
+	}
+	match := LIST_FILENAME_PATTERN.FindStringSubmatch(filename)
+	if len(match) != 2 {
+		return "", fmt.Errorf("file_list filename parse failed: %d %v", len(match), match)
+	}
+	return match[1], nil
+}
+
+// MaildirFiles returns the selected files with their class and parsed message name
+func (t *Tarsnap) MaildirFiles() []MaildirFile {
+	files := []MaildirFile{}
+	for _, user := range t.Users {
+		for _, maildir := range user.Maildirs {
+			for _, file := range maildir.Files {
+				if file.Class != CLASS_DIRECTORY {
+					files = append(files, file)
+				}
+			}
+		}
+	}
+	return files
+}
+
 func (t *Tarsnap) Files() []string {
 	files := []string{}
 	for _, user := range t.Users {
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"context"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/require"
 	"testing"
@@ -46,6 +47,6 @@ func TestTarsnapRestore(t *testing.T) {
 	viper.Set("user", "test")
 	ts := initTarsnap(t)
 	checkTarsnap(t, ts)
-	err := ts.Restore()
+	err := ts.Restore(context.Background())
 	require.Nil(t, err)
 }
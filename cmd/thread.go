@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"sort"
+	"strings"
+)
+
+// ThreadMessages returns the messages of the conversation threads containing the seed messages
+//
+// Messages are linked through their Message-ID, In-Reply-To and References
+// headers; a thread is every message reachable from a seed through these
+// links, so replies whose parent is missing are still joined by a shared
+// reference. Copies of a message in several folders or mailboxes are all
+// returned. The result is ordered by date.
+func ThreadMessages(messages []CatalogMessage, seeds []CatalogMessage) []CatalogMessage {
+	links := make(map[string][]string)
+	link := func(a, b string) {
+		if a == "" || b == "" || a == b {
+			return
+		}
+		links[a] = append(links[a], b)
+		links[b] = append(links[b], a)
+	}
+	for _, m := range messages {
+		for _, id := range threadReferences(m) {
+			link(m.MessageID, id)
+		}
+	}
+
+	thread := make(map[string]bool)
+	pending := []string{}
+	visit := func(id string) {
+		if id != "" && !thread[id] {
+			thread[id] = true
+			pending = append(pending, id)
+		}
+	}
+	seedPaths := make(map[string]bool)
+	for _, seed := range seeds {
+		seedPaths[seed.Archive+"\x00"+seed.Path] = true
+		visit(seed.MessageID)
+		for _, id := range threadReferences(seed) {
+			visit(id)
+		}
+	}
+	for len(pending) > 0 {
+		id := pending[0]
+		pending = pending[1:]
+		for _, linked := range links[id] {
+			visit(linked)
+		}
+	}
+
+	selected := []CatalogMessage{}
+	for _, m := range messages {
+		if thread[m.MessageID] || seedPaths[m.Archive+"\x00"+m.Path] {
+			selected = append(selected, m)
+		}
+	}
+	sort.SliceStable(selected, func(i, j int) bool {
+		return selected[i].Date.Before(selected[j].Date)
+	})
+	return selected
+}
+
+func threadReferences(m CatalogMessage) []string {
+	ids := strings.Fields(m.References)
+	if m.InReplyTo != "" {
+		ids = append(ids, m.InReplyTo)
+	}
+	return ids
+}
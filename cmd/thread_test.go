@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestThreadMessages(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2024, 4, d, 0, 0, 0, 0, time.UTC)
+	}
+	messages := []CatalogMessage{
+		{Path: "inbox/1", MessageID: "order@vendor", Date: day(1)},
+		{Path: "sent/2", MessageID: "reply@us", InReplyTo: "order@vendor", References: "order@vendor", Date: day(2)},
+		// parent not archived: joined by the shared reference
+		{Path: "inbox/4", MessageID: "late@vendor", InReplyTo: "missing@vendor", References: "order@vendor missing@vendor", Date: day(4)},
+		{Path: "archive/3", MessageID: "ack@vendor", InReplyTo: "reply@us", Date: day(3)},
+		// copy of the reply in another mailbox
+		{Path: "bob/inbox/2", MessageID: "reply@us", Date: day(2)},
+		{Path: "inbox/9", MessageID: "other@vendor", Date: day(9)},
+		{Path: "inbox/10", MessageID: "other-reply@us", References: "other@vendor", Date: day(10)},
+		{Path: "inbox/11", Date: day(11)},
+	}
+	paths := func(selected []CatalogMessage) []string {
+		result := []string{}
+		for _, m := range selected {
+			result = append(result, m.Path)
+		}
+		return result
+	}
+	expected := []string{"inbox/1", "sent/2", "bob/inbox/2", "archive/3", "inbox/4"}
+	require.Equal(t, expected, paths(ThreadMessages(messages, []CatalogMessage{messages[3]})))
+	require.Equal(t, expected, paths(ThreadMessages(messages, []CatalogMessage{{MessageID: "order@vendor"}})))
+	require.Equal(t, []string{"inbox/9", "inbox/10"}, paths(ThreadMessages(messages, []CatalogMessage{messages[5]})))
+	require.Equal(t, []string{"inbox/11"}, paths(ThreadMessages(messages, []CatalogMessage{messages[7]})))
+}
@@ -0,0 +1,339 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// TRENDS_ANOMALY_EXIT is the exit code used by watch-trends when anomalies are detected
+const TRENDS_ANOMALY_EXIT = 2
+
+var watchTrendsCmd = &cobra.Command{
+	Use:   "watch-trends",
+	Short: "detect mass deletions and other anomalies across daily backups",
+	Long: `
+Load the metadata for a sliding window of daily archives, ending with the
+latest archive or the archive selected with --date, and compute per-user
+and per-maildir message counts and sizes for each day.
+
+Day-over-day changes are flagged as anomalies when:
+  message count or size drops by more than --drop-percent
+  message count or size grows by more than --spike-percent
+  more than --flag-change-percent of messages change Maildir flags
+Counts below --min-messages are not evaluated.
+
+Exits 0 if no anomalies are found, 2 if anomalies are found, and 1 on error.
+`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		report, err := WatchTrends()
+		cobra.CheckErr(err)
+		if viper.GetBool("json") {
+			fmt.Println(FormatJSON(report))
+		} else {
+			report.Print(viper.GetBool("verbose"))
+		}
+		if len(report.Anomalies) > 0 {
+			CloseLog()
+			os.Exit(TRENDS_ANOMALY_EXIT)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(watchTrendsCmd)
+}
+
+type TrendStats struct {
+	Messages int
+	Bytes    int64
+}
+
+type TrendThresholds struct {
+	DropPercent       int
+	SpikePercent      int
+	FlagChangePercent int
+	MinMessages       int
+}
+
+// TrendDay holds the message statistics of one daily archive
+type TrendDay struct {
+	Archive  string
+	Date     string
+	Users    map[string]*TrendStats
+	Maildirs map[string]map[string]*TrendStats
+	flags    map[string]string
+}
+
+type TrendAnomaly struct {
+	Date     string
+	Previous string
+	User     string
+	Maildir  string `json:",omitempty"`
+	Kind     string
+	Before   int64
+	After    int64
+	Percent  int
+}
+
+type TrendReport struct {
+	Host       string
+	Thresholds TrendThresholds
+	Days       []*TrendDay
+	Anomalies  []TrendAnomaly
+}
+
+func NewTrendDay(t *Tarsnap) *TrendDay {
+	d := TrendDay{
+		Archive:  t.Archive,
+		Users:    make(map[string]*TrendStats),
+		Maildirs: make(map[string]map[string]*TrendStats),
+		flags:    make(map[string]string),
+	}
+	date, _, err := ParseArchiveBase(t.Archive)
+	if err == nil {
+		d.Date = date.Format(DATE_FORMAT)
+	}
+	for userName, user := range t.Users {
+		userStats := TrendStats{}
+		d.Users[userName] = &userStats
+		d.Maildirs[userName] = make(map[string]*TrendStats)
+		for maildirName, maildir := range user.Maildirs {
+			maildirStats := TrendStats{}
+			d.Maildirs[userName][maildirName] = &maildirStats
+			for _, file := range maildir.Files {
+				// messages still in tmp have not been delivered
+				if file.Message == nil || path.Base(path.Dir(file.Name)) == "tmp" {
+					continue
+				}
+				maildirStats.Messages += 1
+				maildirStats.Bytes += file.Size
+				d.flags[userName+"/"+file.Message.Unique] = file.Message.Flags
+			}
+			userStats.Messages += maildirStats.Messages
+			userStats.Bytes += maildirStats.Bytes
+		}
+	}
+	return &d
+}
+
+func percentChange(before, after int64) int {
+	if before == 0 {
+		return 0
+	}
+	return int((after - before) * 100 / before)
+}
+
+func (r *TrendReport) compare(previous, current *TrendDay, user, maildir string, before, after *TrendStats) {
+	add := func(kind string, b, a int64) {
+		r.Anomalies = append(r.Anomalies, TrendAnomaly{
+			Date:     current.Date,
+			Previous: previous.Date,
+			User:     user,
+			Maildir:  maildir,
+			Kind:     kind,
+			Before:   b,
+			After:    a,
+			Percent:  percentChange(b, a),
+		})
+	}
+	if before == nil {
+		before = &TrendStats{}
+	}
+	if after == nil {
+		after = &TrendStats{}
+	}
+	if before.Messages >= r.Thresholds.MinMessages {
+		if -percentChange(int64(before.Messages), int64(after.Messages)) > r.Thresholds.DropPercent {
+			add("message-drop", int64(before.Messages), int64(after.Messages))
+		} else if -percentChange(before.Bytes, after.Bytes) > r.Thresholds.DropPercent {
+			add("size-drop", before.Bytes, after.Bytes)
+		}
+	}
+	if after.Messages >= r.Thresholds.MinMessages && before.Messages > 0 {
+		if percentChange(int64(before.Messages), int64(after.Messages)) > r.Thresholds.SpikePercent {
+			add("message-spike", int64(before.Messages), int64(after.Messages))
+		} else if percentChange(before.Bytes, after.Bytes) > r.Thresholds.SpikePercent {
+			add("size-spike", before.Bytes, after.Bytes)
+		}
+	}
+}
+
+func (r *TrendReport) compareFlags(previous, current *TrendDay) {
+	common := make(map[string]int64)
+	changed := make(map[string]int64)
+	for key, flags := range current.flags {
+		before, ok := previous.flags[key]
+		if !ok {
+			continue
+		}
+		user, _, _ := strings.Cut(key, "/")
+		common[user] += 1
+		if before != flags {
+			changed[user] += 1
+		}
+	}
+	for _, user := range SortedKeys(common) {
+		if common[user] < int64(r.Thresholds.MinMessages) {
+			continue
+		}
+		percent := int(changed[user] * 100 / common[user])
+		if percent > r.Thresholds.FlagChangePercent {
+			r.Anomalies = append(r.Anomalies, TrendAnomaly{
+				Date:     current.Date,
+				Previous: previous.Date,
+				User:     user,
+				Kind:     "flag-change",
+				Before:   common[user],
+				After:    changed[user],
+				Percent:  percent,
+			})
+		}
+	}
+}
+
+// Analyze compares each day with the previous day in the window
+func (r *TrendReport) Analyze() {
+	r.Anomalies = []TrendAnomaly{}
+	for i := 1; i < len(r.Days); i++ {
+		previous, current := r.Days[i-1], r.Days[i]
+		users := make(map[string]bool)
+		for user := range previous.Users {
+			users[user] = true
+		}
+		for user := range current.Users {
+			users[user] = true
+		}
+		for _, user := range SortedKeys(users) {
+			r.compare(previous, current, user, "", previous.Users[user], current.Users[user])
+			maildirs := make(map[string]bool)
+			for maildir := range previous.Maildirs[user] {
+				maildirs[maildir] = true
+			}
+			for maildir := range current.Maildirs[user] {
+				maildirs[maildir] = true
+			}
+			for _, maildir := range SortedKeys(maildirs) {
+				r.compare(previous, current, user, maildir, previous.Maildirs[user][maildir], current.Maildirs[user][maildir])
+			}
+		}
+		r.compareFlags(previous, current)
+	}
+}
+
+// WatchTrends loads the metadata of the daily archives in the configured window and analyzes them
+func WatchTrends() (*TrendReport, error) {
+	days := viper.GetInt("days")
+	if days < 2 {
+		return nil, fmt.Errorf("--days must be at least 2")
+	}
+	var date time.Time
+	if viper.GetString("date") != "" {
+		var err error
+		date, err = ParseDate(viper.GetString("date"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	names, err := ListArchives()
+	if err != nil {
+		return nil, err
+	}
+	archives, _ := ParseArchiveList(names)
+	base, err := ResolveArchive(archives, viper.GetString("host"), date)
+	if err != nil {
+		return nil, err
+	}
+	last, host, err := ParseArchiveBase(base)
+	if err != nil {
+		return nil, err
+	}
+	first := last.AddDate(0, 0, 1-days)
+
+	report := TrendReport{
+		Host: host,
+		Thresholds: TrendThresholds{
+			DropPercent:       viper.GetInt("drop_percent"),
+			SpikePercent:      viper.GetInt("spike_percent"),
+			FlagChangePercent: viper.GetInt("flag_change_percent"),
+			MinMessages:       viper.GetInt("min_messages"),
+		},
+		Days: []*TrendDay{},
+	}
+	for _, a := range archives {
+		if a.Kind != ARCHIVE_METADATA || a.Host != host || a.Date.Before(first) || a.Date.After(last) {
+			continue
+		}
+		t, err := newTarsnap(a.Base(), "")
+		if err != nil {
+			return nil, err
+		}
+		report.Days = append(report.Days, NewTrendDay(t))
+		t.Cleanup()
+	}
+	sort.Slice(report.Days, func(i, j int) bool { return report.Days[i].Date < report.Days[j].Date })
+	report.Analyze()
+	return &report, nil
+}
+
+func (r *TrendReport) Print(verbose bool) {
+	if verbose {
+		for _, day := range r.Days {
+			for _, user := range SortedKeys(day.Users) {
+				stats := day.Users[user]
+				fmt.Printf("%s %s %d messages %d bytes\n", day.Date, user, stats.Messages, stats.Bytes)
+			}
+		}
+	}
+	for _, a := range r.Anomalies {
+		maildir := MaildirDisplayName(a.Maildir)
+		if maildir == "" {
+			maildir = "*"
+		}
+		if a.Kind == "flag-change" {
+			fmt.Printf("%s %s %s %s: %d of %d messages changed flags (%d%%) since %s\n", a.Date, a.User, maildir, a.Kind, a.After, a.Before, a.Percent, a.Previous)
+		} else {
+			fmt.Printf("%s %s %s %s: %d -> %d (%+d%%) since %s\n", a.Date, a.User, maildir, a.Kind, a.Before, a.After, a.Percent, a.Previous)
+		}
+	}
+	if len(r.Anomalies) == 0 {
+		fmt.Printf("%s: no anomalies in %d days\n", r.Host, len(r.Days))
+	}
+}
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func trendTestDay(archive string, messages int, flags string) *TrendDay {
+	t := Tarsnap{Archive: archive, Users: make(map[string]*User)}
+	inbox := t.getUser("alice").getMaildir("INBOX")
+	for i := 0; i < messages; i++ {
+		inbox.AddFile(fmt.Sprintf("./alice/Maildir/cur/%d.M1P1.host:2,%s", i, flags), 1000)
+	}
+	inbox.AddFile("./alice/Maildir/dovecot-uidlist", 100)
+	return NewTrendDay(&t)
+}
+
+func TestTrendsAnalyze(t *testing.T) {
+	report := TrendReport{
+		Thresholds: TrendThresholds{DropPercent: 50, SpikePercent: 100, FlagChangePercent: 25, MinMessages: 10},
+		Days: []*TrendDay{
+			trendTestDay("2025-03-01.mail1", 100, "S"),
+			trendTestDay("2025-03-02.mail1", 100, "ST"),
+			trendTestDay("2025-03-03.mail1", 20, "ST"),
+		},
+	}
+	require.Equal(t, 100, report.Days[0].Users["alice"].Messages)
+	report.Analyze()
+	kinds := []string{}
+	for _, a := range report.Anomalies {
+		kinds = append(kinds, a.Date+" "+a.Maildir+" "+a.Kind)
+	}
+	require.Equal(t, []string{
+		"2025-03-02  flag-change",
+		"2025-03-03  message-drop",
+		"2025-03-03 INBOX message-drop",
+	}, kinds)
+}
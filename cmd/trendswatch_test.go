@@ -0,0 +1,42 @@
+//go:build unix
+
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchTrendsCleanup(t *testing.T) {
+	// the fake tarsnap lists two daily metadata archives and extracts a file list from each
+	script := filepath.Join(t.TempDir(), "tarsnap")
+	require.Nil(t, os.WriteFile(script, []byte(`#!/bin/sh
+dir=.
+for arg; do
+  case "$prev" in
+    -C) dir="$arg";;
+    -f) archive="$arg";;
+  esac
+  prev="$arg"
+done
+case " $* " in
+  *" --list-archives "*) printf '2025-06-24.mailbox.metadata\n2025-06-25.mailbox.metadata\n'; exit 0;;
+esac
+echo "-rw------- 1 alice alice 6 Jun 25 10:00 ./alice/Maildir/cur/1.M1P1.host,S=6:2,S" > "$dir/${archive%.metadata}.alice.file_list"
+`), 0700))
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	restore := OverrideOptions(map[string]any{"tarsnap_command": script, "keyfile": "", "days": 2, "host": "", "date": "", "metadata_dir": ""})
+	defer restore()
+
+	report, err := WatchTrends()
+	require.Nil(t, err)
+	require.Len(t, report.Days, 2)
+	// the extracted metadata directories are removed
+	entries, err := os.ReadDir(tmp)
+	require.Nil(t, err)
+	require.Empty(t, entries)
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+// MUTF7_ENCODING is the base64 variant of IMAP modified UTF-7 (RFC 3501 5.1.3)
+var MUTF7_ENCODING = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+,").WithPadding(base64.NoPadding)
+
+// DecodeModifiedUTF7 decodes an IMAP modified UTF-7 mailbox name
+func DecodeModifiedUTF7(name string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c != '&' {
+			if c < 0x20 || c > 0x7e {
+				return "", fmt.Errorf("invalid character in modified UTF-7: %q", name)
+			}
+			b.WriteByte(c)
+			continue
+		}
+		end := strings.IndexByte(name[i+1:], '-')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated modified UTF-7 shift: %q", name)
+		}
+		encoded := name[i+1 : i+1+end]
+		i += end + 1
+		if encoded == "" {
+			b.WriteByte('&')
+			continue
+		}
+		data, err := MUTF7_ENCODING.DecodeString(encoded)
+		if err != nil || len(data)%2 != 0 {
+			return "", fmt.Errorf("invalid modified UTF-7 sequence '&%s-' in %q", encoded, name)
+		}
+		units := make([]uint16, len(data)/2)
+		for j := range units {
+			units[j] = uint16(data[2*j])<<8 | uint16(data[2*j+1])
+		}
+		b.WriteString(string(utf16.Decode(units)))
+	}
+	return b.String(), nil
+}
+
+// MaildirDisplayName returns the readable folder path of a Maildir++ or LAYOUT=fs folder name,
+// decoding modified UTF-7 and replacing the Maildir++ . hierarchy separator with /
+//
+//	.Entw&APw-rfe        Entwürfe
+//	.Archive.&AMQ-rger   Archive/Ärger
+//	Archive/&AMQ-rger    Archive/Ärger
+//
+// Names that cannot be decoded are returned unchanged.
+func MaildirDisplayName(name string) string {
+	switch name {
+	case "INBOX":
+		return name
+	case MAILBOX_FOLDER:
+		return "(mailbox)"
+	}
+	parts := strings.Split(name, "/")
+	if strings.HasPrefix(name, ".") {
+		parts = strings.Split(strings.TrimPrefix(name, "."), ".")
+	}
+	for i, part := range parts {
+		decoded, err := DecodeModifiedUTF7(part)
+		if err != nil {
+			return name
+		}
+		parts[i] = decoded
+	}
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestUTF7Decode(t *testing.T) {
+	cases := map[string]string{
+		"Sent":                    "Sent",
+		"&AMQ-rger":               "Ärger",
+		"Entw&APw-rfe":            "Entwürfe",
+		"&AMk-l&AOk-ments":        "Éléments",
+		"Tom &- Jerry":            "Tom & Jerry",
+		"&ZeVnLIqe-":              "日本語",
+		"&2D3eAA-":                "😀",
+		"Envoy&AOk-s envoy&AOk-s": "Envoyés envoyés",
+	}
+	for encoded, decoded := range cases {
+		value, err := DecodeModifiedUTF7(encoded)
+		require.Nil(t, err, encoded)
+		require.Equal(t, decoded, value, encoded)
+	}
+	for _, invalid := range []string{"&AMQ", "&A-", "café"} {
+		_, err := DecodeModifiedUTF7(invalid)
+		require.NotNil(t, err, invalid)
+	}
+
+	require.Equal(t, "INBOX", MaildirDisplayName("INBOX"))
+	require.Equal(t, "Entwürfe", MaildirDisplayName(".Entw&APw-rfe"))
+	require.Equal(t, "Archive/Ärger", MaildirDisplayName(".Archive.&AMQ-rger"))
+	require.Equal(t, ".bad&AMQ", MaildirDisplayName(".bad&AMQ"))
+}